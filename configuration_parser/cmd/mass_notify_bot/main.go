@@ -4,7 +4,11 @@ import (
 	"configuration_parser/internal/command_parser"
 	"configuration_parser/internal/repository/postgres"
 	"configuration_parser/internal/telegram_api"
+	"configuration_parser/internal/webhook"
+	"context"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/joho/godotenv"
 	_ "github.com/lib/pq"
@@ -26,13 +30,20 @@ func main() {
 	}
 	defer repository.Close()
 
-	parser := command_parser.NewService(repository)
+	parser := command_parser.NewService(repository, webhook.NewClient())
 	tgApiService, err := telegram_api.NewService(logger, parser)
 	if err != nil {
 		logger.Panic().Msgf("failed to setup telegram api: %v", err)
 	}
 
-	logger.Fatal().Msgf("failed to listen telegram api server: %v", tgApiService.ListenAndServe())
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	if err := tgApiService.ListenAndServe(ctx); err != nil {
+		logger.Error().Msgf("failed to listen telegram api server: %v", err)
+		return
+	}
+	logger.Info().Msg("bot is stopped")
 }
 
 func initLogger() zerolog.Logger {
@@ -6,11 +6,66 @@ var (
 	AlreadyLoggedIn         = "You already logged in."
 	InternalError           = "An internal error has occurred"
 	LoginSuccessful         = "Login successful."
+	Reactivated             = "Welcome back! You will receive notifications again."
+	Exited                  = "You will no longer receive notifications. Use /start to come back."
+	AlreadyExited           = "You have already exited. Use /start to come back."
 	IncorrectUsageOfCommand = "Incorrect use of the command!\n\n" +
-		"You must specify only the user you want to %v access to - %v @username\n\n"
+		"You must specify the users you want to %v access to - %v @username1 @username2\n\n" +
+		"Up to %v users separated by spaces or commas."
 	NotLoggedIn           = "@%v not logged in."
+	RenamedUser           = "%v (formerly @%v)"
 	AlreadyHasAccess      = "@%v already has access to send you notifications."
 	CanSendNotifications  = "@%v can now send you notifications"
 	HaveNotAccess         = "@%v does not have access to send you notifications."
 	CantSendNotifications = "@%s can no longer send you notifications"
+	NotRegistered         = "You are not logged in. Use /start first."
+
+	NoAccessGranted      = "Nobody can send you notifications. Use /grant_access @username to allow somebody."
+	AccessHeader         = "%v user(s) can send you notifications, page %v of %v:\n\n"
+	AccessItem           = "%v. @%v"
+	AccessItemExited     = " (exited)"
+	AccessRevoked        = "Access revoked."
+	AccessAlreadyRevoked = "The user already has no access."
+
+	RemoveAllAccessUsage   = "\n\nUse /remove_access all to deny access to everybody."
+	ConfirmRemoveAllAccess = "%v user(s) will no longer be able to send you notifications. Are you sure?"
+	AllAccessRemoved       = "Removed access of %v user(s)."
+	RemoveAllAccessCancel  = "Nothing has changed."
+
+	ApiKeyCreated = "Your new API key:\n\n%v\n\n" +
+		"Pass it in the Authorization header as \"Bearer <key>\". " +
+		"Keep it secret, it will not be shown again."
+	NoApiKeys      = "You have no active API keys."
+	ApiKeysRevoked = "Revoked %v API key(s)."
+
+	NoSubscriptions     = "You have no recurring notifications."
+	SubscriptionsHeader = "Your recurring notifications:\n\n"
+	SubscriptionItem    = "#%v from %v\n" +
+		"schedule: %v (%v), next at %v\n" +
+		"%v\n\n"
+	IncorrectUsageOfUnsubscribe = "Incorrect use of the command!\n\n" +
+		"You must specify the id of the recurring notification - /unsubscribe id\n\n" +
+		"Use /subscriptions to see the ids."
+	NotSubscribed = "You are not subscribed to the recurring notification #%v."
+	Unsubscribed  = "You will no longer receive the recurring notification #%v."
+
+	IncorrectUsageOfRequestAccess = "Incorrect use of the command!\n\n" +
+		"You must specify the user you want to send notifications to - /request_access @username"
+	AccessRequestToSelf         = "You do not need access to send notifications to yourself."
+	AccessAlreadyGranted        = "@%v already lets you send them notifications."
+	AccessRequestPending        = "Your request to @%v is still waiting for an answer."
+	AccessRequestRecentlyDenied = "@%v has recently denied your request, try again later."
+	TooManyAccessRequests       = "You have sent too many access requests today, try again tomorrow."
+	AccessRequested             = "@%v is asked to let you send them notifications, the request expires at %v. " +
+		"You will be told the answer."
+	AccessRequestAnnouncement = "@%v asks to send you notifications. The request expires at %v."
+	AccessRequestDeniedByYou  = "You have denied the request of @%v."
+	AccessRequestExpired      = "The request of @%v has expired."
+	AccessRequestNotPending   = "This request is no longer waiting for an answer."
+	YourAccessRequestApproved = "@%v has approved your request, you can now send them notifications."
+	YourAccessRequestDenied   = "@%v has denied your request to send them notifications."
+	YourAccessRequestExpired  = "@%v has not answered your request to send them notifications in time."
+
+	ActionRecorded = "Done."
+	UnknownAction  = "This button is no longer available."
 )
@@ -1,39 +1,79 @@
 package command_parser
 
 import (
+	"configuration_parser/internal/model"
 	"configuration_parser/internal/repository"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"strconv"
 	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	apiKeyLength              = 32
+	subscriptionPreviewLength = 50
+	accessPageSize            = 10
+	maxUserNames              = 20
+	removeAllAccess           = "all"
+
+	accessRequestsBatchSize = 100
+	accessRequestTimeLayout = "2006-01-02 15:04 MST"
 )
 
 type repo interface {
 	InsertUser(userId int64, userName string) error
-	GetUser(userName string) (int64, error)
-	AddNotificationAccess(userId int64, userNameWithAccess string) error
-	RemoveNotificationAccess(userId int64, userNameWithAccess string) error
+	GetUser(userName string) (model.User, error)
+	GetUsers(userNames []string) (map[string]model.User, error)
+	UpdateUserName(userId int64, userName string) error
+	SetUserActive(userId int64, isActive bool) (bool, error)
+	RemoveNotificationAccess(userId int64, grantedUserId int64) error
+	GrantNotificationAccess(userId int64, grantedUsersId []int64) (map[int64]bool, error)
+	RevokeNotificationAccess(userId int64, grantedUsersId []int64) (map[int64]bool, error)
+	RevokeAllNotificationAccess(userId int64) (int64, error)
+	ListNotificationAccess(userId int64, offset int, limit int) ([]model.User, int, error)
+	InsertApiKey(userId int64, keyHash string) error
+	RevokeApiKeys(userId int64) (int64, error)
+	ListSubscriptions(userId int64) ([]model.Subscription, error)
+	Unsubscribe(userId int64, recurringId int64) error
+	RecordNotificationAction(notificationId int64, userId int64, action string) (model.NotificationAction, error)
+	GetNotificationWebhook(notificationId int64) (string, string, error)
+	CreateAccessRequest(requesterId int64, recipientId int64) (model.AccessRequest, error)
+	ListUnannouncedAccessRequests(limit int) ([]model.AccessRequest, error)
+	SetAccessRequestAnnounced(requestId int64, messageId int) error
+	ExpireAccessRequests(limit int) ([]model.AccessRequest, error)
+	DecideAccessRequest(requestId int64, recipientId int64, status string) (model.AccessRequest, error)
+}
+
+type webhook interface {
+	PostAction(url string, secret string, action model.NotificationAction) error
 }
 
 type Service struct {
-	repo repo
+	repo    repo
+	webhook webhook
 }
 
-func NewService(repo repo) *Service {
+func NewService(repo repo, webhook webhook) *Service {
 	return &Service{
-		repo: repo,
+		repo:    repo,
+		webhook: webhook,
 	}
 }
 
 func (s *Service) Start(userId int64, userName string) (string, error) {
-	if len(userName) < 0 {
+	if len(userName) == 0 {
 		return MissingUserName, nil
 	}
 
 	err := s.repo.InsertUser(userId, userName)
 	if err != nil {
-		// TODO check isActive
 		switch err {
 		case repository.ErrAlreadyExists:
-			return AlreadyLoggedIn, nil
+			return s.reactivate(userId)
 		default:
 			return InternalError, fmt.Errorf("failed to insert user in database, %v", err)
 		}
@@ -41,58 +81,478 @@ func (s *Service) Start(userId int64, userName string) (string, error) {
 	return LoginSuccessful, nil
 }
 
+// reactivate activates the user who has exited before.
+func (s *Service) reactivate(userId int64) (string, error) {
+	activated, err := s.repo.SetUserActive(userId, true)
+	if err != nil {
+		return InternalError, fmt.Errorf("failed to activate user, %v", err)
+	}
+	if !activated {
+		return AlreadyLoggedIn, nil
+	}
+	return Reactivated, nil
+}
+
+// Exit deactivates the user, so nobody can send them notifications until they /start again.
+func (s *Service) Exit(userId int64) (string, error) {
+	deactivated, err := s.repo.SetUserActive(userId, false)
+	if err != nil {
+		switch err {
+		case repository.ErrNotExists:
+			return NotRegistered, nil
+		default:
+			return InternalError, fmt.Errorf("failed to deactivate user, %v", err)
+		}
+	}
+	if !deactivated {
+		return AlreadyExited, nil
+	}
+	return Exited, nil
+}
+
+// GrantAccess lets the @usernames of the request, separated by spaces or commas, send notifications to the user.
+// All of them are granted at once and the reply has a line for each.
 func (s *Service) GrantAccess(userId int64, request string) (string, error) {
-	tokens := strings.Split(request, " ")
-	// TODO parse multiply usernames
-	if len(tokens) != 2 || tokens[1][0] != '@' {
-		return fmt.Sprintf(IncorrectUsageOfCommand, "give", "/grant_access"), nil
+	userNames, ok := parseUserNames(request)
+	if !ok {
+		return fmt.Sprintf(IncorrectUsageOfCommand, "give", "/grant_access", maxUserNames), nil
+	}
+
+	users, err := s.repo.GetUsers(userNames)
+	if err != nil {
+		return InternalError, fmt.Errorf("failed to get users %v, %v", userNames, err)
+	}
+
+	var usersId []int64
+	for _, user := range users {
+		if user.IsActive {
+			usersId = append(usersId, user.Id)
+		}
+	}
+	granted := map[int64]bool{}
+	if len(usersId) > 0 {
+		granted, err = s.repo.GrantNotificationAccess(userId, usersId)
+		if err != nil {
+			return InternalError, fmt.Errorf("failed to grant access to the users %v, %v", userNames, err)
+		}
+	}
+
+	replies := make([]string, 0, len(userNames))
+	for _, userName := range userNames {
+		user, ok := users[userName]
+		switch {
+		case !ok || !user.IsActive:
+			replies = append(replies, fmt.Sprintf(NotLoggedIn, userName))
+		case granted[user.Id]:
+			// the same user may be given by the old and the new username
+			delete(granted, user.Id)
+			replies = append(replies, fmt.Sprintf(CanSendNotifications, displayName(userName, user)))
+		default:
+			replies = append(replies, fmt.Sprintf(AlreadyHasAccess, displayName(userName, user)))
+		}
+	}
+	return strings.Join(replies, "\n"), nil
+}
+
+// RemoveAccess removes the access of the @usernames of the request like GrantAccess grants it.
+// It returns true when the request is "all", then the reply asks to confirm RemoveAllAccess.
+func (s *Service) RemoveAccess(userId int64, request string) (string, bool, error) {
+	if tokens := strings.Fields(request); len(tokens) == 2 && tokens[1] == removeAllAccess {
+		_, total, err := s.repo.ListNotificationAccess(userId, 0, 0)
+		if err != nil {
+			return InternalError, false, fmt.Errorf("failed to count access, %v", err)
+		}
+		if total == 0 {
+			return NoAccessGranted, false, nil
+		}
+		return fmt.Sprintf(ConfirmRemoveAllAccess, total), true, nil
+	}
+
+	userNames, ok := parseUserNames(request)
+	if !ok {
+		return fmt.Sprintf(IncorrectUsageOfCommand, "deny", "/remove_access", maxUserNames) + RemoveAllAccessUsage,
+			false, nil
+	}
+
+	// access of exited users can still be removed
+	users, err := s.repo.GetUsers(userNames)
+	if err != nil {
+		return InternalError, false, fmt.Errorf("failed to get users %v, %v", userNames, err)
 	}
-	userNameWithAccess := tokens[1][1:] //remove @ from username
 
-	_, err := s.repo.GetUser(userNameWithAccess)
-	// TODO check isActive
+	var usersId []int64
+	for _, user := range users {
+		usersId = append(usersId, user.Id)
+	}
+	revoked := map[int64]bool{}
+	if len(usersId) > 0 {
+		revoked, err = s.repo.RevokeNotificationAccess(userId, usersId)
+		if err != nil {
+			return InternalError, false, fmt.Errorf("failed to remove access from users %v, %v", userNames, err)
+		}
+	}
+
+	replies := make([]string, 0, len(userNames))
+	for _, userName := range userNames {
+		user, ok := users[userName]
+		switch {
+		case !ok:
+			replies = append(replies, fmt.Sprintf(NotLoggedIn, userName))
+		case revoked[user.Id]:
+			delete(revoked, user.Id)
+			replies = append(replies, fmt.Sprintf(CantSendNotifications, displayName(userName, user)))
+		default:
+			replies = append(replies, fmt.Sprintf(HaveNotAccess, displayName(userName, user)))
+		}
+	}
+	return strings.Join(replies, "\n"), false, nil
+}
+
+// RemoveAllAccess removes the access of everybody to send notifications to the user
+// once it is confirmed after RemoveAccess.
+func (s *Service) RemoveAllAccess(userId int64, confirmed bool) (string, error) {
+	if !confirmed {
+		return RemoveAllAccessCancel, nil
+	}
+
+	count, err := s.repo.RevokeAllNotificationAccess(userId)
 	if err != nil {
-		return fmt.Sprintf(NotLoggedIn, userNameWithAccess), nil
+		return InternalError, fmt.Errorf("failed to remove all access, %v", err)
 	}
+	if count == 0 {
+		return NoAccessGranted, nil
+	}
+	return fmt.Sprintf(AllAccessRemoved, count), nil
+}
+
+// parseUserNames returns the distinct usernames without @ of the command arguments,
+// which are @usernames separated by spaces or commas.
+func parseUserNames(request string) ([]string, bool) {
+	tokens := strings.FieldsFunc(request, func(r rune) bool {
+		return r == ',' || unicode.IsSpace(r)
+	})
+	// the first token is the command itself
+	if len(tokens) < 2 || len(tokens) > maxUserNames+1 {
+		return nil, false
+	}
+
+	userNames := make([]string, 0, len(tokens)-1)
+	seen := make(map[string]bool, len(tokens)-1)
+	for _, token := range tokens[1:] {
+		if len(token) < 2 || token[0] != '@' {
+			return nil, false
+		}
+		userName := token[1:] //remove @ from username
+		if seen[userName] {
+			continue
+		}
+		seen[userName] = true
+		userNames = append(userNames, userName)
+	}
+	return userNames, true
+}
 
-	err = s.repo.AddNotificationAccess(userId, userNameWithAccess)
+// ListAccess returns the page of the users who can send notifications to the user.
+// Pages past the end are clamped to the last one, as grants may have been removed since the page was shown.
+func (s *Service) ListAccess(userId int64, page int) (string, model.AccessPage, error) {
+	if page < 0 {
+		page = 0
+	}
+	users, total, err := s.repo.ListNotificationAccess(userId, page*accessPageSize, accessPageSize)
+	if err != nil {
+		return InternalError, model.AccessPage{}, fmt.Errorf("failed to list access, %v", err)
+	}
+	if total == 0 {
+		return NoAccessGranted, model.AccessPage{}, nil
+	}
+
+	pages := (total + accessPageSize - 1) / accessPageSize
+	if page >= pages {
+		page = pages - 1
+		users, total, err = s.repo.ListNotificationAccess(userId, page*accessPageSize, accessPageSize)
+		if err != nil {
+			return InternalError, model.AccessPage{}, fmt.Errorf("failed to list access, %v", err)
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString(fmt.Sprintf(AccessHeader, total, page+1, pages))
+	for i, user := range users {
+		b.WriteString(fmt.Sprintf(AccessItem, page*accessPageSize+i+1, user.UserName))
+		if !user.IsActive {
+			b.WriteString(AccessItemExited)
+		}
+		b.WriteString("\n")
+	}
+	return b.String(), model.AccessPage{Users: users, Page: page, Pages: pages}, nil
+}
+
+// RevokeAccess removes the access of the user with the id, it is RemoveAccess for the buttons of ListAccess.
+func (s *Service) RevokeAccess(userId int64, grantedUserId int64) (string, error) {
+	err := s.repo.RemoveNotificationAccess(userId, grantedUserId)
 	if err != nil {
 		switch err {
-		case repository.ErrAlreadyExists:
-			return fmt.Sprintf(AlreadyHasAccess, userNameWithAccess), nil
+		case repository.ErrNotExists:
+			return AccessAlreadyRevoked, nil
+		default:
+			return InternalError, fmt.Errorf("failed to remove access from user %v, %v", grantedUserId, err)
+		}
+	}
+	return AccessRevoked, nil
+}
+
+// UpdateUserName keeps the username of the user up to date, as telegram users can change it any time.
+func (s *Service) UpdateUserName(userId int64, userName string) error {
+	if userName == "" {
+		return nil
+	}
+	return s.repo.UpdateUserName(userId, userName)
+}
+
+// displayName returns the current username of the user found by the given one,
+// noting the given one if the user has renamed since.
+func displayName(userName string, user model.User) string {
+	if user.UserName == userName {
+		return userName
+	}
+	return fmt.Sprintf(RenamedUser, user.UserName, userName)
+}
+
+func (s *Service) CreateApiKey(userId int64) (string, error) {
+	buf := make([]byte, apiKeyLength)
+	if _, err := rand.Read(buf); err != nil {
+		return InternalError, fmt.Errorf("failed to generate api key, %v", err)
+	}
+	key := hex.EncodeToString(buf)
+	hash := sha256.Sum256([]byte(key))
+
+	err := s.repo.InsertApiKey(userId, hex.EncodeToString(hash[:]))
+	if err != nil {
+		switch err {
+		case repository.ErrNotExists:
+			return NotRegistered, nil
 		default:
-			return InternalError, fmt.Errorf("failed to grant access to the user %v, %v",
-				userNameWithAccess, err)
+			return InternalError, fmt.Errorf("failed to insert api key in database, %v", err)
 		}
 	}
 
-	return fmt.Sprintf(CanSendNotifications, userNameWithAccess), nil
+	return fmt.Sprintf(ApiKeyCreated, key), nil
 }
 
-func (s *Service) RemoveAccess(userId int64, request string) (string, error) {
-	tokens := strings.Split(request, " ")
-	// TODO parse multiply usernames
-	if len(tokens) > 2 || tokens[1][0] != '@' {
-		return fmt.Sprintf(IncorrectUsageOfCommand, "deny", "/remove_access"), nil
+func (s *Service) RevokeApiKeys(userId int64) (string, error) {
+	count, err := s.repo.RevokeApiKeys(userId)
+	if err != nil {
+		return InternalError, fmt.Errorf("failed to revoke api keys, %v", err)
+	}
+	if count == 0 {
+		return NoApiKeys, nil
+	}
+
+	return fmt.Sprintf(ApiKeysRevoked, count), nil
+}
+
+func (s *Service) Subscriptions(userId int64) (string, error) {
+	subscriptions, err := s.repo.ListSubscriptions(userId)
+	if err != nil {
+		return InternalError, fmt.Errorf("failed to list subscriptions, %v", err)
+	}
+	if len(subscriptions) == 0 {
+		return NoSubscriptions, nil
+	}
+
+	var b strings.Builder
+	b.WriteString(SubscriptionsHeader)
+	for _, subscription := range subscriptions {
+		message := subscription.Message
+		if runes := []rune(message); len(runes) > subscriptionPreviewLength {
+			message = string(runes[:subscriptionPreviewLength]) + "..."
+		}
+		nextRunAt := subscription.NextRunAt
+		if location, err := time.LoadLocation(subscription.Timezone); err == nil {
+			nextRunAt = nextRunAt.In(location)
+		}
+		b.WriteString(fmt.Sprintf(SubscriptionItem, subscription.Id, subscription.Sender, subscription.Cron,
+			subscription.Timezone, nextRunAt.Format("2006-01-02 15:04 MST"), message))
+	}
+	return b.String(), nil
+}
+
+func (s *Service) Unsubscribe(userId int64, request string) (string, error) {
+	tokens := strings.Fields(request)
+	if len(tokens) != 2 {
+		return IncorrectUsageOfUnsubscribe, nil
+	}
+	recurringId, err := strconv.ParseInt(tokens[1], 10, 64)
+	if err != nil {
+		return IncorrectUsageOfUnsubscribe, nil
+	}
+
+	err = s.repo.Unsubscribe(userId, recurringId)
+	if err != nil {
+		switch err {
+		case repository.ErrNotExists:
+			return fmt.Sprintf(NotSubscribed, recurringId), nil
+		default:
+			return InternalError, fmt.Errorf("failed to unsubscribe from %v, %v", recurringId, err)
+		}
+	}
+
+	return fmt.Sprintf(Unsubscribed, recurringId), nil
+}
+
+// Action records the press of a callback button of a notification, whose data is "notificationId:action".
+// It returns the recorded action, empty if nothing is recorded, to be posted with PostAction
+// once the press is answered.
+func (s *Service) Action(userId int64, data string) (string, model.NotificationAction, error) {
+	tokens := strings.SplitN(data, ":", 2)
+	if len(tokens) != 2 {
+		return UnknownAction, model.NotificationAction{}, nil
+	}
+	notificationId, err := strconv.ParseInt(tokens[0], 10, 64)
+	if err != nil {
+		return UnknownAction, model.NotificationAction{}, nil
+	}
+
+	action, err := s.repo.RecordNotificationAction(notificationId, userId, tokens[1])
+	if err != nil {
+		switch err {
+		case repository.ErrNotExists:
+			return UnknownAction, model.NotificationAction{}, nil
+		default:
+			return InternalError, model.NotificationAction{}, fmt.Errorf("failed to record action of notification %v, %v",
+				notificationId, err)
+		}
 	}
-	userNameWithAccess := tokens[1][1:] //remove @ from username
 
-	_, err := s.repo.GetUser(userNameWithAccess)
-	// TODO check isActive
+	return ActionRecorded, action, nil
+}
+
+// PostAction posts the recorded action to the webhook of the sender of the notification if there is one.
+func (s *Service) PostAction(action model.NotificationAction) error {
+	url, secret, err := s.repo.GetNotificationWebhook(action.NotificationId)
 	if err != nil {
-		return fmt.Sprintf(NotLoggedIn, userNameWithAccess), nil
+		return fmt.Errorf("failed to get webhook of notification %v, %v", action.NotificationId, err)
+	}
+	if url == "" {
+		return nil
+	}
+	if err := s.webhook.PostAction(url, secret, action); err != nil {
+		return fmt.Errorf("failed to post action of notification %v to webhook, %v", action.NotificationId, err)
 	}
+	return nil
+}
 
-	err = s.repo.RemoveNotificationAccess(userId, userNameWithAccess)
+// RequestAccess asks the @username of the request to let the user send them notifications.
+// The request is announced to the recipient by AccessRequestsToAnnounce.
+func (s *Service) RequestAccess(userId int64, request string) (string, error) {
+	userNames, ok := parseUserNames(request)
+	if !ok || len(userNames) != 1 {
+		return IncorrectUsageOfRequestAccess, nil
+	}
+
+	recipient, err := s.repo.GetUser(userNames[0])
+	if err != nil || !recipient.IsActive {
+		return fmt.Sprintf(NotLoggedIn, userNames[0]), nil
+	}
+	if recipient.Id == userId {
+		return AccessRequestToSelf, nil
+	}
+	recipientUserName := displayName(userNames[0], recipient)
+
+	accessRequest, err := s.repo.CreateAccessRequest(userId, recipient.Id)
 	if err != nil {
 		switch err {
 		case repository.ErrNotExists:
-			return fmt.Sprintf(HaveNotAccess, userNameWithAccess), nil
+			return NotRegistered, nil
+		case repository.ErrAccessAlreadyGranted:
+			return fmt.Sprintf(AccessAlreadyGranted, recipientUserName), nil
+		case repository.ErrAccessRequestPending:
+			return fmt.Sprintf(AccessRequestPending, recipientUserName), nil
+		case repository.ErrAccessRequestDenied:
+			return fmt.Sprintf(AccessRequestRecentlyDenied, recipientUserName), nil
+		case repository.ErrTooManyAccessRequests:
+			return TooManyAccessRequests, nil
 		default:
-			return InternalError, fmt.Errorf("failed to remove access from user %v, %v",
-				userNameWithAccess, err)
+			return InternalError, fmt.Errorf("failed to request access from the user %v, %v", recipientUserName, err)
 		}
 	}
 
-	return fmt.Sprintf(CantSendNotifications, userNameWithAccess), nil
+	return fmt.Sprintf(AccessRequested, recipientUserName,
+		accessRequest.ExpiresAt.UTC().Format(accessRequestTimeLayout)), nil
+}
+
+// AccessRequestsToAnnounce returns the pending access requests the recipients have not been told about yet,
+// each of them has to be marked with AccessRequestAnnounced once it is sent.
+func (s *Service) AccessRequestsToAnnounce() ([]model.AccessRequestUpdate, error) {
+	requests, err := s.repo.ListUnannouncedAccessRequests(accessRequestsBatchSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list unannounced access requests, %v", err)
+	}
+
+	updates := make([]model.AccessRequestUpdate, 0, len(requests))
+	for _, request := range requests {
+		updates = append(updates, model.AccessRequestUpdate{
+			Request: request,
+			RecipientText: fmt.Sprintf(AccessRequestAnnouncement, request.RequesterUserName,
+				request.ExpiresAt.UTC().Format(accessRequestTimeLayout)),
+		})
+	}
+	return updates, nil
+}
+
+// AccessRequestAnnounced saves the message the access request is announced with, 0 if it could not be sent.
+func (s *Service) AccessRequestAnnounced(requestId int64, messageId int) error {
+	return s.repo.SetAccessRequestAnnounced(requestId, messageId)
+}
+
+// ExpireAccessRequests expires the access requests nobody has decided in time.
+func (s *Service) ExpireAccessRequests() ([]model.AccessRequestUpdate, error) {
+	requests, err := s.repo.ExpireAccessRequests(accessRequestsBatchSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to expire access requests, %v", err)
+	}
+
+	updates := make([]model.AccessRequestUpdate, 0, len(requests))
+	for _, request := range requests {
+		updates = append(updates, model.AccessRequestUpdate{
+			Request:       request,
+			RecipientText: fmt.Sprintf(AccessRequestExpired, request.RequesterUserName),
+			RequesterText: fmt.Sprintf(YourAccessRequestExpired, request.RecipientUserName),
+		})
+	}
+	return updates, nil
+}
+
+// DecideAccessRequest approves or denies the access request to the user. It returns the answer to the button press
+// and what to tell the participants, nothing if the request is no longer pending.
+func (s *Service) DecideAccessRequest(userId int64, requestId int64, approve bool) (string, model.AccessRequestUpdate, error) {
+	status := model.AccessRequestDenied
+	if approve {
+		status = model.AccessRequestApproved
+	}
+
+	request, err := s.repo.DecideAccessRequest(requestId, userId, status)
+	if err != nil {
+		switch err {
+		case repository.ErrAccessRequestNotExists:
+			return AccessRequestNotPending, model.AccessRequestUpdate{}, nil
+		default:
+			return InternalError, model.AccessRequestUpdate{}, fmt.Errorf("failed to decide access request %v, %v",
+				requestId, err)
+		}
+	}
+
+	if !approve {
+		return ActionRecorded, model.AccessRequestUpdate{
+			Request:       request,
+			RecipientText: fmt.Sprintf(AccessRequestDeniedByYou, request.RequesterUserName),
+			RequesterText: fmt.Sprintf(YourAccessRequestDenied, request.RecipientUserName),
+		}, nil
+	}
+
+	return ActionRecorded, model.AccessRequestUpdate{
+		Request:       request,
+		RecipientText: fmt.Sprintf(CanSendNotifications, request.RequesterUserName),
+		RequesterText: fmt.Sprintf(YourAccessRequestApproved, request.RecipientUserName),
+	}, nil
 }
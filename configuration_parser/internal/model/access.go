@@ -0,0 +1,38 @@
+package model
+
+import "time"
+
+// AccessPage is a page of the users who can send notifications to the user, pages are counted from 0.
+type AccessPage struct {
+	Users []User
+	Page  int
+	Pages int
+}
+
+const (
+	AccessRequestPending  = "pending"
+	AccessRequestApproved = "approved"
+	AccessRequestDenied   = "denied"
+	AccessRequestExpired  = "expired"
+)
+
+// AccessRequest is a request of the requester to be granted access by the recipient.
+// MessageId is the bot message with the buttons to decide it, 0 if there is none.
+type AccessRequest struct {
+	Id                int64
+	RequesterId       int64
+	RequesterUserName string
+	RecipientId       int64
+	RecipientUserName string
+	Status            string
+	MessageId         int
+	ExpiresAt         time.Time
+}
+
+// AccessRequestUpdate is what the bot tells the participants of the access request,
+// nothing is told to the ones with an empty text.
+type AccessRequestUpdate struct {
+	Request       AccessRequest
+	RecipientText string
+	RequesterText string
+}
@@ -0,0 +1,12 @@
+package model
+
+import "time"
+
+// NotificationAction is a press of a callback button of a notification by its recipient.
+type NotificationAction struct {
+	NotificationId int64     `json:"notificationId"`
+	UserId         int64     `json:"userId"`
+	UserName       string    `json:"username"`
+	Action         string    `json:"action"`
+	PressedAt      time.Time `json:"pressedAt"`
+}
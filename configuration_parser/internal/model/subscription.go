@@ -0,0 +1,13 @@
+package model
+
+import "time"
+
+// Subscription is a recurring notification the user receives.
+type Subscription struct {
+	Id        int64
+	Sender    string
+	Cron      string
+	Timezone  string
+	Message   string
+	NextRunAt time.Time
+}
@@ -0,0 +1,7 @@
+package model
+
+type User struct {
+	Id       int64
+	UserName string
+	IsActive bool
+}
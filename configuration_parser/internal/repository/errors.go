@@ -6,4 +6,10 @@ var (
 	ErrAlreadyExists = errors.New("user already exists")
 	ErrNotExists     = errors.New("user does not exist")
 	ErrInternal      = errors.New("something went wrong")
+
+	ErrAccessRequestNotExists = errors.New("access request does not exist or is not pending")
+	ErrAccessRequestPending   = errors.New("an access request to the recipient is already pending")
+	ErrAccessRequestDenied    = errors.New("the recipient has recently denied an access request")
+	ErrTooManyAccessRequests  = errors.New("too many access requests")
+	ErrAccessAlreadyGranted   = errors.New("the recipient has already granted access")
 )
@@ -1,6 +1,7 @@
 package postgres
 
 import (
+	"configuration_parser/internal/model"
 	"configuration_parser/internal/repository"
 	"database/sql"
 	"errors"
@@ -11,7 +12,15 @@ import (
 	"github.com/lib/pq"
 )
 
-const uniqueViolation = "23505"
+const (
+	uniqueViolation     = "23505"
+	foreignKeyViolation = "23503"
+
+	// raised by create_access_request, see migrations/0019_access_request_limits.sql
+	accessAlreadyGranted  = "AR001"
+	accessRequestDenied   = "AR002"
+	tooManyAccessRequests = "AR003"
+)
 
 type Repository struct {
 	db *sql.DB
@@ -66,29 +75,235 @@ func (repo *Repository) InsertUser(userId int64, userName string) error {
 	return nil
 }
 
-func (repo *Repository) GetUser(userName string) (int64, error) {
-	q := `SELECT id FROM users WHERE username = $1`
+// GetUser returns the user with the username. Users who have renamed since are found by their old usernames,
+// unless somebody else has taken them.
+func (repo *Repository) GetUser(userName string) (model.User, error) {
+	q := `SELECT id, username, is_active FROM users WHERE username = $1
+		UNION ALL
+		(SELECT u.id, u.username, u.is_active FROM username_history h JOIN users u ON u.id = h.user_id
+		WHERE h.username = $1 AND NOT EXISTS(SELECT 1 FROM users WHERE username = $1)
+		ORDER BY h.changed_at DESC
+		LIMIT 1)`
 
-	var userId int64
+	var user model.User
 	row := repo.db.QueryRow(q, userName)
 	if err := row.Err(); err != nil {
-		return userId, err
+		return user, err
+	}
+
+	if err := row.Scan(&user.Id, &user.UserName, &user.IsActive); err != nil {
+		return user, err
+	}
+
+	return user, nil
+}
+
+// GetUsers returns the users with the usernames by the usernames, resolving old usernames like GetUser.
+func (repo *Repository) GetUsers(userNames []string) (map[string]model.User, error) {
+	q := `SELECT username, id, username, is_active FROM users WHERE username = ANY($1)
+		UNION ALL
+		(SELECT DISTINCT ON (h.username) h.username, u.id, u.username, u.is_active
+		FROM username_history h JOIN users u ON u.id = h.user_id
+		WHERE h.username = ANY($1) AND NOT EXISTS(SELECT 1 FROM users WHERE username = h.username)
+		ORDER BY h.username, h.changed_at DESC)`
+
+	rows, err := repo.db.Query(q, pq.Array(userNames))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := make(map[string]model.User, len(userNames))
+	for rows.Next() {
+		var userName string
+		var user model.User
+		if err := rows.Scan(&userName, &user.Id, &user.UserName, &user.IsActive); err != nil {
+			return nil, err
+		}
+		users[userName] = user
+	}
+
+	return users, rows.Err()
+}
+
+// UpdateUserName changes the username of the user if it differs and keeps the old one in the history.
+func (repo *Repository) UpdateUserName(userId int64, userName string) error {
+	tx, err := repo.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	q := `UPDATE users u SET username = $2
+		FROM (SELECT id, username FROM users WHERE id = $1 FOR UPDATE) old
+		WHERE u.id = old.id AND old.username IS DISTINCT FROM $2
+		RETURNING old.username`
+
+	var oldUserName sql.NullString
+	if err := tx.QueryRow(q, userId, userName).Scan(&oldUserName); err != nil {
+		if err == sql.ErrNoRows {
+			// not registered or not renamed
+			return nil
+		}
+		return err
+	}
+
+	if oldUserName.Valid && oldUserName.String != "" {
+		q = `INSERT INTO username_history (user_id, username) VALUES ($1, $2)`
+		if _, err := tx.Exec(q, userId, oldUserName.String); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// SetUserActive activates or deactivates the user. It returns false if the user already was in that state.
+func (repo *Repository) SetUserActive(userId int64, isActive bool) (bool, error) {
+	q := `UPDATE users SET is_active = $2 WHERE id = $1 AND is_active <> $2`
+
+	res, err := repo.db.Exec(q, userId, isActive)
+	if err != nil {
+		return false, err
+	}
+	count, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	if count > 0 {
+		return true, nil
+	}
+
+	q = `SELECT EXISTS(SELECT 1 FROM users WHERE id = $1)`
+
+	var exists bool
+	if err := repo.db.QueryRow(q, userId).Scan(&exists); err != nil {
+		return false, err
+	}
+	if !exists {
+		return false, repository.ErrNotExists
 	}
+	return false, nil
+}
+
+func (repo *Repository) RemoveNotificationAccess(userId int64, grantedUserId int64) error {
+	q := `DELETE FROM notification_access where user_id = $1 and granted_user_id = $2`
 
-	if err := row.Scan(&userId); err != nil {
-		return userId, err
+	res, err := repo.db.Exec(q, userId, grantedUserId)
+	if err != nil {
+		return err
+	}
+	count, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return repository.ErrNotExists
 	}
+	return nil
+}
+
+// GrantNotificationAccess lets all the users send notifications to the user at once
+// and returns the ones who did not have access before.
+func (repo *Repository) GrantNotificationAccess(userId int64, grantedUsersId []int64) (map[int64]bool, error) {
+	return grantNotificationAccess(repo.db, userId, grantedUsersId)
+}
+
+// querier is the database or a transaction
+type querier interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// grantNotificationAccess grants the access like GrantNotificationAccess, existing grants are left as they are
+// without aborting the transaction they are granted in.
+func grantNotificationAccess(db querier, userId int64, grantedUsersId []int64) (map[int64]bool, error) {
+	q := `INSERT INTO notification_access (user_id, granted_user_id)
+		SELECT $1, granted_user_id FROM unnest($2::bigint[]) AS granted_user_id
+		ON CONFLICT (user_id, granted_user_id) DO NOTHING
+		RETURNING granted_user_id`
 
-	return userId, nil
+	return accessChanges(db, q, userId, grantedUsersId)
 }
 
-func (repo *Repository) AddNotificationAccess(userId int64, userNameWithAccess string) error {
-	q := `INSERT INTO notification_access (user_id, username_with_access) VALUES ($1, $2)`
+// RevokeNotificationAccess removes the access of all the users at once and returns the ones who had it.
+func (repo *Repository) RevokeNotificationAccess(userId int64, grantedUsersId []int64) (map[int64]bool, error) {
+	q := `DELETE FROM notification_access WHERE user_id = $1 AND granted_user_id = ANY($2)
+		RETURNING granted_user_id`
 
-	if _, err := repo.db.Exec(q, userId, userNameWithAccess); err != nil {
+	return accessChanges(repo.db, q, userId, grantedUsersId)
+}
+
+func accessChanges(db querier, q string, userId int64, grantedUsersId []int64) (map[int64]bool, error) {
+	rows, err := db.Query(q, userId, pq.Array(grantedUsersId))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	changed := make(map[int64]bool, len(grantedUsersId))
+	for rows.Next() {
+		var grantedUserId int64
+		if err := rows.Scan(&grantedUserId); err != nil {
+			return nil, err
+		}
+		changed[grantedUserId] = true
+	}
+
+	return changed, rows.Err()
+}
+
+// RevokeAllNotificationAccess removes the access of everybody to send notifications to the user
+// and returns how many users had it.
+func (repo *Repository) RevokeAllNotificationAccess(userId int64) (int64, error) {
+	q := `DELETE FROM notification_access WHERE user_id = $1`
+
+	res, err := repo.db.Exec(q, userId)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// ListNotificationAccess returns the users who can send notifications to the user ordered by username
+// and the total number of them.
+func (repo *Repository) ListNotificationAccess(userId int64, offset int, limit int) ([]model.User, int, error) {
+	q := `SELECT count(*) FROM notification_access WHERE user_id = $1`
+
+	var total int
+	if err := repo.db.QueryRow(q, userId).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	q = `SELECT u.id, u.username, u.is_active FROM notification_access a JOIN users u ON u.id = a.granted_user_id
+		WHERE a.user_id = $1
+		ORDER BY u.username, u.id
+		OFFSET $2 LIMIT $3`
+
+	rows, err := repo.db.Query(q, userId, offset, limit)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var users []model.User
+	for rows.Next() {
+		var user model.User
+		if err := rows.Scan(&user.Id, &user.UserName, &user.IsActive); err != nil {
+			return nil, 0, err
+		}
+		users = append(users, user)
+	}
+
+	return users, total, rows.Err()
+}
+
+func (repo *Repository) InsertApiKey(userId int64, keyHash string) error {
+	q := `INSERT INTO api_keys (user_id, key_hash) VALUES ($1, $2)`
+
+	if _, err := repo.db.Exec(q, userId, keyHash); err != nil {
 		if e, ok := err.(*pq.Error); ok {
-			if e.Code == uniqueViolation {
-				return repository.ErrAlreadyExists
+			if e.Code == foreignKeyViolation {
+				return repository.ErrNotExists
 			}
 		}
 		return err
@@ -97,10 +312,48 @@ func (repo *Repository) AddNotificationAccess(userId int64, userNameWithAccess s
 	return nil
 }
 
-func (repo *Repository) RemoveNotificationAccess(userId int64, userNameWithAccess string) error {
-	q := `DELETE FROM notification_access where user_id = $1 and username_with_access = $2`
+func (repo *Repository) RevokeApiKeys(userId int64) (int64, error) {
+	q := `UPDATE api_keys SET revoked_at = now() WHERE user_id = $1 AND revoked_at IS NULL`
+
+	res, err := repo.db.Exec(q, userId)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (repo *Repository) ListSubscriptions(userId int64) ([]model.Subscription, error) {
+	q := `SELECT n.id, '@' || s.username, n.cron, n.timezone, n.message, n.next_run_at
+		FROM recurring_notifications n
+			JOIN users s ON s.id = n.sender_id
+			JOIN recurring_notification_recipients r ON r.recurring_notification_id = n.id
+		WHERE r.recipient_id = $1 AND n.disabled_at IS NULL
+		ORDER BY n.id`
+
+	rows, err := repo.db.Query(q, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var subscriptions []model.Subscription
+	for rows.Next() {
+		var subscription model.Subscription
+		err := rows.Scan(&subscription.Id, &subscription.Sender, &subscription.Cron, &subscription.Timezone,
+			&subscription.Message, &subscription.NextRunAt)
+		if err != nil {
+			return nil, err
+		}
+		subscriptions = append(subscriptions, subscription)
+	}
+
+	return subscriptions, rows.Err()
+}
+
+func (repo *Repository) Unsubscribe(userId int64, recurringId int64) error {
+	q := `DELETE FROM recurring_notification_recipients WHERE recipient_id = $1 AND recurring_notification_id = $2`
 
-	res, err := repo.db.Exec(q, userId, userNameWithAccess)
+	res, err := repo.db.Exec(q, userId, recurringId)
 	if err != nil {
 		return err
 	}
@@ -114,6 +367,185 @@ func (repo *Repository) RemoveNotificationAccess(userId int64, userNameWithAcces
 	return nil
 }
 
+// RecordNotificationAction saves the action of the recipient of the notification.
+func (repo *Repository) RecordNotificationAction(notificationId int64, userId int64, action string) (model.NotificationAction, error) {
+	q := `INSERT INTO notification_actions (notification_id, recipient_id, action) VALUES ($1, $2, $3)
+		RETURNING created_at, (SELECT username FROM users WHERE id = $2)`
+
+	notificationAction := model.NotificationAction{
+		NotificationId: notificationId,
+		UserId:         userId,
+		Action:         action,
+	}
+	row := repo.db.QueryRow(q, notificationId, userId, action)
+	if err := row.Scan(&notificationAction.PressedAt, &notificationAction.UserName); err != nil {
+		if e, ok := err.(*pq.Error); ok {
+			if e.Code == foreignKeyViolation {
+				return notificationAction, repository.ErrNotExists
+			}
+		}
+		return notificationAction, err
+	}
+
+	return notificationAction, nil
+}
+
+// GetNotificationWebhook returns the webhook of the sender of the notification with its secret,
+// empty if there is none.
+func (repo *Repository) GetNotificationWebhook(notificationId int64) (string, string, error) {
+	q := `SELECT w.url, COALESCE(w.secret, '') FROM notifications n JOIN webhooks w ON w.owner_id = n.sender_id
+		WHERE n.id = $1`
+
+	var url, secret string
+	row := repo.db.QueryRow(q, notificationId)
+	if err := row.Scan(&url, &secret); err != nil {
+		if err == sql.ErrNoRows {
+			return "", "", nil
+		}
+		return "", "", err
+	}
+
+	return url, secret, nil
+}
+
+// CreateAccessRequest creates a pending request of the requester to be granted access by the recipient.
+// The limits of requests are kept in access_request_limits and shared with the notification receiver.
+func (repo *Repository) CreateAccessRequest(requesterId int64, recipientId int64) (model.AccessRequest, error) {
+	request := model.AccessRequest{
+		RequesterId: requesterId,
+		RecipientId: recipientId,
+	}
+
+	q := `SELECT id, status, expires_at FROM create_access_request($1, $2)`
+
+	row := repo.db.QueryRow(q, requesterId, recipientId)
+	if err := row.Scan(&request.Id, &request.Status, &request.ExpiresAt); err != nil {
+		if e, ok := err.(*pq.Error); ok {
+			switch e.Code {
+			case accessAlreadyGranted:
+				return request, repository.ErrAccessAlreadyGranted
+			case accessRequestDenied:
+				return request, repository.ErrAccessRequestDenied
+			case tooManyAccessRequests:
+				return request, repository.ErrTooManyAccessRequests
+			case uniqueViolation:
+				return request, repository.ErrAccessRequestPending
+			case foreignKeyViolation:
+				return request, repository.ErrNotExists
+			}
+		}
+		return request, err
+	}
+
+	return request, nil
+}
+
+// accessRequestColumns are scanned by scanAccessRequests from access_requests r joined with
+// the users requester and recipient.
+const accessRequestColumns = `r.id, r.requester_id, requester.username, r.recipient_id, recipient.username, r.status,
+	COALESCE(r.message_id, 0), r.expires_at`
+
+// ListUnannouncedAccessRequests returns pending access requests the recipients have not been told about.
+func (repo *Repository) ListUnannouncedAccessRequests(limit int) ([]model.AccessRequest, error) {
+	q := `SELECT ` + accessRequestColumns + `
+		FROM access_requests r JOIN users requester ON requester.id = r.requester_id
+			JOIN users recipient ON recipient.id = r.recipient_id
+		WHERE r.status = 'pending' AND r.announced_at IS NULL AND r.expires_at > now()
+		ORDER BY r.id
+		LIMIT $1`
+
+	rows, err := repo.db.Query(q, limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanAccessRequests(rows)
+}
+
+// SetAccessRequestAnnounced saves the bot message the access request is announced with, 0 if it could not be sent.
+func (repo *Repository) SetAccessRequestAnnounced(requestId int64, messageId int) error {
+	q := `UPDATE access_requests SET announced_at = now(), message_id = NULLIF($2, 0) WHERE id = $1`
+
+	_, err := repo.db.Exec(q, requestId, messageId)
+	return err
+}
+
+// ExpireAccessRequests marks pending access requests which have expired and returns them.
+func (repo *Repository) ExpireAccessRequests(limit int) ([]model.AccessRequest, error) {
+	q := `WITH expired AS (
+			UPDATE access_requests SET status = 'expired', decided_at = now()
+			WHERE id IN (SELECT id FROM access_requests WHERE status = 'pending' AND expires_at <= now()
+				ORDER BY id LIMIT $1 FOR UPDATE SKIP LOCKED)
+			RETURNING *
+		)
+		SELECT ` + accessRequestColumns + `
+		FROM expired r JOIN users requester ON requester.id = r.requester_id
+			JOIN users recipient ON recipient.id = r.recipient_id`
+
+	rows, err := repo.db.Query(q, limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanAccessRequests(rows)
+}
+
+// DecideAccessRequest approves or denies the pending access request to the recipient.
+// The access of an approved request is granted in the same transaction.
+func (repo *Repository) DecideAccessRequest(requestId int64, recipientId int64, status string) (model.AccessRequest, error) {
+	tx, err := repo.db.Begin()
+	if err != nil {
+		return model.AccessRequest{}, err
+	}
+	defer tx.Rollback()
+
+	q := `WITH decided AS (
+			UPDATE access_requests SET status = $3, decided_at = now()
+			WHERE id = $1 AND recipient_id = $2 AND status = 'pending' AND expires_at > now()
+			RETURNING *
+		)
+		SELECT ` + accessRequestColumns + `
+		FROM decided r JOIN users requester ON requester.id = r.requester_id
+			JOIN users recipient ON recipient.id = r.recipient_id`
+
+	rows, err := tx.Query(q, requestId, recipientId, status)
+	if err != nil {
+		return model.AccessRequest{}, err
+	}
+	requests, err := scanAccessRequests(rows)
+	if err != nil {
+		return model.AccessRequest{}, err
+	}
+	if len(requests) == 0 {
+		return model.AccessRequest{}, repository.ErrAccessRequestNotExists
+	}
+	request := requests[0]
+
+	if status == model.AccessRequestApproved {
+		// the access may have been granted with /grant_access since the request
+		if _, err := grantNotificationAccess(tx, recipientId, []int64{request.RequesterId}); err != nil {
+			return model.AccessRequest{}, err
+		}
+	}
+
+	return request, tx.Commit()
+}
+
+func scanAccessRequests(rows *sql.Rows) ([]model.AccessRequest, error) {
+	defer rows.Close()
+
+	var requests []model.AccessRequest
+	for rows.Next() {
+		var request model.AccessRequest
+		err := rows.Scan(&request.Id, &request.RequesterId, &request.RequesterUserName, &request.RecipientId,
+			&request.RecipientUserName, &request.Status, &request.MessageId, &request.ExpiresAt)
+		if err != nil {
+			return nil, err
+		}
+		requests = append(requests, request)
+	}
+
+	return requests, rows.Err()
+}
+
 func getPostgresCredentials() (string, error) {
 	host, ok := os.LookupEnv("PGHOST")
 	if !ok {
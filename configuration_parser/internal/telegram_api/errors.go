@@ -5,5 +5,6 @@ import (
 )
 
 var (
-	ErrUnexpected = errors.New("received an unexpected error")
+	ErrUnexpected      = errors.New("received an unexpected error")
+	ErrUnknownCallback = errors.New("unknown callback data")
 )
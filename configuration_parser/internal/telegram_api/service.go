@@ -1,8 +1,16 @@
 package telegram_api
 
 import (
+	"configuration_parser/internal/model"
+	"context"
 	"errors"
+	"fmt"
+	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 	"github.com/rs/zerolog"
@@ -10,14 +18,34 @@ import (
 
 type parser interface {
 	Start(userId int64, userName string) (string, error)
+	UpdateUserName(userId int64, userName string) error
+	Exit(userId int64) (string, error)
 	GrantAccess(userId int64, request string) (string, error)
-	RemoveAccess(userId int64, request string) (string, error)
+	RemoveAccess(userId int64, request string) (string, bool, error)
+	RemoveAllAccess(userId int64, confirmed bool) (string, error)
+	CreateApiKey(userId int64) (string, error)
+	RevokeApiKeys(userId int64) (string, error)
+	Subscriptions(userId int64) (string, error)
+	Unsubscribe(userId int64, request string) (string, error)
+	Action(userId int64, data string) (string, model.NotificationAction, error)
+	PostAction(action model.NotificationAction) error
+	ListAccess(userId int64, page int) (string, model.AccessPage, error)
+	RevokeAccess(userId int64, grantedUserId int64) (string, error)
+	RequestAccess(userId int64, request string) (string, error)
+	AccessRequestsToAnnounce() ([]model.AccessRequestUpdate, error)
+	AccessRequestAnnounced(requestId int64, messageId int) error
+	ExpireAccessRequests() ([]model.AccessRequestUpdate, error)
+	DecideAccessRequest(userId int64, requestId int64, approve bool) (string, model.AccessRequestUpdate, error)
 }
 
+const defaultAccessRequestsInterval = 10 * time.Second
+
 type Service struct {
 	logger zerolog.Logger
 	parser parser
 	bot    *tgbotapi.BotAPI
+	// accessRequestsInterval is how often access requests are announced and expired
+	accessRequestsInterval time.Duration
 }
 
 func NewService(logger zerolog.Logger, commandParser parser) (*Service, error) {
@@ -33,21 +61,65 @@ func NewService(logger zerolog.Logger, commandParser parser) (*Service, error) {
 		return nil, err
 	}
 
+	accessRequestsInterval := defaultAccessRequestsInterval
+	if value, ok := os.LookupEnv("ACCESS_REQUESTS_INTERVAL"); ok {
+		accessRequestsInterval, err = time.ParseDuration(value)
+		if err != nil || accessRequestsInterval <= 0 {
+			return nil, fmt.Errorf("failed to parse ACCESS_REQUESTS_INTERVAL: %v", value)
+		}
+	}
+
 	return &Service{
-		logger: l,
-		parser: commandParser,
-		bot:    bot,
+		logger:                 l,
+		parser:                 commandParser,
+		bot:                    bot,
+		accessRequestsInterval: accessRequestsInterval,
 	}, nil
 }
 
-func (s *Service) ListenAndServe() error {
+// ListenAndServe handles updates until the context is done,
+// then waits for the messages being handled.
+func (s *Service) ListenAndServe(ctx context.Context) error {
 	// TODO change offset from 0? change timeout?
 	updateConfig := tgbotapi.NewUpdate(0)
 	updateConfig.Timeout = 30
 
 	updates := s.bot.GetUpdatesChan(updateConfig)
 
-	for update := range updates {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		s.runAccessRequests(ctx)
+	}()
+
+	for {
+		var update tgbotapi.Update
+		var ok bool
+		select {
+		case <-ctx.Done():
+			s.bot.StopReceivingUpdates()
+			return nil
+		case update, ok = <-updates:
+			if !ok {
+				return ErrUnexpected
+			}
+		}
+
+		if update.CallbackQuery != nil {
+			s.logger.Info().Msgf("received callback query from tg api. id: %v, nickname: %v, data: %v",
+				update.CallbackQuery.From.ID, update.CallbackQuery.From.UserName, update.CallbackQuery.Data)
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				s.handleCallbackQuery(update)
+			}()
+			continue
+		}
+
 		if update.Message == nil {
 			continue
 		}
@@ -55,29 +127,67 @@ func (s *Service) ListenAndServe() error {
 		s.logger.Info().Msgf("received message from tg api. id: %v, nickname: %v, message: %v",
 			update.Message.Chat.ID, update.Message.Chat.UserName, update.Message.Text)
 
-		go s.handleMessage(update)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.handleMessage(update)
+		}()
 	}
-	return ErrUnexpected
 }
 
 func (s *Service) handleMessage(update tgbotapi.Update) {
+	if err := s.parser.UpdateUserName(update.Message.Chat.ID, update.Message.Chat.UserName); err != nil {
+		s.logger.Error().Msgf("failed to update username of %v, %v", update.Message.Chat.ID, err)
+	}
+
 	msg := tgbotapi.NewMessage(update.Message.Chat.ID, "")
 
 	var err error
 	switch update.Message.Command() {
-	//TODO add command to view list of all user with access
 	case "start":
 		msg.Text, err = s.parser.Start(update.Message.Chat.ID, update.Message.Chat.UserName)
+	case "exit":
+		msg.Text, err = s.parser.Exit(update.Message.Chat.ID)
 	case "grant_access":
 		msg.Text, err = s.parser.GrantAccess(update.Message.Chat.ID, update.Message.Text)
 	case "remove_access":
-		msg.Text, err = s.parser.RemoveAccess(update.Message.Chat.ID, update.Message.Text)
+		var confirm bool
+		msg.Text, confirm, err = s.parser.RemoveAccess(update.Message.Chat.ID, update.Message.Text)
+		if confirm {
+			msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(
+				tgbotapi.NewInlineKeyboardButtonData("Remove all", accessRemoveAllCallback),
+				tgbotapi.NewInlineKeyboardButtonData("Cancel", accessCancelCallback)))
+		}
+	case "list_access":
+		var page model.AccessPage
+		msg.Text, page, err = s.parser.ListAccess(update.Message.Chat.ID, 0)
+		if len(page.Users) > 0 {
+			msg.ReplyMarkup = accessKeyboard(page)
+		}
+	case "request_access":
+		msg.Text, err = s.parser.RequestAccess(update.Message.Chat.ID, update.Message.Text)
+	case "create_api_key":
+		msg.Text, err = s.parser.CreateApiKey(update.Message.Chat.ID)
+	case "revoke_api_keys":
+		msg.Text, err = s.parser.RevokeApiKeys(update.Message.Chat.ID)
+	case "subscriptions":
+		msg.Text, err = s.parser.Subscriptions(update.Message.Chat.ID)
+	case "unsubscribe":
+		msg.Text, err = s.parser.Unsubscribe(update.Message.Chat.ID, update.Message.Text)
 	default:
 		msg.Text = "Command list:\n\n" +
 			"/start - join the list of active users.\n\n" +
-			"/exit - ?\n\n" +
+			"/exit - stop receiving notifications until /start.\n\n" +
 			"/grant_access @username - let user - @username send me notifications.\n\n" +
-			"/remove_access @username - prevent user - @username send me notifications."
+			"/grant_access @username1 @username2 - let several users send me notifications at once.\n\n" +
+			"/remove_access @username - prevent user - @username send me notifications.\n\n" +
+			"/remove_access all - prevent everybody send me notifications.\n\n" +
+			"/list_access - list users who can send me notifications.\n\n" +
+			"/request_access @username - ask user - @username to let me send them notifications.\n\n" +
+			"/create_api_key - create a key to send notifications on my behalf through the API.\n\n" +
+			"/revoke_api_keys - revoke all my API keys.\n\n" +
+			"/subscriptions - list recurring notifications sent to me.\n\n" +
+			"/unsubscribe id - stop receiving the recurring notification."
 	}
 
 	if err != nil {
@@ -91,3 +201,282 @@ func (s *Service) handleMessage(update tgbotapi.Update) {
 			update.Message.Chat.ID, update.Message.Chat.UserName, msg.Text)
 	}
 }
+
+func (s *Service) handleCallbackQuery(update tgbotapi.Update) {
+	query := update.CallbackQuery
+	if err := s.parser.UpdateUserName(query.From.ID, query.From.UserName); err != nil {
+		s.logger.Error().Msgf("failed to update username of %v, %v", query.From.ID, err)
+	}
+
+	if strings.HasPrefix(query.Data, accessCallbackPrefix) {
+		s.handleAccessCallback(query)
+		return
+	}
+	if strings.HasPrefix(query.Data, accessRequestCallbackPrefix) {
+		s.handleAccessRequestCallback(query)
+		return
+	}
+
+	text, action, err := s.parser.Action(query.From.ID, query.Data)
+	if err != nil {
+		s.logger.Error().Msgf("error while process callback query, %v", err)
+	}
+
+	if _, err = s.bot.Request(tgbotapi.NewCallback(query.ID, text)); err != nil {
+		s.logger.Error().Msgf("failed to answer callback query, %v", err)
+	}
+
+	// the webhook is posted after the answer, so a slow webhook does not keep the button spinning
+	if action.NotificationId != 0 {
+		if err := s.parser.PostAction(action); err != nil {
+			s.logger.Error().Msgf("error while post action, %v", err)
+		}
+	}
+}
+
+// callback data of the buttons of /list_access, notification buttons start with the notification id instead
+const (
+	accessCallbackPrefix = "access:"
+	accessPageCallback   = accessCallbackPrefix + "page:%v"
+	accessRevokeCallback = accessCallbackPrefix + "revoke:%v:%v"
+
+	// confirmation of /remove_access all
+	accessRemoveAllCallback = accessCallbackPrefix + "remove_all"
+	accessCancelCallback    = accessCallbackPrefix + "cancel"
+)
+
+// accessKeyboard returns a revoke button for every user of the page and buttons to switch pages.
+func accessKeyboard(page model.AccessPage) tgbotapi.InlineKeyboardMarkup {
+	var rows [][]tgbotapi.InlineKeyboardButton
+	for _, user := range page.Users {
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData(
+			"Revoke @"+user.UserName, fmt.Sprintf(accessRevokeCallback, user.Id, page.Page))))
+	}
+
+	var navigation []tgbotapi.InlineKeyboardButton
+	if page.Page > 0 {
+		navigation = append(navigation,
+			tgbotapi.NewInlineKeyboardButtonData("« Previous", fmt.Sprintf(accessPageCallback, page.Page-1)))
+	}
+	if page.Page < page.Pages-1 {
+		navigation = append(navigation,
+			tgbotapi.NewInlineKeyboardButtonData("Next »", fmt.Sprintf(accessPageCallback, page.Page+1)))
+	}
+	if len(navigation) > 0 {
+		rows = append(rows, navigation)
+	}
+	return tgbotapi.NewInlineKeyboardMarkup(rows...)
+}
+
+// handleAccessCallback revokes access or switches the page of the /list_access message
+// and edits the message to show the current page.
+func (s *Service) handleAccessCallback(query *tgbotapi.CallbackQuery) {
+	switch query.Data {
+	case accessRemoveAllCallback, accessCancelCallback:
+		s.handleRemoveAllCallback(query)
+		return
+	}
+
+	tokens := strings.Split(strings.TrimPrefix(query.Data, accessCallbackPrefix), ":")
+
+	var answer string
+	var page int
+	var err error
+	switch {
+	case len(tokens) == 2 && tokens[0] == "page":
+		page, err = strconv.Atoi(tokens[1])
+	case len(tokens) == 3 && tokens[0] == "revoke":
+		var grantedUserId int64
+		grantedUserId, err = strconv.ParseInt(tokens[1], 10, 64)
+		if err == nil {
+			page, err = strconv.Atoi(tokens[2])
+		}
+		if err == nil {
+			answer, err = s.parser.RevokeAccess(query.From.ID, grantedUserId)
+			if err != nil {
+				s.logger.Error().Msgf("error while process callback query, %v", err)
+			}
+		}
+	default:
+		err = ErrUnknownCallback
+	}
+	if err != nil {
+		s.logger.Error().Msgf("failed to parse callback data %v, %v", query.Data, err)
+	}
+
+	if _, err = s.bot.Request(tgbotapi.NewCallback(query.ID, answer)); err != nil {
+		s.logger.Error().Msgf("failed to answer callback query, %v", err)
+	}
+
+	// inline messages are not sent by /list_access
+	if query.Message == nil {
+		return
+	}
+
+	text, accessPage, err := s.parser.ListAccess(query.From.ID, page)
+	if err != nil {
+		s.logger.Error().Msgf("error while process callback query, %v", err)
+	}
+	edit := tgbotapi.NewEditMessageText(query.Message.Chat.ID, query.Message.MessageID, text)
+	if len(accessPage.Users) > 0 {
+		keyboard := accessKeyboard(accessPage)
+		edit.ReplyMarkup = &keyboard
+	}
+	if _, err = s.bot.Request(edit); err != nil {
+		s.logger.Error().Msgf("failed to update access list, %v", err)
+	}
+}
+
+// handleRemoveAllCallback removes the access of everybody or cancels it
+// and replaces the confirmation with the result.
+func (s *Service) handleRemoveAllCallback(query *tgbotapi.CallbackQuery) {
+	text, err := s.parser.RemoveAllAccess(query.From.ID, query.Data == accessRemoveAllCallback)
+	if err != nil {
+		s.logger.Error().Msgf("error while process callback query, %v", err)
+	}
+
+	if _, err := s.bot.Request(tgbotapi.NewCallback(query.ID, "")); err != nil {
+		s.logger.Error().Msgf("failed to answer callback query, %v", err)
+	}
+
+	if query.Message == nil {
+		return
+	}
+	// editing the text without a markup removes the buttons, so the confirmation can not be pressed twice
+	edit := tgbotapi.NewEditMessageText(query.Message.Chat.ID, query.Message.MessageID, text)
+	if _, err := s.bot.Request(edit); err != nil {
+		s.logger.Error().Msgf("failed to update confirmation, %v", err)
+	}
+}
+
+// callback data of the buttons of access requests
+const (
+	accessRequestCallbackPrefix = "access_request:"
+	accessRequestCallback       = accessRequestCallbackPrefix + "%v:%v"
+	approveAccessRequest        = "approve"
+	denyAccessRequest           = "deny"
+)
+
+// runAccessRequests announces new access requests to the recipients and expires old ones until the context is done.
+func (s *Service) runAccessRequests(ctx context.Context) {
+	ticker := time.NewTicker(s.accessRequestsInterval)
+	defer ticker.Stop()
+
+	for {
+		s.expireAccessRequests()
+		s.announceAccessRequests()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Service) announceAccessRequests() {
+	updates, err := s.parser.AccessRequestsToAnnounce()
+	if err != nil {
+		s.logger.Error().Msgf("failed to get access requests to announce, %v", err)
+		return
+	}
+
+	for _, update := range updates {
+		request := update.Request
+		msg := tgbotapi.NewMessage(request.RecipientId, update.RecipientText)
+		msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("Approve",
+				fmt.Sprintf(accessRequestCallback, approveAccessRequest, request.Id)),
+			tgbotapi.NewInlineKeyboardButtonData("Deny",
+				fmt.Sprintf(accessRequestCallback, denyAccessRequest, request.Id))))
+
+		var messageId int
+		sent, err := s.bot.Send(msg)
+		if err != nil {
+			// recipients who blocked the bot will never get it, so the request just expires
+			if e, ok := err.(*tgbotapi.Error); !ok || (e.Code != http.StatusForbidden && e.Code != http.StatusBadRequest) {
+				s.logger.Error().Msgf("failed to announce access request %v, %v", request.Id, err)
+				continue
+			}
+			s.logger.Warn().Msgf("failed to announce access request %v to %v, %v", request.Id,
+				request.RecipientId, err)
+		} else {
+			messageId = sent.MessageID
+		}
+
+		if err := s.parser.AccessRequestAnnounced(request.Id, messageId); err != nil {
+			s.logger.Error().Msgf("failed to mark access request %v announced, %v", request.Id, err)
+		}
+	}
+}
+
+func (s *Service) expireAccessRequests() {
+	updates, err := s.parser.ExpireAccessRequests()
+	if err != nil {
+		s.logger.Error().Msgf("failed to expire access requests, %v", err)
+		return
+	}
+
+	for _, update := range updates {
+		if update.Request.MessageId != 0 {
+			s.editAccessRequest(update.Request.RecipientId, update.Request.MessageId, update.RecipientText)
+		}
+		s.tellRequester(update)
+	}
+}
+
+// handleAccessRequestCallback approves or denies the access request and tells the requester about it.
+func (s *Service) handleAccessRequestCallback(query *tgbotapi.CallbackQuery) {
+	tokens := strings.Split(strings.TrimPrefix(query.Data, accessRequestCallbackPrefix), ":")
+	var requestId int64
+	var err error
+	if len(tokens) == 2 && (tokens[0] == approveAccessRequest || tokens[0] == denyAccessRequest) {
+		requestId, err = strconv.ParseInt(tokens[1], 10, 64)
+	} else {
+		err = ErrUnknownCallback
+	}
+	if err != nil {
+		s.logger.Error().Msgf("failed to parse callback data %v, %v", query.Data, err)
+		if _, err = s.bot.Request(tgbotapi.NewCallback(query.ID, "")); err != nil {
+			s.logger.Error().Msgf("failed to answer callback query, %v", err)
+		}
+		return
+	}
+
+	answer, update, err := s.parser.DecideAccessRequest(query.From.ID, requestId, tokens[0] == approveAccessRequest)
+	if err != nil {
+		s.logger.Error().Msgf("error while process callback query, %v", err)
+	}
+
+	if _, err = s.bot.Request(tgbotapi.NewCallback(query.ID, answer)); err != nil {
+		s.logger.Error().Msgf("failed to answer callback query, %v", err)
+	}
+
+	// the request has been decided before or has expired
+	if update.Request.Id == 0 {
+		return
+	}
+	if query.Message != nil {
+		s.editAccessRequest(query.Message.Chat.ID, query.Message.MessageID, update.RecipientText)
+	}
+	s.tellRequester(update)
+}
+
+// editAccessRequest replaces the announcement of the access request with the text, which removes its buttons.
+func (s *Service) editAccessRequest(chatId int64, messageId int, text string) {
+	edit := tgbotapi.NewEditMessageText(chatId, messageId, text)
+	if _, err := s.bot.Request(edit); err != nil {
+		s.logger.Error().Msgf("failed to update access request message, %v", err)
+	}
+}
+
+func (s *Service) tellRequester(update model.AccessRequestUpdate) {
+	if update.RequesterText == "" {
+		return
+	}
+	msg := tgbotapi.NewMessage(update.Request.RequesterId, update.RequesterText)
+	if _, err := s.bot.Send(msg); err != nil {
+		s.logger.Error().Msgf("failed to tell the outcome of access request %v to the requester, %v",
+			update.Request.Id, err)
+	}
+}
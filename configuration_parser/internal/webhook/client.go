@@ -0,0 +1,81 @@
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"configuration_parser/internal/model"
+)
+
+const (
+	requestTimeout = 5 * time.Second
+
+	eventAction = "action"
+
+	// must match the headers of the delivery summaries posted by notification_sender
+	signatureHeader = "X-Webhook-Signature"
+	timestampHeader = "X-Webhook-Timestamp"
+)
+
+type actionEvent struct {
+	Event string `json:"event"`
+	model.NotificationAction
+}
+
+// Client posts events to the webhooks registered by the senders of notifications.
+type Client struct {
+	httpClient *http.Client
+}
+
+// NewClient creates the client, which connects only to public addresses.
+func NewClient() *Client {
+	return &Client{
+		httpClient: newPublicClient(requestTimeout),
+	}
+}
+
+// PostAction posts the action to the webhook, signed with its secret if there is one.
+func (c *Client) PostAction(url string, secret string, action model.NotificationAction) error {
+	body, err := json.Marshal(actionEvent{Event: eventAction, NotificationAction: action})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(timestampHeader, timestamp)
+	if secret != "" {
+		req.Header.Set(signatureHeader, sign(secret, timestamp, body))
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded with status %v", resp.StatusCode)
+	}
+	return nil
+}
+
+// sign returns the hex encoded HMAC-SHA256 of "timestamp.body" with the secret of the webhook.
+func sign(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,69 @@
+package webhook
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+)
+
+// forbiddenNetworks are the ranges not covered by the checks of net.IP which webhooks may not point to
+var forbiddenNetworks = []*net.IPNet{
+	mustParseCIDR("0.0.0.0/8"),
+	// carrier-grade NAT
+	mustParseCIDR("100.64.0.0/10"),
+	// IPv4-IPv6 translation
+	mustParseCIDR("64:ff9b::/96"),
+}
+
+// newPublicClient returns a client which connects only to public addresses, so webhooks
+// can not be used to reach the services next to the bot. The address is checked
+// once it is resolved, which covers redirects and hostnames resolving to private addresses.
+func newPublicClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: timeout,
+		Control: checkPublicAddress,
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// a proxy would be the address checked instead of the webhook
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+
+	return &http.Client{Timeout: timeout, Transport: transport}
+}
+
+// checkPublicAddress is the net.Dialer Control hook which rejects connections to addresses which are not public.
+func checkPublicAddress(network string, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !isPublic(ip) {
+		return fmt.Errorf("%w: %v", ErrForbiddenAddress, host)
+	}
+	return nil
+}
+
+func isPublic(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return false
+	}
+	for _, network := range forbiddenNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+func mustParseCIDR(s string) *net.IPNet {
+	_, network, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return network
+}
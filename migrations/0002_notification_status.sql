@@ -0,0 +1,18 @@
+CREATE TABLE IF NOT EXISTS notifications
+(
+    id         BIGSERIAL PRIMARY KEY,
+    sender     TEXT        NOT NULL,
+    message    TEXT        NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS notification_recipients
+(
+    notification_id     BIGINT      NOT NULL REFERENCES notifications (id) ON DELETE CASCADE,
+    recipient_id        BIGINT      NOT NULL,
+    status              TEXT        NOT NULL DEFAULT 'queued',
+    telegram_message_id BIGINT,
+    error               TEXT,
+    updated_at          TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (notification_id, recipient_id)
+);
@@ -0,0 +1,7 @@
+ALTER TABLE notifications
+    ADD COLUMN IF NOT EXISTS send_at         TIMESTAMPTZ,
+    ADD COLUMN IF NOT EXISTS schedule_status TEXT,
+    ADD COLUMN IF NOT EXISTS claimed_at      TIMESTAMPTZ;
+
+CREATE INDEX IF NOT EXISTS notifications_due_idx ON notifications (send_at)
+    WHERE schedule_status IN ('pending', 'publishing');
@@ -0,0 +1,19 @@
+CREATE TABLE IF NOT EXISTS recurring_notifications
+(
+    id          BIGSERIAL PRIMARY KEY,
+    sender      TEXT        NOT NULL,
+    cron        TEXT        NOT NULL,
+    timezone    TEXT        NOT NULL DEFAULT 'UTC',
+    message     TEXT        NOT NULL,
+    next_run_at TIMESTAMPTZ NOT NULL,
+    created_at  TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS recurring_notifications_next_run_at_idx ON recurring_notifications (next_run_at);
+
+CREATE TABLE IF NOT EXISTS recurring_notification_recipients
+(
+    recurring_notification_id BIGINT NOT NULL REFERENCES recurring_notifications (id) ON DELETE CASCADE,
+    recipient_id              BIGINT NOT NULL,
+    PRIMARY KEY (recurring_notification_id, recipient_id)
+);
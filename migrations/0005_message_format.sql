@@ -0,0 +1,5 @@
+ALTER TABLE notifications
+    ADD COLUMN IF NOT EXISTS format TEXT NOT NULL DEFAULT 'plain';
+
+ALTER TABLE recurring_notifications
+    ADD COLUMN IF NOT EXISTS format TEXT NOT NULL DEFAULT 'plain';
@@ -0,0 +1,18 @@
+CREATE TABLE IF NOT EXISTS attachments
+(
+    id         BIGSERIAL PRIMARY KEY,
+    type       TEXT        NOT NULL,
+    url        TEXT,
+    data       BYTEA,
+    file_name  TEXT,
+    file_id    TEXT,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS notification_attachments
+(
+    notification_id BIGINT NOT NULL REFERENCES notifications (id) ON DELETE CASCADE,
+    attachment_id   BIGINT NOT NULL REFERENCES attachments (id),
+    position        INT    NOT NULL,
+    PRIMARY KEY (notification_id, position)
+);
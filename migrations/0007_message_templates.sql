@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS message_templates
+(
+    id         BIGSERIAL PRIMARY KEY,
+    owner      TEXT        NOT NULL,
+    name       TEXT        NOT NULL,
+    body       TEXT        NOT NULL,
+    format     TEXT        NOT NULL DEFAULT 'plain',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    UNIQUE (owner, name)
+);
+
+-- messages rendered from templates differ between recipients
+ALTER TABLE notification_recipients
+    ADD COLUMN IF NOT EXISTS message TEXT;
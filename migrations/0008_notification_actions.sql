@@ -0,0 +1,23 @@
+ALTER TABLE notifications
+    ADD COLUMN IF NOT EXISTS buttons JSONB;
+
+CREATE TABLE IF NOT EXISTS notification_actions
+(
+    id              BIGSERIAL PRIMARY KEY,
+    notification_id BIGINT      NOT NULL,
+    recipient_id    BIGINT      NOT NULL,
+    action          TEXT        NOT NULL,
+    created_at      TIMESTAMPTZ NOT NULL DEFAULT now(),
+    FOREIGN KEY (notification_id, recipient_id)
+        REFERENCES notification_recipients (notification_id, recipient_id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS notification_actions_notification_id_idx ON notification_actions (notification_id);
+
+-- webhooks the senders get events of their notifications on
+CREATE TABLE IF NOT EXISTS webhooks
+(
+    owner      TEXT PRIMARY KEY,
+    url        TEXT        NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
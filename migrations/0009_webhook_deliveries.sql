@@ -0,0 +1,25 @@
+-- webhooks registered before have to be registered again to get a secret to sign requests with
+ALTER TABLE webhooks
+    ADD COLUMN IF NOT EXISTS secret TEXT;
+
+ALTER TABLE notifications
+    ADD COLUMN IF NOT EXISTS completed_at TIMESTAMPTZ;
+
+CREATE TABLE IF NOT EXISTS webhook_deliveries
+(
+    id              BIGSERIAL PRIMARY KEY,
+    notification_id BIGINT      NOT NULL REFERENCES notifications (id) ON DELETE CASCADE,
+    url             TEXT        NOT NULL,
+    secret          TEXT,
+    payload         JSONB       NOT NULL,
+    status          TEXT        NOT NULL DEFAULT 'pending',
+    attempts        INT         NOT NULL DEFAULT 0,
+    response_code   INT,
+    error           TEXT,
+    next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    created_at      TIMESTAMPTZ NOT NULL DEFAULT now(),
+    delivered_at    TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS webhook_deliveries_due_idx ON webhook_deliveries (next_attempt_at)
+    WHERE status = 'pending';
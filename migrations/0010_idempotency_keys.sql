@@ -0,0 +1,20 @@
+CREATE TABLE IF NOT EXISTS idempotency_keys
+(
+    owner        TEXT        NOT NULL,
+    key          TEXT        NOT NULL,
+    request_hash TEXT        NOT NULL,
+    status_code  INT,
+    response     JSONB,
+    created_at   TIMESTAMPTZ NOT NULL DEFAULT now(),
+    expires_at   TIMESTAMPTZ NOT NULL,
+    PRIMARY KEY (owner, key)
+);
+
+CREATE INDEX IF NOT EXISTS idempotency_keys_expires_at_idx ON idempotency_keys (expires_at);
+
+-- messages the sender has processed, to drop their repeated deliveries
+CREATE TABLE IF NOT EXISTS processed_messages
+(
+    message_id   TEXT PRIMARY KEY,
+    processed_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
@@ -0,0 +1,15 @@
+-- receivers caching user ids by username drop the old username on this notification
+CREATE OR REPLACE FUNCTION notify_username_changed() RETURNS trigger AS
+$$
+BEGIN
+    PERFORM pg_notify('username_changed', OLD.username);
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS users_username_changed ON users;
+CREATE TRIGGER users_username_changed
+    AFTER UPDATE OF username OR DELETE
+    ON users
+    FOR EACH ROW
+EXECUTE FUNCTION notify_username_changed();
@@ -0,0 +1,7 @@
+-- cached users are also dropped when they exit or come back
+DROP TRIGGER IF EXISTS users_username_changed ON users;
+CREATE TRIGGER users_username_changed
+    AFTER UPDATE OF username, is_active OR DELETE
+    ON users
+    FOR EACH ROW
+EXECUTE FUNCTION notify_username_changed();
@@ -0,0 +1,28 @@
+-- grants point at users by id, so they survive username changes
+ALTER TABLE notification_access
+    ADD COLUMN IF NOT EXISTS granted_user_id BIGINT REFERENCES users (id) ON DELETE CASCADE;
+
+UPDATE notification_access a
+SET granted_user_id = u.id
+FROM users u
+WHERE u.username = a.username_with_access
+  AND a.granted_user_id IS NULL;
+
+-- grants to usernames nobody has anymore do not let anyone send notifications
+DELETE FROM notification_access WHERE granted_user_id IS NULL;
+
+ALTER TABLE notification_access
+    ALTER COLUMN granted_user_id SET NOT NULL,
+    DROP COLUMN IF EXISTS username_with_access;
+
+CREATE UNIQUE INDEX IF NOT EXISTS notification_access_user_id_granted_user_id_idx
+    ON notification_access (user_id, granted_user_id);
+
+CREATE TABLE IF NOT EXISTS username_history
+(
+    user_id    BIGINT      NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    username   TEXT        NOT NULL,
+    changed_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS username_history_username_idx ON username_history (username, changed_at);
@@ -0,0 +1,22 @@
+-- requests of senders to be granted access by recipients, announced and decided in the bot
+CREATE TABLE IF NOT EXISTS access_requests
+(
+    id           BIGSERIAL PRIMARY KEY,
+    requester_id BIGINT      NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    recipient_id BIGINT      NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    -- pending, approved, denied or expired
+    status       TEXT        NOT NULL DEFAULT 'pending',
+    -- the bot message with the buttons, NULL until it is announced or if it could not be sent
+    message_id   BIGINT,
+    announced_at TIMESTAMPTZ,
+    created_at   TIMESTAMPTZ NOT NULL DEFAULT now(),
+    expires_at   TIMESTAMPTZ NOT NULL,
+    decided_at   TIMESTAMPTZ
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS access_requests_pending_idx
+    ON access_requests (requester_id, recipient_id) WHERE status = 'pending';
+
+CREATE INDEX IF NOT EXISTS access_requests_requester_id_idx ON access_requests (requester_id, created_at);
+
+CREATE INDEX IF NOT EXISTS access_requests_expires_at_idx ON access_requests (expires_at) WHERE status = 'pending';
@@ -0,0 +1,3 @@
+-- how many parts of a long message or its attachments are sent, so a retry sends only the rest
+ALTER TABLE notification_recipients
+    ADD COLUMN IF NOT EXISTS sent_parts INTEGER NOT NULL DEFAULT 0;
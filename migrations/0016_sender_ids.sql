@@ -0,0 +1,58 @@
+-- senders point at users by id, so renames keep their notifications, templates, webhooks and idempotency keys.
+-- The sender text of notifications stays as the username the notification was sent with.
+ALTER TABLE notifications
+    ADD COLUMN IF NOT EXISTS sender_id BIGINT REFERENCES users (id) ON DELETE SET NULL;
+ALTER TABLE recurring_notifications
+    ADD COLUMN IF NOT EXISTS sender_id BIGINT REFERENCES users (id) ON DELETE CASCADE;
+ALTER TABLE message_templates
+    ADD COLUMN IF NOT EXISTS owner_id BIGINT REFERENCES users (id) ON DELETE CASCADE;
+ALTER TABLE webhooks
+    ADD COLUMN IF NOT EXISTS owner_id BIGINT REFERENCES users (id) ON DELETE CASCADE;
+ALTER TABLE idempotency_keys
+    ADD COLUMN IF NOT EXISTS owner_id BIGINT REFERENCES users (id) ON DELETE CASCADE;
+
+-- @usernames of the users, including the old ones nobody has taken since
+CREATE TEMPORARY VIEW sender_names AS
+SELECT '@' || username AS sender, id
+FROM users
+UNION ALL
+(SELECT DISTINCT ON (h.username) '@' || h.username, h.user_id
+ FROM username_history h
+ WHERE NOT EXISTS(SELECT 1 FROM users WHERE username = h.username)
+ ORDER BY h.username, h.changed_at DESC);
+
+UPDATE notifications n SET sender_id = s.id FROM sender_names s WHERE s.sender = n.sender AND n.sender_id IS NULL;
+UPDATE recurring_notifications n SET sender_id = s.id FROM sender_names s WHERE s.sender = n.sender AND n.sender_id IS NULL;
+UPDATE message_templates t SET owner_id = s.id FROM sender_names s WHERE s.sender = t.owner AND t.owner_id IS NULL;
+UPDATE webhooks w SET owner_id = s.id FROM sender_names s WHERE s.sender = w.owner AND w.owner_id IS NULL;
+UPDATE idempotency_keys k SET owner_id = s.id FROM sender_names s WHERE s.sender = k.owner AND k.owner_id IS NULL;
+
+DROP VIEW sender_names;
+
+-- senders nobody has anymore can not authenticate, so nothing of theirs can be used;
+-- their sent notifications are kept for the history
+DELETE FROM recurring_notifications WHERE sender_id IS NULL;
+DELETE FROM message_templates WHERE owner_id IS NULL;
+DELETE FROM webhooks WHERE owner_id IS NULL;
+DELETE FROM idempotency_keys WHERE owner_id IS NULL;
+
+ALTER TABLE recurring_notifications
+    ALTER COLUMN sender_id SET NOT NULL;
+
+ALTER TABLE message_templates
+    ALTER COLUMN owner_id SET NOT NULL,
+    DROP COLUMN IF EXISTS owner,
+    ADD UNIQUE (owner_id, name);
+
+ALTER TABLE webhooks
+    ALTER COLUMN owner_id SET NOT NULL,
+    DROP COLUMN IF EXISTS owner,
+    ADD PRIMARY KEY (owner_id);
+
+ALTER TABLE idempotency_keys
+    ALTER COLUMN owner_id SET NOT NULL,
+    DROP COLUMN IF EXISTS owner,
+    ADD PRIMARY KEY (owner_id, key);
+
+CREATE INDEX IF NOT EXISTS notifications_sender_id_idx ON notifications (sender_id);
+CREATE INDEX IF NOT EXISTS recurring_notifications_sender_id_idx ON recurring_notifications (sender_id);
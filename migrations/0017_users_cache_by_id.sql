@@ -0,0 +1,22 @@
+-- receivers caching user ids by username drop every username of the user on this notification, including
+-- old ones still resolved from the history, and whatever the current username of the user was cached for.
+-- The payload is "<user id> <username>".
+CREATE OR REPLACE FUNCTION notify_username_changed() RETURNS trigger AS
+$$
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        PERFORM pg_notify('username_changed', OLD.id || ' ' || COALESCE(OLD.username, ''));
+    ELSE
+        PERFORM pg_notify('username_changed', NEW.id || ' ' || COALESCE(NEW.username, ''));
+    END IF;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+-- a new user may take a username cached for the user who had it before
+DROP TRIGGER IF EXISTS users_username_changed ON users;
+CREATE TRIGGER users_username_changed
+    AFTER INSERT OR UPDATE OF username, is_active OR DELETE
+    ON users
+    FOR EACH ROW
+EXECUTE FUNCTION notify_username_changed();
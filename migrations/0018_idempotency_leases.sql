@@ -0,0 +1,7 @@
+-- keys of requests which have not finished by reserved_until, e.g. because the receiver crashed,
+-- are taken over by the next request with the key
+ALTER TABLE idempotency_keys
+    ADD COLUMN IF NOT EXISTS reserved_until TIMESTAMPTZ NOT NULL DEFAULT now();
+
+-- processed messages are pruned by the sender once they can not be delivered again
+CREATE INDEX IF NOT EXISTS processed_messages_processed_at_idx ON processed_messages (processed_at);
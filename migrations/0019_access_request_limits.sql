@@ -0,0 +1,59 @@
+-- limits of access requests, the same for the ones made with /request_access in the bot and through the receiver API
+CREATE TABLE IF NOT EXISTS access_request_limits
+(
+    -- the table has a single row
+    id        BOOLEAN PRIMARY KEY DEFAULT true CHECK (id),
+    -- how long the recipient has to decide the request
+    ttl       INTERVAL NOT NULL,
+    -- how many requests a requester may create a day
+    max_daily INTEGER  NOT NULL,
+    -- how long a requester may not ask the recipient again after a denial
+    cooldown  INTERVAL NOT NULL
+);
+
+INSERT INTO access_request_limits (ttl, max_daily, cooldown)
+VALUES (interval '72 hours', 10, interval '7 days')
+ON CONFLICT DO NOTHING;
+
+-- create_access_request creates a pending request of the requester to be granted access by the recipient.
+-- A request which breaks the limits raises:
+--   AR001 if the access is already granted,
+--   AR002 if the recipient has denied a request of the requester within the cooldown,
+--   AR003 if the requester has created too many requests a day.
+CREATE OR REPLACE FUNCTION create_access_request(p_requester_id BIGINT, p_recipient_id BIGINT)
+    RETURNS SETOF access_requests
+    LANGUAGE plpgsql AS
+$$
+DECLARE
+    limits access_request_limits;
+BEGIN
+    -- requests of the same requester are created one by one, so the limit can not be exceeded concurrently
+    PERFORM pg_advisory_xact_lock(p_requester_id);
+
+    SELECT * INTO STRICT limits FROM access_request_limits;
+
+    IF EXISTS(SELECT 1 FROM notification_access WHERE user_id = p_recipient_id AND granted_user_id = p_requester_id) THEN
+        RAISE EXCEPTION 'access is already granted' USING ERRCODE = 'AR001';
+    END IF;
+
+    IF EXISTS(SELECT 1
+              FROM access_requests
+              WHERE requester_id = p_requester_id
+                AND recipient_id = p_recipient_id
+                AND status = 'denied'
+                AND decided_at > now() - limits.cooldown) THEN
+        RAISE EXCEPTION 'access request is recently denied' USING ERRCODE = 'AR002';
+    END IF;
+
+    IF (SELECT count(*)
+        FROM access_requests
+        WHERE requester_id = p_requester_id
+          AND created_at > now() - interval '1 day') >= limits.max_daily THEN
+        RAISE EXCEPTION 'too many access requests' USING ERRCODE = 'AR003';
+    END IF;
+
+    RETURN QUERY INSERT INTO access_requests (requester_id, recipient_id, expires_at)
+        VALUES (p_requester_id, p_recipient_id, now() + limits.ttl)
+        RETURNING *;
+END
+$$;
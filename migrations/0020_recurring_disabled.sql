@@ -0,0 +1,5 @@
+-- recurring notifications whose next run can not be computed, e.g. because the timezone is not known anymore,
+-- are disabled with the reason instead of being picked up as due on every poll
+ALTER TABLE recurring_notifications
+    ADD COLUMN IF NOT EXISTS disabled_at     TIMESTAMPTZ,
+    ADD COLUMN IF NOT EXISTS disabled_reason TEXT;
@@ -1,15 +1,24 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
 	"net/http"
 	"notification_receiver/internal/repository/postgres"
 	"os"
-
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"notification_receiver/internal/auth"
+	"notification_receiver/internal/cache"
 	addNotifications "notification_receiver/internal/handlers"
 	"notification_receiver/internal/publisher"
+	"notification_receiver/internal/scheduler"
 
 	"github.com/gorilla/mux"
 	"github.com/joho/godotenv"
@@ -17,6 +26,9 @@ import (
 	"github.com/rs/zerolog"
 )
 
+// how long in-flight requests are waited for on shutdown
+const shutdownTimeout = 30 * time.Second
+
 func main() {
 	mainLogger := initLogger()
 	logger := mainLogger.With().Str("component", "main").Logger()
@@ -47,7 +59,32 @@ func main() {
 	// TODO handle error
 	defer publisherService.Close()
 
-	addNotificationHandler := addNotifications.NewHandler(repository, logger, publisherService)
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	usersCacheTTL, err := getUsersCacheTTL()
+	if err != nil {
+		logger.Panic().Msgf("failed to get users cache ttl from env: %v", err)
+	}
+	var users interface {
+		GetUsers(userNames []string) (map[string]int64, error)
+	} = repository
+	if usersCacheTTL > 0 {
+		usersCache := cache.NewUsers(logger, repository, usersCacheTTL)
+		go func() {
+			if err := usersCache.Listen(ctx, postgresCredentials); err != nil {
+				logger.Error().Msgf("failed to listen username changes, cached users only expire after ttl: %v", err)
+			}
+		}()
+		users = usersCache
+	}
+
+	addNotificationHandler := addNotifications.NewHandler(repository, users, logger, publisherService)
+	apiAdmins, err := getApiAdmins()
+	if err != nil {
+		logger.Panic().Msgf("failed to get api admins from env: %v", err)
+	}
+	authMiddleware := auth.NewMiddleware(repository, logger, apiAdmins)
 
 	httpServerCredentials, err := getHttpServerCredentials()
 	if err != nil {
@@ -55,9 +92,66 @@ func main() {
 	}
 
 	router := mux.NewRouter()
-	router.HandleFunc("/api/add-notification", addNotificationHandler.AddNotification).Methods("POST")
+	api := router.PathPrefix("/api").Subrouter()
+	api.Use(authMiddleware.Authenticate)
+	api.HandleFunc("/add-notification", addNotificationHandler.AddNotification).Methods("POST")
+	api.HandleFunc("/notifications/batch", addNotificationHandler.AddNotificationsBatch).Methods("POST")
+	api.HandleFunc("/notifications/{id}", addNotificationHandler.GetNotificationStatus).Methods("GET")
+	api.HandleFunc("/scheduled", addNotificationHandler.ListScheduledNotifications).Methods("GET")
+	api.HandleFunc("/scheduled/{id}", addNotificationHandler.CancelScheduledNotification).Methods("DELETE")
+	api.HandleFunc("/recurring", addNotificationHandler.CreateRecurringNotification).Methods("POST")
+	api.HandleFunc("/recurring", addNotificationHandler.ListRecurringNotifications).Methods("GET")
+	api.HandleFunc("/recurring/{id}", addNotificationHandler.DeleteRecurringNotification).Methods("DELETE")
+	api.HandleFunc("/templates", addNotificationHandler.CreateTemplate).Methods("POST")
+	api.HandleFunc("/templates", addNotificationHandler.ListTemplates).Methods("GET")
+	api.HandleFunc("/templates/{name}", addNotificationHandler.GetTemplate).Methods("GET")
+	api.HandleFunc("/templates/{name}", addNotificationHandler.UpdateTemplate).Methods("PUT")
+	api.HandleFunc("/templates/{name}", addNotificationHandler.DeleteTemplate).Methods("DELETE")
+	api.HandleFunc("/webhook", addNotificationHandler.SetWebhook).Methods("PUT")
+	api.HandleFunc("/webhook", addNotificationHandler.GetWebhook).Methods("GET")
+	api.HandleFunc("/webhook", addNotificationHandler.DeleteWebhook).Methods("DELETE")
+	api.HandleFunc("/access-requests", addNotificationHandler.RequestAccess).Methods("POST")
+	api.HandleFunc("/access-requests/{id}", addNotificationHandler.GetAccessRequest).Methods("GET")
+
+	admin := api.PathPrefix("/dead-letters").Subrouter()
+	admin.Use(authMiddleware.RequireAdmin)
+	admin.HandleFunc("", addNotificationHandler.ListDeadLetters).Methods("GET")
+	admin.HandleFunc("/replay", addNotificationHandler.ReplayDeadLetters).Methods("POST")
+
+	schedulerService := scheduler.NewService(logger, repository, publisherService, scheduler.RealClock())
+	schedulerDone := make(chan struct{})
+	go func() {
+		defer close(schedulerDone)
+		schedulerService.Run(ctx)
+	}()
+	defer func() {
+		stop()
+		<-schedulerDone
+	}()
+
+	server := &http.Server{
+		Addr:    httpServerCredentials,
+		Handler: router,
+	}
+
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.ListenAndServe()
+	}()
 
-	logger.Fatal().Msgf("failed to listen http server: %v", http.ListenAndServe(httpServerCredentials, router))
+	select {
+	case err := <-serverErr:
+		logger.Error().Msgf("failed to listen http server: %v", err)
+		return
+	case <-ctx.Done():
+	}
+
+	logger.Info().Msg("shutting down http server")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		logger.Error().Msgf("failed to shutdown http server: %v", err)
+	}
 }
 
 func initLogger() zerolog.Logger {
@@ -79,6 +173,37 @@ func getHttpServerCredentials() (string, error) {
 	return fmt.Sprintf("%s:%s", host, port), nil
 }
 
+// getApiAdmins returns the telegram user ids of the comma separated API_ADMINS.
+func getApiAdmins() ([]int64, error) {
+	value, ok := os.LookupEnv("API_ADMINS")
+	if !ok || value == "" {
+		return nil, nil
+	}
+
+	var admins []int64
+	for _, admin := range strings.Split(value, ",") {
+		id, err := strconv.ParseInt(strings.TrimSpace(admin), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse API_ADMINS: %v", value)
+		}
+		admins = append(admins, id)
+	}
+	return admins, nil
+}
+
+// getUsersCacheTTL returns how long user ids are cached by username, zero if the cache is disabled.
+func getUsersCacheTTL() (time.Duration, error) {
+	value, ok := os.LookupEnv("USERS_CACHE_TTL")
+	if !ok || value == "" {
+		return 0, nil
+	}
+	ttl, err := time.ParseDuration(value)
+	if err != nil || ttl < 0 {
+		return 0, fmt.Errorf("failed to parse USERS_CACHE_TTL: %v", value)
+	}
+	return ttl, nil
+}
+
 func getPostgresCredentials() (string, error) {
 	host, ok := os.LookupEnv("PGHOST")
 	if !ok {
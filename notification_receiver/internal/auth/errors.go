@@ -0,0 +1,10 @@
+package auth
+
+import "errors"
+
+var (
+	ErrMissingApiKey = errors.New("api key is missing")
+	ErrInvalidApiKey = errors.New("api key is invalid or revoked")
+	ErrForbidden     = errors.New("not enough rights")
+	ErrInternal      = errors.New("internal error while checking api key")
+)
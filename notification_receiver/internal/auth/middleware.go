@@ -0,0 +1,121 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/rs/zerolog"
+)
+
+type contextKey struct{}
+
+// identity is the client authenticated by the API key
+type identity struct {
+	userId   int64
+	userName string
+}
+
+type errorMessage struct {
+	Error string `json:"errorMessage"`
+}
+
+type repo interface {
+	GetApiKeyOwner(keyHash string) (int64, string, error)
+}
+
+type Middleware struct {
+	repo   repo
+	logger zerolog.Logger
+	admins map[int64]struct{}
+}
+
+// NewMiddleware creates the middleware, admins are telegram user ids as usernames can be taken by someone else.
+func NewMiddleware(repo repo, logger zerolog.Logger, admins []int64) *Middleware {
+	l := logger.With().Str("component", "auth_middleware").Logger()
+
+	adminSet := make(map[int64]struct{}, len(admins))
+	for _, admin := range admins {
+		adminSet[admin] = struct{}{}
+	}
+
+	return &Middleware{
+		repo:   repo,
+		logger: l,
+		admins: adminSet,
+	}
+}
+
+// Authenticate resolves the API key of the request to the telegram user id and username of its owner
+// and stores them in the request context.
+func (m *Middleware) Authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := apiKeyFromRequest(r)
+		if key == "" {
+			m.respond(w, ErrMissingApiKey, http.StatusUnauthorized)
+			return
+		}
+
+		hash := sha256.Sum256([]byte(key))
+		userId, userName, err := m.repo.GetApiKeyOwner(hex.EncodeToString(hash[:]))
+		if err != nil {
+			if err == sql.ErrNoRows {
+				m.respond(w, ErrInvalidApiKey, http.StatusUnauthorized)
+				return
+			}
+			m.logger.Error().Msgf("failed to get api key owner: %v", err)
+			m.respond(w, ErrInternal, http.StatusInternalServerError)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), contextKey{}, identity{userId: userId, userName: userName})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// RequireAdmin lets through only authenticated clients listed as admins.
+func (m *Middleware) RequireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userId, _, ok := User(r.Context())
+		if !ok {
+			m.respond(w, ErrMissingApiKey, http.StatusUnauthorized)
+			return
+		}
+		if _, ok := m.admins[userId]; !ok {
+			m.respond(w, ErrForbidden, http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// User returns the telegram user id and username of the authenticated client. Everything the client owns
+// is keyed by the id, as the username may change.
+func User(ctx context.Context) (int64, string, bool) {
+	client, ok := ctx.Value(contextKey{}).(identity)
+	return client.userId, client.userName, ok
+}
+
+func (m *Middleware) respond(w http.ResponseWriter, err error, code int) {
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(errorMessage{Error: err.Error()}); err != nil {
+		m.logger.Error().Msgf("failed to write response: %v", err)
+	}
+}
+
+func apiKeyFromRequest(r *http.Request) string {
+	if key := r.Header.Get("X-Api-Key"); key != "" {
+		return key
+	}
+
+	header := r.Header.Get("Authorization")
+	if strings.HasPrefix(header, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+	}
+	return ""
+}
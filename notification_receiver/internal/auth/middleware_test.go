@@ -0,0 +1,47 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+// fakeRepo resolves every key to the user of the key
+type fakeRepo map[string]struct {
+	id       int64
+	userName string
+}
+
+func (r fakeRepo) GetApiKeyOwner(keyHash string) (int64, string, error) {
+	owner := r[keyHash]
+	return owner.id, owner.userName, nil
+}
+
+func TestRequireAdminMatchesUserId(t *testing.T) {
+	repo := fakeRepo{
+		hashKey("admin"): {id: 1, userName: "admin"},
+		// someone who has taken the username the admin had before
+		hashKey("impostor"): {id: 2, userName: "old_admin"},
+	}
+	m := NewMiddleware(repo, zerolog.Nop(), []int64{1})
+	handler := m.Authenticate(m.RequireAdmin(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+
+	for key, want := range map[string]int{"admin": http.StatusOK, "impostor": http.StatusForbidden} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("X-Api-Key", key)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != want {
+			t.Errorf("%v got status %v, want %v", key, w.Code, want)
+		}
+	}
+}
+
+func hashKey(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(hash[:])
+}
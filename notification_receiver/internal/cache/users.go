@@ -0,0 +1,211 @@
+package cache
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/rs/zerolog"
+)
+
+const (
+	// the channel the database notifies about changed usernames on
+	usernameChangedChannel = "username_changed"
+
+	minReconnectInterval = time.Second
+	maxReconnectInterval = time.Minute
+)
+
+type repo interface {
+	GetUsers(userNames []string) (map[string]int64, error)
+}
+
+type entry struct {
+	userId    int64
+	expiresAt time.Time
+}
+
+// Users caches ids of users by username for ttl. Only registered users are cached,
+// so users registered in the meantime are found right away.
+type Users struct {
+	logger zerolog.Logger
+	repo   repo
+	ttl    time.Duration
+
+	mu      sync.RWMutex
+	entries map[string]entry
+	// userNames are the cached usernames of every user, current and old ones
+	userNames map[int64][]string
+	// expired entries are removed once a ttl
+	purgeAt time.Time
+	// generation changes on every invalidation, users looked up meanwhile may be stale and are not cached
+	generation uint64
+}
+
+func NewUsers(logger zerolog.Logger, repo repo, ttl time.Duration) *Users {
+	l := logger.With().Str("component", "users_cache").Logger()
+	return &Users{
+		logger:    l,
+		repo:      repo,
+		ttl:       ttl,
+		entries:   make(map[string]entry),
+		userNames: make(map[int64][]string),
+		purgeAt:   time.Now().Add(ttl),
+	}
+}
+
+// GetUsers returns ids of the users by username like the repository, looking up only the ones not cached.
+func (c *Users) GetUsers(userNames []string) (map[string]int64, error) {
+	now := time.Now()
+	users := make(map[string]int64, len(userNames))
+	var missing []string
+
+	c.mu.RLock()
+	generation := c.generation
+	for _, userName := range userNames {
+		if e, ok := c.entries[userName]; ok && now.Before(e.expiresAt) {
+			users[userName] = e.userId
+		} else {
+			missing = append(missing, userName)
+		}
+	}
+	c.mu.RUnlock()
+
+	if len(missing) == 0 {
+		return users, nil
+	}
+
+	found, err := c.repo.GetUsers(missing)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !now.Before(c.purgeAt) {
+		c.purge(now)
+	}
+	for userName, userId := range found {
+		users[userName] = userId
+		if c.generation != generation {
+			continue
+		}
+		c.remove(userName)
+		c.entries[userName] = entry{userId: userId, expiresAt: now.Add(c.ttl)}
+		c.userNames[userId] = append(c.userNames[userId], userName)
+	}
+	return users, nil
+}
+
+// Invalidate drops the username, whoever it is cached for.
+func (c *Users) Invalidate(userName string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	c.remove(userName)
+}
+
+// InvalidateUser drops every cached username of the user.
+func (c *Users) InvalidateUser(userId int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	for _, userName := range c.userNames[userId] {
+		delete(c.entries, userName)
+	}
+	delete(c.userNames, userId)
+}
+
+func (c *Users) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	c.entries = make(map[string]entry)
+	c.userNames = make(map[int64][]string)
+}
+
+// remove drops the username, the caller must hold the write lock.
+func (c *Users) remove(userName string) {
+	e, ok := c.entries[userName]
+	if !ok {
+		return
+	}
+	delete(c.entries, userName)
+
+	userNames := c.userNames[e.userId]
+	for i, cached := range userNames {
+		if cached == userName {
+			userNames = append(userNames[:i], userNames[i+1:]...)
+			break
+		}
+	}
+	if len(userNames) == 0 {
+		delete(c.userNames, e.userId)
+	} else {
+		c.userNames[e.userId] = userNames
+	}
+}
+
+// purge drops the expired entries, the caller must hold the write lock.
+func (c *Users) purge(now time.Time) {
+	for userName, e := range c.entries {
+		if !now.Before(e.expiresAt) {
+			c.remove(userName)
+		}
+	}
+	c.purgeAt = now.Add(c.ttl)
+}
+
+// Listen invalidates the users the database notifies about until the context is done.
+// The whole cache is cleared on reconnection, as notifications could be missed in the meantime.
+func (c *Users) Listen(ctx context.Context, postgresCredentials string) error {
+	listener := pq.NewListener(postgresCredentials, minReconnectInterval, maxReconnectInterval,
+		func(event pq.ListenerEventType, err error) {
+			if err != nil {
+				c.logger.Error().Msgf("username notifications listener: %v", err)
+			}
+		})
+	defer listener.Close()
+
+	if err := listener.Listen(usernameChangedChannel); err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case notification := <-listener.Notify:
+			if notification == nil {
+				c.logger.Warn().Msg("reconnected to database, clearing the cache")
+				c.Clear()
+				continue
+			}
+			c.invalidateChanged(notification.Extra)
+		}
+	}
+}
+
+// invalidateChanged drops the user of the notification with all their usernames, as well as their current
+// username, which may be cached for the user who had it before. Notifications with a username alone
+// come from the trigger before user ids were added.
+func (c *Users) invalidateChanged(payload string) {
+	fields := strings.SplitN(payload, " ", 2)
+	if len(fields) == 1 {
+		c.Invalidate(payload)
+		return
+	}
+	userId, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		c.logger.Warn().Msgf("unexpected username notification %q, clearing the cache", payload)
+		c.Clear()
+		return
+	}
+	c.InvalidateUser(userId)
+	if fields[1] != "" {
+		c.Invalidate(fields[1])
+	}
+}
@@ -0,0 +1,197 @@
+package cache
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+type fakeRepo struct {
+	mu     sync.Mutex
+	users  map[string]int64
+	lookup int
+	// lookingUp is called during the lookup, before its result is returned
+	lookingUp func()
+}
+
+func (r *fakeRepo) GetUsers(userNames []string) (map[string]int64, error) {
+	if r.lookingUp != nil {
+		r.lookingUp()
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lookup += len(userNames)
+	users := make(map[string]int64, len(userNames))
+	for _, userName := range userNames {
+		if id, ok := r.users[userName]; ok {
+			users[userName] = id
+		}
+	}
+	return users, nil
+}
+
+func (r *fakeRepo) lookups() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.lookup
+}
+
+func TestGetUsersCachesRegisteredUsers(t *testing.T) {
+	repo := &fakeRepo{users: map[string]int64{"alice": 1, "bob": 2}}
+	c := NewUsers(zerolog.Nop(), repo, time.Hour)
+
+	for i := 0; i < 2; i++ {
+		users, err := c.GetUsers([]string{"alice", "bob", "carol"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(users) != 2 || users["alice"] != 1 || users["bob"] != 2 {
+			t.Fatalf("got %v", users)
+		}
+	}
+	// carol is not registered, so she is looked up every time
+	if lookups := repo.lookups(); lookups != 4 {
+		t.Errorf("looked up %v usernames, want 4", lookups)
+	}
+}
+
+func TestInvalidateUserDropsOldUsernames(t *testing.T) {
+	// the old username of alice still resolves to her from the history
+	repo := &fakeRepo{users: map[string]int64{"alice": 1, "alice_old": 1, "bob": 2}}
+	c := NewUsers(zerolog.Nop(), repo, time.Hour)
+	if _, err := c.GetUsers([]string{"alice", "alice_old", "bob"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// alice exits the bot
+	delete(repo.users, "alice")
+	delete(repo.users, "alice_old")
+	c.invalidateChanged("1 alice")
+
+	users, err := c.GetUsers([]string{"alice", "alice_old", "bob"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 1 || users["bob"] != 2 {
+		t.Errorf("got %v, want only bob", users)
+	}
+	if _, ok := c.userNames[1]; ok {
+		t.Error("usernames of the invalidated user are kept")
+	}
+}
+
+func TestInvalidateTakenUsername(t *testing.T) {
+	// alice has renamed herself, her old name resolves to her until someone takes it
+	repo := &fakeRepo{users: map[string]int64{"alice_old": 1}}
+	c := NewUsers(zerolog.Nop(), repo, time.Hour)
+	if _, err := c.GetUsers([]string{"alice_old"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// carol registers with the old name of alice
+	repo.users["alice_old"] = 3
+	c.invalidateChanged("3 alice_old")
+
+	users, err := c.GetUsers([]string{"alice_old"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if users["alice_old"] != 3 {
+		t.Errorf("alice_old resolves to %v, want 3", users["alice_old"])
+	}
+	if len(c.userNames[1]) != 0 || len(c.userNames[3]) != 1 {
+		t.Errorf("usernames by user are %v", c.userNames)
+	}
+}
+
+func TestInvalidateLegacyNotification(t *testing.T) {
+	repo := &fakeRepo{users: map[string]int64{"alice": 1}}
+	c := NewUsers(zerolog.Nop(), repo, time.Hour)
+	if _, err := c.GetUsers([]string{"alice"}); err != nil {
+		t.Fatal(err)
+	}
+
+	c.invalidateChanged("alice")
+	if len(c.entries) != 0 {
+		t.Errorf("entries are %v, want none", c.entries)
+	}
+}
+
+func TestInvalidationDuringLookupIsNotLost(t *testing.T) {
+	repo := &fakeRepo{users: map[string]int64{"alice": 1}}
+	c := NewUsers(zerolog.Nop(), repo, time.Hour)
+
+	// alice exits the bot while her id is being looked up, the lookup may have read it before
+	repo.lookingUp = func() {
+		repo.lookingUp = nil
+		c.invalidateChanged("1 alice")
+	}
+	users, err := c.GetUsers([]string{"alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if users["alice"] != 1 {
+		t.Errorf("alice resolves to %v, want 1 as read", users["alice"])
+	}
+	if len(c.entries) != 0 {
+		t.Errorf("entries are %v, want none cached after the invalidation", c.entries)
+	}
+
+	// the next lookup caches again
+	if _, err := c.GetUsers([]string{"alice"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.entries) != 1 {
+		t.Errorf("entries are %v, want alice", c.entries)
+	}
+}
+
+func TestExpiredEntriesArePurged(t *testing.T) {
+	repo := &fakeRepo{users: map[string]int64{}}
+	for i := 0; i < 100; i++ {
+		repo.users["user"+strconv.Itoa(i)] = int64(i)
+	}
+	c := NewUsers(zerolog.Nop(), repo, time.Millisecond)
+
+	for i := 0; i < 100; i++ {
+		if _, err := c.GetUsers([]string{"user" + strconv.Itoa(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(5 * time.Millisecond)
+	if _, err := c.GetUsers([]string{"user0"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(c.entries) != 1 || len(c.userNames) != 1 {
+		t.Errorf("%v entries of %v users are left, want only the one just looked up", len(c.entries),
+			len(c.userNames))
+	}
+}
+
+func recipients(n int) []string {
+	userNames := make([]string, n)
+	for i := range userNames {
+		userNames[i] = "user" + strconv.Itoa(i)
+	}
+	return userNames
+}
+
+func BenchmarkGetUsersCached(b *testing.B) {
+	userNames := recipients(100)
+	repo := &fakeRepo{users: make(map[string]int64)}
+	for i, userName := range userNames {
+		repo.users[userName] = int64(i)
+	}
+	c := NewUsers(zerolog.Nop(), repo, time.Hour)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := c.GetUsers(userNames); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,11 @@
+package formatting
+
+import "errors"
+
+var (
+	ErrEmptyMessage  = errors.New("message must not be empty")
+	ErrUnknownFormat = errors.New("format must be one of plain, markdown_v2, html")
+	ErrMalformed     = errors.New("malformed message")
+	ErrUnsplittable  = errors.New("message is too long and can not be split outside of an entity")
+	ErrTooLong       = errors.New("message must not exceed 65536 characters")
+)
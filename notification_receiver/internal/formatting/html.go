@@ -0,0 +1,89 @@
+package formatting
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+var (
+	htmlEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+	htmlEntity = regexp.MustCompile(`^&(lt|gt|amp|quot|#[0-9]+|#x[0-9a-fA-F]+);`)
+	htmlTag    = regexp.MustCompile(`^<(/?)([a-zA-Z-]+)((?:\s+[a-zA-Z-]+\s*=\s*"[^"]*")*)\s*>`)
+)
+
+// tags supported by telegram with the attribute they require
+var htmlTags = map[string]string{
+	"b":          "",
+	"strong":     "",
+	"i":          "",
+	"em":         "",
+	"u":          "",
+	"ins":        "",
+	"s":          "",
+	"strike":     "",
+	"del":        "",
+	"tg-spoiler": "",
+	"span":       "class",
+	"a":          "href",
+	"tg-emoji":   "emoji-id",
+	"code":       "",
+	"pre":        "",
+	"blockquote": "",
+}
+
+// htmlBoundaries validates telegram HTML and returns the byte offsets outside of tags.
+func htmlBoundaries(text string) ([]int, error) {
+	var safe []int
+	var stack []string
+
+	for i := 0; i < len(text); {
+		if len(stack) == 0 {
+			safe = append(safe, i)
+		}
+
+		switch text[i] {
+		case '<':
+			m := htmlTag.FindStringSubmatch(text[i:])
+			if m == nil {
+				return nil, fmt.Errorf("%w: unescaped < at %v", ErrMalformed, i)
+			}
+			closing, name, attributes := m[1] == "/", strings.ToLower(m[2]), m[3]
+
+			required, ok := htmlTags[name]
+			if !ok {
+				return nil, fmt.Errorf("%w: unsupported tag <%v>", ErrMalformed, name)
+			}
+			if closing {
+				if len(stack) == 0 || stack[len(stack)-1] != name {
+					return nil, fmt.Errorf("%w: unexpected </%v>", ErrMalformed, name)
+				}
+				stack = stack[:len(stack)-1]
+			} else {
+				if required != "" && !strings.Contains(attributes, required) {
+					return nil, fmt.Errorf("%w: <%v> requires %v attribute", ErrMalformed, name, required)
+				}
+				stack = append(stack, name)
+			}
+			i += len(m[0])
+		case '>':
+			return nil, fmt.Errorf("%w: unescaped > at %v", ErrMalformed, i)
+		case '&':
+			m := htmlEntity.FindString(text[i:])
+			if m == "" {
+				return nil, fmt.Errorf("%w: unescaped & at %v", ErrMalformed, i)
+			}
+			i += len(m)
+		default:
+			_, size := utf8.DecodeRuneInString(text[i:])
+			i += size
+		}
+	}
+
+	if len(stack) > 0 {
+		return nil, fmt.Errorf("%w: tag <%v> is not closed", ErrMalformed, stack[len(stack)-1])
+	}
+	return append(safe, len(text)), nil
+}
@@ -0,0 +1,100 @@
+package addNotifications
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"notification_receiver/internal/auth"
+	"notification_receiver/internal/repository"
+
+	"github.com/gorilla/mux"
+)
+
+type accessRequestMessage struct {
+	Recipient string `json:"recipient"`
+}
+
+// RequestAccess asks the recipient to let the sender send them notifications.
+// The bot sends the recipient a message to approve or deny the request and tells the sender the outcome.
+func (h *Handler) RequestAccess(w http.ResponseWriter, r *http.Request) {
+	message := accessRequestMessage{}
+	if err := json.NewDecoder(r.Body).Decode(&message); err != nil {
+		h.respond(w, errorMessage{Error: fmt.Sprintf("failed to decode request: %v", err)}, http.StatusBadRequest)
+		return
+	}
+	if len(message.Recipient) < 2 || message.Recipient[0] != '@' {
+		h.respond(w, errorMessage{Error: ErrInvalidRecipient.Error()}, http.StatusBadRequest)
+		return
+	}
+	recipientUserName := message.Recipient[1:]
+
+	requesterId, senderUserName, ok := auth.User(r.Context())
+	if !ok {
+		h.respond(w, errorMessage{Error: auth.ErrMissingApiKey.Error()}, http.StatusUnauthorized)
+		return
+	}
+
+	ids, err := h.users.GetUsers([]string{recipientUserName})
+	if err != nil {
+		h.logger.Error().Msgf("failed to get user %v: %v", recipientUserName, err)
+		h.respond(w, errorMessage{Error: ErrInternal.Error()}, http.StatusInternalServerError)
+		return
+	}
+	recipientId, ok := ids[recipientUserName]
+	if !ok {
+		h.respond(w, errorMessage{Error: repository.ErrNotExists.Error()}, http.StatusNotFound)
+		return
+	}
+	if recipientId == requesterId {
+		h.respond(w, errorMessage{Error: ErrAccessRequestToSelf.Error()}, http.StatusBadRequest)
+		return
+	}
+
+	request, err := h.repo.CreateAccessRequest(requesterId, recipientId)
+	if err != nil {
+		switch err {
+		case repository.ErrAccessAlreadyGranted, repository.ErrAccessRequestPending:
+			h.respond(w, errorMessage{Error: err.Error()}, http.StatusConflict)
+		case repository.ErrAccessRequestDenied, repository.ErrTooManyAccessRequests:
+			h.respond(w, errorMessage{Error: err.Error()}, http.StatusTooManyRequests)
+		default:
+			h.logger.Error().Msgf("failed to create access request of %v to %v: %v", senderUserName,
+				recipientUserName, err)
+			h.respond(w, errorMessage{Error: ErrInternal.Error()}, http.StatusInternalServerError)
+		}
+		return
+	}
+	request.Recipient = message.Recipient
+
+	h.respond(w, request, http.StatusCreated)
+}
+
+func (h *Handler) GetAccessRequest(w http.ResponseWriter, r *http.Request) {
+	requestId, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		h.respond(w, errorMessage{Error: "access request id must be a number"}, http.StatusBadRequest)
+		return
+	}
+
+	requesterId, _, ok := auth.User(r.Context())
+	if !ok {
+		h.respond(w, errorMessage{Error: auth.ErrMissingApiKey.Error()}, http.StatusUnauthorized)
+		return
+	}
+
+	// requests of other senders are reported as missing to not disclose their existence
+	request, err := h.repo.GetAccessRequest(requestId, requesterId)
+	if err != nil {
+		if err == repository.ErrAccessRequestNotExists {
+			h.respond(w, errorMessage{Error: err.Error()}, http.StatusNotFound)
+			return
+		}
+		h.logger.Error().Msgf("failed to get access request %v: %v", requestId, err)
+		h.respond(w, errorMessage{Error: ErrInternal.Error()}, http.StatusInternalServerError)
+		return
+	}
+
+	h.respond(w, request, http.StatusOK)
+}
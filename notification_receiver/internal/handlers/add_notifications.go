@@ -2,11 +2,19 @@ package addNotifications
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
+	"text/template"
+	"time"
 
+	"notification_receiver/internal/auth"
+	"notification_receiver/internal/formatting"
 	"notification_receiver/internal/model"
+	notificationPublisher "notification_receiver/internal/publisher"
+	"notification_receiver/internal/repository"
 
 	"github.com/rs/zerolog"
 )
@@ -16,48 +24,95 @@ type errorMessage struct {
 }
 
 type responseMessage struct {
-	Message       string   `json:"message"`
-	Authorized    []string `json:"authorizedUsers"`
-	NotAuthorized []string `json:"notAuthorizedUsers"`
+	Message        string     `json:"message"`
+	NotificationId int64      `json:"notificationId,omitempty"`
+	SendAt         *time.Time `json:"sendAt,omitempty"`
+	Authorized     []string   `json:"authorizedUsers"`
+	NotAuthorized  []string   `json:"notAuthorizedUsers"`
+	NoAccess       []string   `json:"noAccessUsers"`
+	Unpublished    []string   `json:"unpublishedUsers,omitempty"`
 }
 
 type repo interface {
-	GetUser(userName string) (int64, error)
+	GetNotificationAccess(usersId []int64, userIdWithAccess int64) (map[int64]bool, error)
+	CreateNotification(notification model.Notification, recipientsId []int64, sendAt *time.Time) (int64, error)
+	FailRecipients(notificationId int64, recipientsId []int64, reason string) error
+	GetNotificationStatus(notificationId int64) (model.NotificationStatus, error)
+	ListScheduledNotifications(senderId int64) ([]model.ScheduledNotification, error)
+	CancelScheduledNotification(notificationId int64, senderId int64) error
+	CreateRecurringNotification(recurring model.RecurringNotification) (int64, error)
+	ListRecurringNotifications(senderId int64) ([]model.RecurringNotification, error)
+	DeleteRecurringNotification(recurringId int64, senderId int64) error
+	SaveAttachment(attachment model.Attachment, data []byte) (int64, error)
+	CreateTemplate(messageTemplate model.MessageTemplate) (model.MessageTemplate, error)
+	GetTemplate(ownerId int64, name string) (model.MessageTemplate, error)
+	ListTemplates(ownerId int64) ([]model.MessageTemplate, error)
+	UpdateTemplate(messageTemplate model.MessageTemplate) (model.MessageTemplate, error)
+	DeleteTemplate(ownerId int64, name string) error
+	SetWebhook(ownerId int64, url string, secret string) error
+	GetWebhook(ownerId int64) (string, error)
+	DeleteWebhook(ownerId int64) error
+	ReserveIdempotencyKey(ownerId int64, key string, requestHash string, ttl time.Duration,
+		lease time.Duration) (*model.IdempotentResponse, error)
+	RenewIdempotencyKey(ownerId int64, key string, lease time.Duration) error
+	SaveIdempotentResponse(ownerId int64, key string, statusCode int, response []byte) error
+	ReleaseIdempotencyKey(ownerId int64, key string) error
+	CreateAccessRequest(requesterId int64, recipientId int64) (model.AccessRequest, error)
+	GetAccessRequest(requestId int64, requesterId int64) (model.AccessRequest, error)
+}
+
+// users resolves usernames to ids, it is either the repository or its cache
+type users interface {
+	GetUsers(userNames []string) (map[string]int64, error)
 }
 
 type publisher interface {
 	Publish(notification model.Notification) error
+	PublishBatch(notifications []model.Notification) []error
+	ListDeadLetters(limit int) ([]model.DeadLetter, error)
+	ReplayDeadLetters(limit int) ([]model.DeadLetter, error)
 }
 
 type Handler struct {
 	repo      repo
+	users     users
 	logger    zerolog.Logger
 	publisher publisher
 }
 
-func NewHandler(repo repo, logger zerolog.Logger, publisher publisher) *Handler {
+func NewHandler(repo repo, users users, logger zerolog.Logger, publisher publisher) *Handler {
 	l := logger.With().Str("component", "add_notification_handler").Logger()
 	return &Handler{
 		repo:      repo,
+		users:     users,
 		logger:    l,
 		publisher: publisher,
 	}
 }
 
 func (h *Handler) respond(w http.ResponseWriter, data interface{}, code int) {
-	w.WriteHeader(code)
 	if data != nil {
 		w.Header().Add("Content-Type", "application/json")
+	}
+	w.WriteHeader(code)
+	if data != nil {
 		if err := json.NewEncoder(w).Encode(data); err != nil {
 			h.logger.Error().Msgf("failed to write response: %v", err)
 		}
 	}
 }
 
+func publishErrorCode(err error) int {
+	if errors.Is(err, notificationPublisher.ErrUnavailable) {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
 func (h *Handler) AddNotification(w http.ResponseWriter, r *http.Request) {
-	h.logger.Info().Msgf("received a new notification: %s", r.Body)
+	h.logger.Info().Msg("received a new notification")
 	notification := model.Notification{}
-	err := json.NewDecoder(r.Body).Decode(&notification)
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestSize)).Decode(&notification)
 	if err != nil {
 		msg := fmt.Sprintf("failed to decode request %v: %v", r.Body, err)
 		h.logger.Error().Msgf(msg)
@@ -65,37 +120,287 @@ func (h *Handler) AddNotification(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// TODO check if users exist in bot database
-	// TODO check if sender has access to send notifications to recipients
+	senderId, senderUserName, ok := auth.User(r.Context())
+	if !ok {
+		h.respond(w, errorMessage{Error: auth.ErrMissingApiKey.Error()}, http.StatusUnauthorized)
+		return
+	}
+	notification.Sender = "@" + senderUserName
+	notification.SenderId = senderId
+
+	key := r.Header.Get(idempotencyKeyHeader)
+	if key == "" {
+		key = notification.DedupKey
+	}
+	notification.DedupKey = ""
+	if key == "" {
+		h.addNotification(w, notification)
+		return
+	}
+	h.idempotent(w, senderId, key, notification, func(w http.ResponseWriter) {
+		h.addNotification(w, notification)
+	})
+}
+
+func (h *Handler) addNotification(w http.ResponseWriter, notification model.Notification) {
+	pending, code, err := h.prepare(notification)
+	if err != nil {
+		h.respond(w, errorMessage{Error: err.Error()}, code)
+		return
+	}
+
+	pending.recipients, err = h.resolveRecipients(notification.SenderId, notification.RecipientsId)
+	if err != nil {
+		h.respond(w, errorMessage{Error: ErrInternal.Error()}, http.StatusInternalServerError)
+		return
+	}
+
+	if code, err := h.save(&pending); err != nil {
+		h.respond(w, errorMessage{Error: err.Error()}, code)
+		return
+	}
+
+	// scheduled notifications are published by the scheduler
+	if pending.notification.Id != 0 && pending.sendAt == nil {
+		err = h.publisher.Publish(pending.notification)
+		if err != nil && !h.failUnpublished(&pending, err) {
+			h.respond(w, errorMessage{Error: err.Error()}, publishErrorCode(err))
+			return
+		}
+	}
+
+	h.respond(w, pending.response(), http.StatusOK)
+}
+
+// pendingNotification is a valid notification which is not saved yet.
+type pendingNotification struct {
+	notification    model.Notification
+	sendAt          *time.Time
+	tmpl            *template.Template
+	attachmentsData [][]byte
+	recipients      resolvedRecipients
+	// unpublished are the recipients the notification is not published to, while it is to the others
+	unpublished []string
+}
 
-	var existingRecipientsId []string
-	var existingRecipientsUserName []string
-	var nonExistentRecipients []string
+// prepare validates the notification and returns the status code of the error if it is invalid.
+func (h *Handler) prepare(notification model.Notification) (pendingNotification, int, error) {
+	sendAt, err := parseSendAt(notification.SendAt, notification.Timezone)
+	if err != nil {
+		return pendingNotification{}, http.StatusBadRequest, err
+	}
+	notification.SendAt, notification.Timezone = "", ""
 
-	for _, recipient := range notification.RecipientsId {
-		id, err := h.repo.GetUser(recipient[1:])
+	var tmpl *template.Template
+	if notification.Template != "" {
+		tmpl, err = h.loadTemplate(&notification)
 		if err != nil {
-			nonExistentRecipients = append(nonExistentRecipients, recipient)
-			continue
+			switch err {
+			case ErrMessageAndTemplate, repository.ErrTemplateNotExists:
+				return pendingNotification{}, http.StatusBadRequest, err
+			default:
+				h.logger.Error().Msgf("failed to load template %v: %v", notification.Template, err)
+				return pendingNotification{}, http.StatusInternalServerError, ErrInternal
+			}
+		}
+	} else if notification.Message != "" || len(notification.Attachments) == 0 {
+		// the message is optional when there are attachments
+		if err := formatting.Validate(notification.Format, notification.Message); err != nil {
+			return pendingNotification{}, http.StatusBadRequest, err
+		}
+	}
+
+	attachmentsData, err := validateAttachments(notification.Attachments)
+	if err != nil {
+		return pendingNotification{}, http.StatusBadRequest, err
+	}
+
+	if len(notification.Buttons) > 0 {
+		// media groups can not have a keyboard, so it goes with the message
+		if notification.Message == "" {
+			return pendingNotification{}, http.StatusBadRequest, ErrButtonsWithoutMessage
+		}
+		if err := validateButtons(notification.Buttons); err != nil {
+			return pendingNotification{}, http.StatusBadRequest, err
 		}
-		existingRecipientsId = append(existingRecipientsId, strconv.FormatInt(id, 10))
-		existingRecipientsUserName = append(existingRecipientsUserName, recipient)
 	}
 
-	notification.RecipientsId = existingRecipientsId
+	return pendingNotification{
+		notification:    notification,
+		sendAt:          sendAt,
+		tmpl:            tmpl,
+		attachmentsData: attachmentsData,
+	}, http.StatusOK, nil
+}
 
-	err = h.publisher.Publish(notification)
+// save renders the messages of the notification for its resolved recipients and saves it with the attachments.
+// Notifications nobody can receive are not saved.
+func (h *Handler) save(pending *pendingNotification) (int, error) {
+	notification := &pending.notification
+	if pending.tmpl != nil {
+		messages, err := renderMessages(pending.tmpl, *notification, pending.recipients)
+		if err != nil {
+			return http.StatusBadRequest, fmt.Errorf("failed to render template: %v", err)
+		}
+		notification.RecipientMessages = messages
+		notification.Template, notification.Data = "", nil
+	}
+
+	if len(pending.recipients.ids) == 0 {
+		return http.StatusOK, nil
+	}
+
+	notification.RecipientsId = nil
+	for _, id := range pending.recipients.ids {
+		notification.RecipientsId = append(notification.RecipientsId, strconv.FormatInt(id, 10))
+	}
+
+	var err error
+	notification.Attachments, err = h.saveAttachments(notification.Attachments, pending.attachmentsData)
+	if err != nil {
+		h.logger.Error().Msgf("failed to save attachments: %v", err)
+		return http.StatusInternalServerError, ErrInternal
+	}
+
+	notification.Id, err = h.repo.CreateNotification(*notification, pending.recipients.ids, pending.sendAt)
+	if err != nil {
+		h.logger.Error().Msgf("failed to save notification: %v", err)
+		return http.StatusInternalServerError, ErrInternal
+	}
+	return http.StatusOK, nil
+}
+
+// failUnpublished marks the recipients the saved notification is not published to as failed, so they do not
+// stay queued. It returns true if the notification is published to the rest of the recipients, who must not
+// get it again, and keeps the usernames of the unpublished ones for the response.
+func (h *Handler) failUnpublished(pending *pendingNotification, err error) bool {
+	recipientsId := pending.notification.RecipientsId
+	var unpublished *notificationPublisher.UnpublishedError
+	if errors.As(err, &unpublished) {
+		recipientsId = unpublished.RecipientsId
+	}
+
+	failed := make(map[string]bool, len(recipientsId))
+	ids := make([]int64, 0, len(recipientsId))
+	for _, recipient := range recipientsId {
+		id, err := strconv.ParseInt(recipient, 10, 64)
+		if err != nil {
+			continue
+		}
+		failed[recipient] = true
+		ids = append(ids, id)
+	}
+	err = h.repo.FailRecipients(pending.notification.Id, ids, fmt.Sprintf("failed to publish notification: %v", err))
 	if err != nil {
-		h.respond(w, errorMessage{Error: err.Error()}, http.StatusInternalServerError)
+		h.logger.Error().Msgf("failed to mark unpublished recipients of notification %v as failed: %v",
+			pending.notification.Id, err)
+	}
+
+	if unpublished == nil || !unpublished.Partial {
+		return false
 	}
+	for i, id := range pending.recipients.ids {
+		if failed[strconv.FormatInt(id, 10)] {
+			pending.unpublished = append(pending.unpublished, pending.recipients.authorized[i])
+		}
+	}
+	return true
+}
 
+func (p pendingNotification) response() responseMessage {
 	var response responseMessage
-	response.Authorized = existingRecipientsUserName
-	response.NotAuthorized = nonExistentRecipients
-	if len(response.NotAuthorized) > 0 {
-		response.Message = "Some users are not authorized in the telegram bot"
-	} else {
+	response.NotificationId = p.notification.Id
+	response.SendAt = p.sendAt
+	response.Authorized = p.recipients.authorized
+	response.NotAuthorized = p.recipients.notAuthorized
+	response.NoAccess = p.recipients.noAccess
+	response.Unpublished = p.unpublished
+	switch {
+	case len(response.Unpublished) > 0:
+		response.Message = "Notifications are added to the queue only for some of the recipients, " +
+			"the unpublished users may not get them"
+	case len(response.Authorized) == 0:
+		response.Message = "None of the recipients can receive notifications from the sender"
+	case len(response.NotAuthorized) > 0 || len(response.NoAccess) > 0:
+		response.Message = "Some users are not authorized in the telegram bot or have not granted access to the sender"
+	case p.sendAt != nil:
+		response.Message = "Notifications successfully scheduled!"
+	default:
 		response.Message = "Notifications successfully added to the queue!"
 	}
-	h.respond(w, response, http.StatusOK)
+	return response
+}
+
+type resolvedRecipients struct {
+	ids           []int64
+	authorized    []string
+	notAuthorized []string
+	noAccess      []string
+}
+
+// resolveRecipients splits @usernames into the ones the sender can notify,
+// the ones not registered in the bot and the ones who have not granted access to the sender.
+func (h *Handler) resolveRecipients(senderId int64, userNames []string) (resolvedRecipients, error) {
+	found, err := h.lookupRecipients(senderId, userNames)
+	if err != nil {
+		return resolvedRecipients{}, err
+	}
+	return splitRecipients(userNames, found), nil
+}
+
+// lookupRecipients looks up the @usernames at once and returns the registered ones by username without @.
+func (h *Handler) lookupRecipients(senderId int64, userNames []string) (map[string]model.Recipient, error) {
+	trimmed := make([]string, 0, len(userNames))
+	for _, userName := range userNames {
+		trimmed = append(trimmed, strings.TrimPrefix(userName, "@"))
+	}
+
+	ids, err := h.users.GetUsers(trimmed)
+	if err != nil {
+		h.logger.Error().Msgf("failed to get recipients: %v", err)
+		return nil, err
+	}
+
+	usersId := make([]int64, 0, len(ids))
+	for _, id := range ids {
+		usersId = append(usersId, id)
+	}
+	access, err := h.repo.GetNotificationAccess(usersId, senderId)
+	if err != nil {
+		h.logger.Error().Msgf("failed to check access of %v to recipients: %v", senderId, err)
+		return nil, err
+	}
+
+	recipients := make(map[string]model.Recipient, len(ids))
+	for userName, id := range ids {
+		recipients[userName] = model.Recipient{Id: id, HasAccess: access[id]}
+	}
+	return recipients, nil
+}
+
+// splitRecipients splits @usernames into the ones the sender can notify,
+// the ones not registered in the bot and the ones who have not granted access to the sender.
+// A user named more than once, e.g. with and without @ or by an old username, is kept only by the first name.
+func splitRecipients(userNames []string, found map[string]model.Recipient) resolvedRecipients {
+	var recipients resolvedRecipients
+	seen := make(map[int64]bool, len(userNames))
+	for _, recipient := range userNames {
+		user, ok := found[strings.TrimPrefix(recipient, "@")]
+		if ok {
+			if seen[user.Id] {
+				continue
+			}
+			seen[user.Id] = true
+		}
+		switch {
+		case !ok:
+			recipients.notAuthorized = append(recipients.notAuthorized, recipient)
+		case !user.HasAccess:
+			recipients.noAccess = append(recipients.noAccess, recipient)
+		default:
+			recipients.ids = append(recipients.ids, user.Id)
+			recipients.authorized = append(recipients.authorized, recipient)
+		}
+	}
+	return recipients
 }
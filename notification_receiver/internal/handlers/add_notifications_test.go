@@ -0,0 +1,174 @@
+package addNotifications
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"notification_receiver/internal/auth"
+	"notification_receiver/internal/model"
+
+	"github.com/rs/zerolog"
+)
+
+const testSenderId = 1
+
+// fakeRepo keeps notifications in memory, the methods the tests do not need panic through the nil repo.
+type fakeRepo struct {
+	repo
+
+	mu            sync.Mutex
+	notifications map[int64][]int64
+	recurring     map[int64][]int64
+	lastId        int64
+	// notifications with the message fail to be saved
+	failMessage string
+}
+
+func newFakeRepo() *fakeRepo {
+	return &fakeRepo{
+		notifications: make(map[int64][]int64),
+		recurring:     make(map[int64][]int64),
+		failMessage:   "fail",
+	}
+}
+
+func (r *fakeRepo) GetNotificationAccess(usersId []int64, userIdWithAccess int64) (map[int64]bool, error) {
+	access := make(map[int64]bool, len(usersId))
+	for _, id := range usersId {
+		access[id] = true
+	}
+	return access, nil
+}
+
+// CreateNotification fails on repeated recipients like the primary key of notification_recipients does.
+func (r *fakeRepo) CreateNotification(notification model.Notification, recipientsId []int64, sendAt *time.Time) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := checkUnique(recipientsId); err != nil {
+		return 0, err
+	}
+	if notification.Message == r.failMessage {
+		return 0, errors.New("connection reset by peer")
+	}
+	r.lastId++
+	r.notifications[r.lastId] = recipientsId
+	return r.lastId, nil
+}
+
+// CreateRecurringNotification fails on repeated recipients like the primary key of
+// recurring_notification_recipients does.
+func (r *fakeRepo) CreateRecurringNotification(recurring model.RecurringNotification) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := checkUnique(recurring.RecipientsId); err != nil {
+		return 0, err
+	}
+	r.lastId++
+	r.recurring[r.lastId] = recurring.RecipientsId
+	return r.lastId, nil
+}
+
+func (r *fakeRepo) FailRecipients(notificationId int64, recipientsId []int64, reason string) error {
+	return nil
+}
+
+func checkUnique(recipientsId []int64) error {
+	seen := make(map[int64]bool, len(recipientsId))
+	for _, id := range recipientsId {
+		if seen[id] {
+			return errors.New("duplicate key value violates unique constraint")
+		}
+		seen[id] = true
+	}
+	return nil
+}
+
+// fakeUsers resolves usernames, alice_old is the username alice had before.
+type fakeUsers map[string]int64
+
+func (u fakeUsers) GetUsers(userNames []string) (map[string]int64, error) {
+	users := make(map[string]int64, len(userNames))
+	for _, userName := range userNames {
+		if id, ok := u[userName]; ok {
+			users[userName] = id
+		}
+	}
+	return users, nil
+}
+
+type fakePublisher struct {
+	publisher
+
+	published []model.Notification
+}
+
+func (p *fakePublisher) Publish(notification model.Notification) error {
+	p.published = append(p.published, notification)
+	return nil
+}
+
+func (p *fakePublisher) PublishBatch(notifications []model.Notification) []error {
+	p.published = append(p.published, notifications...)
+	return make([]error, len(notifications))
+}
+
+type fakeKeys struct{}
+
+func (fakeKeys) GetApiKeyOwner(keyHash string) (int64, string, error) {
+	return testSenderId, "sender", nil
+}
+
+func newTestHandler() (*Handler, *fakeRepo, *fakePublisher) {
+	repo := newFakeRepo()
+	users := fakeUsers{"alice": 2, "alice_old": 2, "bob": 3}
+	publisher := &fakePublisher{}
+	return NewHandler(repo, users, zerolog.Nop(), publisher), repo, publisher
+}
+
+// serve makes the authenticated request to the handler and decodes its response.
+func serve(t *testing.T, handler http.HandlerFunc, body interface{}, response interface{}) int {
+	data, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(data))
+	r.Header.Set("X-Api-Key", "key")
+	w := httptest.NewRecorder()
+
+	auth.NewMiddleware(fakeKeys{}, zerolog.Nop(), nil).Authenticate(handler).ServeHTTP(w, r)
+
+	if err := json.NewDecoder(w.Body).Decode(response); err != nil {
+		t.Fatalf("failed to decode response %v: %v", w.Code, err)
+	}
+	return w.Code
+}
+
+func TestAddNotificationRepeatedRecipient(t *testing.T) {
+	h, repo, publisher := newTestHandler()
+
+	var response responseMessage
+	code := serve(t, h.AddNotification, model.Notification{
+		RecipientsId: []string{"@alice", "alice", "@alice_old", "@bob", "@alice"},
+		Message:      "hello",
+	}, &response)
+
+	if code != http.StatusOK {
+		t.Fatalf("status is %v with %q, want 200", code, response.Message)
+	}
+	if recipients := repo.notifications[response.NotificationId]; len(recipients) != 2 ||
+		recipients[0] != 2 || recipients[1] != 3 {
+		t.Errorf("notification is saved for %v, want [2 3]", recipients)
+	}
+	if len(response.Authorized) != 2 || response.Authorized[0] != "@alice" || response.Authorized[1] != "@bob" {
+		t.Errorf("authorized users are %v, want [@alice @bob]", response.Authorized)
+	}
+	if len(publisher.published) != 1 || len(publisher.published[0].RecipientsId) != 2 {
+		t.Errorf("published %v, want one notification to 2 recipients", publisher.published)
+	}
+}
@@ -0,0 +1,105 @@
+package addNotifications
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"notification_receiver/internal/model"
+)
+
+const (
+	// telegram allows up to 10 items in a media group
+	maxAttachments = 10
+
+	maxPhotoSize    = 10 << 20
+	maxDocumentSize = 50 << 20
+
+	// request body limit of single and batch requests. It fits one document of the largest size as base64,
+	// which makes it a third larger, more files have to be sent by url or file_id.
+	maxRequestSize = maxDocumentSize*4/3 + 1<<20
+)
+
+var photoContentTypes = map[string]struct{}{
+	"image/jpeg": {},
+	"image/png":  {},
+	"image/webp": {},
+}
+
+// validateAttachments checks the attachments and returns their decoded data.
+func validateAttachments(attachments []model.Attachment) ([][]byte, error) {
+	if len(attachments) > maxAttachments {
+		return nil, fmt.Errorf("%w: at most %v attachments are allowed", ErrInvalidAttachment, maxAttachments)
+	}
+
+	data := make([][]byte, len(attachments))
+	for i, attachment := range attachments {
+		if attachment.Type != attachments[0].Type {
+			return nil, fmt.Errorf("%w: photos and documents can not be sent together", ErrInvalidAttachment)
+		}
+
+		sources := 0
+		for _, source := range []string{attachment.Url, attachment.Data, attachment.FileId} {
+			if source != "" {
+				sources++
+			}
+		}
+		if sources != 1 {
+			return nil, fmt.Errorf("%w: exactly one of url, data and file_id must be specified", ErrInvalidAttachment)
+		}
+
+		maxSize := maxDocumentSize
+		switch attachment.Type {
+		case model.AttachmentPhoto:
+			maxSize = maxPhotoSize
+		case model.AttachmentDocument:
+		default:
+			return nil, fmt.Errorf("%w: type must be photo or document", ErrInvalidAttachment)
+		}
+
+		switch {
+		case attachment.Url != "":
+			u, err := url.Parse(attachment.Url)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return nil, fmt.Errorf("%w: url must be an http or https url", ErrInvalidAttachment)
+			}
+		case attachment.Data != "":
+			if base64.StdEncoding.DecodedLen(len(attachment.Data)) > maxSize+2 {
+				return nil, fmt.Errorf("%w: %v must not exceed %v MB", ErrInvalidAttachment, attachment.Type, maxSize>>20)
+			}
+			decoded, err := base64.StdEncoding.DecodeString(attachment.Data)
+			if err != nil {
+				return nil, fmt.Errorf("%w: data must be base64 encoded", ErrInvalidAttachment)
+			}
+			if len(decoded) > maxSize {
+				return nil, fmt.Errorf("%w: %v must not exceed %v MB", ErrInvalidAttachment, attachment.Type, maxSize>>20)
+			}
+			if attachment.Type == model.AttachmentPhoto {
+				if _, ok := photoContentTypes[http.DetectContentType(decoded)]; !ok {
+					return nil, fmt.Errorf("%w: photo must be jpeg, png or webp", ErrInvalidAttachment)
+				}
+			}
+			data[i] = decoded
+		}
+	}
+	return data, nil
+}
+
+// saveAttachments saves the attachments and returns them as they are published to the queue.
+func (h *Handler) saveAttachments(attachments []model.Attachment, data [][]byte) ([]model.Attachment, error) {
+	saved := make([]model.Attachment, 0, len(attachments))
+	for i, attachment := range attachments {
+		id, err := h.repo.SaveAttachment(attachment, data[i])
+		if err != nil {
+			return nil, err
+		}
+		saved = append(saved, model.Attachment{
+			Id:       id,
+			Type:     attachment.Type,
+			FileId:   attachment.FileId,
+			FileName: attachment.FileName,
+		})
+	}
+	return saved, nil
+}
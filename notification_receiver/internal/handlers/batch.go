@@ -0,0 +1,126 @@
+package addNotifications
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"notification_receiver/internal/auth"
+	"notification_receiver/internal/model"
+)
+
+const maxBatchSize = 100
+
+type batchItemResult struct {
+	Index  int `json:"index"`
+	Status int `json:"status"`
+	// Error is set for rejected notifications, the rest of the fields for accepted ones
+	Error string `json:"errorMessage,omitempty"`
+	*responseMessage
+}
+
+type batchResponseMessage struct {
+	Accepted int               `json:"accepted"`
+	Rejected int               `json:"rejected"`
+	Results  []batchItemResult `json:"results"`
+}
+
+// AddNotificationsBatch accepts an array of notifications and handles every one of them like AddNotification.
+// Invalid notifications are rejected without affecting the others, results are in the order of the request.
+func (h *Handler) AddNotificationsBatch(w http.ResponseWriter, r *http.Request) {
+	var notifications []model.Notification
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestSize)).Decode(&notifications)
+	if err != nil {
+		h.respond(w, errorMessage{Error: fmt.Sprintf("failed to decode request: %v", err)}, http.StatusBadRequest)
+		return
+	}
+	if len(notifications) == 0 || len(notifications) > maxBatchSize {
+		h.respond(w, errorMessage{Error: ErrInvalidBatchSize.Error()}, http.StatusBadRequest)
+		return
+	}
+
+	senderId, senderUserName, ok := auth.User(r.Context())
+	if !ok {
+		h.respond(w, errorMessage{Error: auth.ErrMissingApiKey.Error()}, http.StatusUnauthorized)
+		return
+	}
+	for i := range notifications {
+		notifications[i].Sender = "@" + senderUserName
+		notifications[i].SenderId = senderId
+		notifications[i].DedupKey = ""
+	}
+
+	key := r.Header.Get(idempotencyKeyHeader)
+	if key == "" {
+		h.addNotificationsBatch(w, notifications, senderId)
+		return
+	}
+	h.idempotent(w, senderId, key, notifications, func(w http.ResponseWriter) {
+		h.addNotificationsBatch(w, notifications, senderId)
+	})
+}
+
+func (h *Handler) addNotificationsBatch(w http.ResponseWriter, notifications []model.Notification, senderId int64) {
+	results := make([]batchItemResult, len(notifications))
+	pending := make([]pendingNotification, len(notifications))
+	var userNames []string
+	for i, notification := range notifications {
+		results[i] = batchItemResult{Index: i, Status: http.StatusOK}
+
+		var err error
+		pending[i], results[i].Status, err = h.prepare(notification)
+		if err != nil {
+			results[i].Error = err.Error()
+			continue
+		}
+		userNames = append(userNames, notification.RecipientsId...)
+	}
+
+	// recipients of all notifications are looked up at once
+	recipients, err := h.lookupRecipients(senderId, userNames)
+	if err != nil {
+		h.respond(w, errorMessage{Error: ErrInternal.Error()}, http.StatusInternalServerError)
+		return
+	}
+
+	var published []int
+	for i := range pending {
+		if results[i].Error != "" {
+			continue
+		}
+
+		pending[i].recipients = splitRecipients(notifications[i].RecipientsId, recipients)
+		if code, err := h.save(&pending[i]); err != nil {
+			results[i].Status, results[i].Error = code, err.Error()
+			continue
+		}
+
+		// scheduled notifications are published by the scheduler
+		if pending[i].notification.Id != 0 && pending[i].sendAt == nil {
+			published = append(published, i)
+		}
+	}
+
+	toPublish := make([]model.Notification, len(published))
+	for j, i := range published {
+		toPublish[j] = pending[i].notification
+	}
+	for j, err := range h.publisher.PublishBatch(toPublish) {
+		i := published[j]
+		if err != nil && !h.failUnpublished(&pending[i], err) {
+			results[i].Status, results[i].Error = publishErrorCode(err), err.Error()
+		}
+	}
+
+	response := batchResponseMessage{Results: results}
+	for i := range results {
+		if results[i].Error != "" {
+			response.Rejected++
+			continue
+		}
+		response.Accepted++
+		itemResponse := pending[i].response()
+		results[i].responseMessage = &itemResponse
+	}
+	h.respond(w, response, http.StatusOK)
+}
@@ -0,0 +1,48 @@
+package addNotifications
+
+import (
+	"net/http"
+	"testing"
+
+	"notification_receiver/internal/model"
+)
+
+// batchResponse is the decoded batchResponseMessage, whose items embed an unexported pointer
+type batchResponse struct {
+	Accepted int `json:"accepted"`
+	Rejected int `json:"rejected"`
+	Results  []struct {
+		Status         int   `json:"status"`
+		NotificationId int64 `json:"notificationId"`
+	} `json:"results"`
+}
+
+func TestAddNotificationsBatchRejectsOnlyBadItems(t *testing.T) {
+	h, repo, publisher := newTestHandler()
+
+	var response batchResponse
+	code := serve(t, h.AddNotificationsBatch, []model.Notification{
+		{RecipientsId: []string{"@alice", "alice", "@alice_old"}, Message: "repeated recipient"},
+		{RecipientsId: []string{"@bob"}},
+		{RecipientsId: []string{"@bob"}, Message: "fail"},
+		{RecipientsId: []string{"@bob", "@alice"}, Message: "hello"},
+	}, &response)
+
+	if code != http.StatusOK {
+		t.Fatalf("status is %v, want 200", code)
+	}
+	if response.Accepted != 2 || response.Rejected != 2 {
+		t.Errorf("accepted %v and rejected %v, want 2 and 2", response.Accepted, response.Rejected)
+	}
+	for i, want := range []int{http.StatusOK, http.StatusBadRequest, http.StatusInternalServerError, http.StatusOK} {
+		if response.Results[i].Status != want {
+			t.Errorf("item %v has status %v, want %v", i, response.Results[i].Status, want)
+		}
+	}
+	if recipients := repo.notifications[response.Results[0].NotificationId]; len(recipients) != 1 || recipients[0] != 2 {
+		t.Errorf("notification with a repeated recipient is saved for %v, want [2]", recipients)
+	}
+	if len(publisher.published) != 2 {
+		t.Errorf("published %v notifications, want 2", len(publisher.published))
+	}
+}
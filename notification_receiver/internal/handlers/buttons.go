@@ -0,0 +1,50 @@
+package addNotifications
+
+import (
+	"fmt"
+	"net/url"
+
+	"notification_receiver/internal/model"
+)
+
+const (
+	// telegram limits of inline keyboards
+	maxButtonsInRow = 8
+	maxButtons      = 100
+
+	// callback data is "notificationId:action" of at most 64 bytes
+	maxActionLength = 32
+)
+
+// validateButtons checks that the buttons form a valid inline keyboard.
+func validateButtons(buttons [][]model.Button) error {
+	count := 0
+	for _, row := range buttons {
+		if len(row) == 0 || len(row) > maxButtonsInRow {
+			return fmt.Errorf("%w: a row must have from 1 to %v buttons", ErrInvalidButtons, maxButtonsInRow)
+		}
+		count += len(row)
+		if count > maxButtons {
+			return fmt.Errorf("%w: at most %v buttons are allowed", ErrInvalidButtons, maxButtons)
+		}
+
+		for _, button := range row {
+			if button.Text == "" {
+				return fmt.Errorf("%w: text must not be empty", ErrInvalidButtons)
+			}
+			if (button.Url == "") == (button.Action == "") {
+				return fmt.Errorf("%w: exactly one of url and action must be specified", ErrInvalidButtons)
+			}
+			if button.Url != "" {
+				u, err := url.Parse(button.Url)
+				if err != nil || (u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "tg") {
+					return fmt.Errorf("%w: url must be an http, https or tg url", ErrInvalidButtons)
+				}
+			}
+			if len(button.Action) > maxActionLength {
+				return fmt.Errorf("%w: action must not exceed %v bytes", ErrInvalidButtons, maxActionLength)
+			}
+		}
+	}
+	return nil
+}
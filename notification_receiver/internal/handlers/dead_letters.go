@@ -0,0 +1,60 @@
+package addNotifications
+
+import (
+	"net/http"
+	"strconv"
+)
+
+const (
+	defaultDeadLettersLimit = 20
+	maxDeadLettersLimit     = 1000
+)
+
+type replayResponse struct {
+	Replayed int `json:"replayed"`
+}
+
+func (h *Handler) ListDeadLetters(w http.ResponseWriter, r *http.Request) {
+	limit, err := parseLimit(r)
+	if err != nil {
+		h.respond(w, errorMessage{Error: err.Error()}, http.StatusBadRequest)
+		return
+	}
+
+	deadLetters, err := h.publisher.ListDeadLetters(limit)
+	if err != nil {
+		h.respond(w, errorMessage{Error: err.Error()}, publishErrorCode(err))
+		return
+	}
+	h.respond(w, deadLetters, http.StatusOK)
+}
+
+func (h *Handler) ReplayDeadLetters(w http.ResponseWriter, r *http.Request) {
+	limit, err := parseLimit(r)
+	if err != nil {
+		h.respond(w, errorMessage{Error: err.Error()}, http.StatusBadRequest)
+		return
+	}
+
+	replayed, err := h.publisher.ReplayDeadLetters(limit)
+	if err != nil {
+		h.logger.Error().Msgf("replay of dead letters stopped after %v messages: %v", len(replayed), err)
+		h.respond(w, errorMessage{Error: err.Error()}, publishErrorCode(err))
+		return
+	}
+	h.logger.Info().Msgf("replayed %v dead letters", len(replayed))
+	h.respond(w, replayResponse{Replayed: len(replayed)}, http.StatusOK)
+}
+
+func parseLimit(r *http.Request) (int, error) {
+	value := r.URL.Query().Get("limit")
+	if value == "" {
+		return defaultDeadLettersLimit, nil
+	}
+
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit <= 0 || limit > maxDeadLettersLimit {
+		return 0, ErrInvalidLimit
+	}
+	return limit, nil
+}
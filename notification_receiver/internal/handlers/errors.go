@@ -0,0 +1,25 @@
+package addNotifications
+
+import "errors"
+
+var (
+	ErrInternal     = errors.New("internal error while processing notification")
+	ErrInvalidLimit = errors.New("limit must be a number from 1 to 1000")
+
+	ErrInvalidSendAt     = errors.New("send_at must be a time in RFC3339 format")
+	ErrSendAtInPast      = errors.New("send_at must not be in the past")
+	ErrInvalidAttachment = errors.New("invalid attachment")
+	ErrInvalidTimezone   = errors.New("timezone must be an IANA time zone name, e.g. Europe/Moscow")
+
+	ErrInvalidTemplateName = errors.New("template name must be non-empty, at most 64 characters long and without spaces or slashes")
+	ErrMessageAndTemplate  = errors.New("either message or template must be given, not both")
+
+	ErrInvalidButtons        = errors.New("invalid buttons")
+	ErrButtonsWithoutMessage = errors.New("notifications with buttons must have a message")
+	ErrInvalidBatchSize      = errors.New("batch must have from 1 to 100 notifications")
+	ErrInvalidIdempotencyKey = errors.New("idempotency key must not exceed 255 characters")
+	ErrInvalidWebhook        = errors.New("webhook url must be an http or https url")
+
+	ErrInvalidRecipient    = errors.New("recipient must be a @username")
+	ErrAccessRequestToSelf = errors.New("senders do not need access to notify themselves")
+)
@@ -0,0 +1,121 @@
+package addNotifications
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"notification_receiver/internal/repository"
+)
+
+const (
+	idempotencyKeyHeader   = "Idempotency-Key"
+	idempotentReplayHeader = "Idempotent-Replayed"
+
+	// how long responses are kept for repeated requests
+	idempotencyKeyTTL = 24 * time.Hour
+	// how long a request holds its key unless it is renewed, which is done every idempotencyKeyRenewal
+	// while the request is handled; keys of requests which are not handled anymore, e.g. because the receiver
+	// crashed, are taken over by the next one once the lease is over
+	idempotencyKeyLease   = time.Minute
+	idempotencyKeyRenewal = idempotencyKeyLease / 3
+
+	maxIdempotencyKeyLength = 255
+)
+
+// responseRecorder keeps the response to save it for repeated requests.
+type responseRecorder struct {
+	http.ResponseWriter
+	code int
+	body bytes.Buffer
+}
+
+func (r *responseRecorder) WriteHeader(code int) {
+	r.code = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+// idempotent handles the request once for the key of the sender. Repeated requests with the key get the
+// saved response until it expires, requests with the key and another body are rejected.
+// Responses with server errors are not saved, so the request can be retried.
+func (h *Handler) idempotent(w http.ResponseWriter, ownerId int64, key string, request interface{}, handle func(w http.ResponseWriter)) {
+	if len(key) > maxIdempotencyKeyLength {
+		h.respond(w, errorMessage{Error: ErrInvalidIdempotencyKey.Error()}, http.StatusBadRequest)
+		return
+	}
+
+	encoded, err := json.Marshal(request)
+	if err != nil {
+		h.logger.Error().Msgf("failed to encode request: %v", err)
+		h.respond(w, errorMessage{Error: ErrInternal.Error()}, http.StatusInternalServerError)
+		return
+	}
+	hash := sha256.Sum256(encoded)
+	requestHash := hex.EncodeToString(hash[:])
+
+	saved, err := h.repo.ReserveIdempotencyKey(ownerId, key, requestHash, idempotencyKeyTTL, idempotencyKeyLease)
+	if err != nil {
+		switch err {
+		case repository.ErrIdempotencyKeyInProgress:
+			h.respond(w, errorMessage{Error: err.Error()}, http.StatusConflict)
+		case repository.ErrIdempotencyKeyReused:
+			h.respond(w, errorMessage{Error: err.Error()}, http.StatusUnprocessableEntity)
+		default:
+			h.logger.Error().Msgf("failed to reserve idempotency key %v: %v", key, err)
+			h.respond(w, errorMessage{Error: ErrInternal.Error()}, http.StatusInternalServerError)
+		}
+		return
+	}
+	if saved != nil {
+		h.logger.Info().Msgf("replaying response for idempotency key %v", key)
+		w.Header().Set(idempotentReplayHeader, "true")
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(saved.StatusCode)
+		if _, err := w.Write(saved.Body); err != nil {
+			h.logger.Error().Msgf("failed to write response: %v", err)
+		}
+		return
+	}
+
+	// batches may take longer than the lease to publish
+	handled := make(chan struct{})
+	go h.renewIdempotencyKey(ownerId, key, handled)
+
+	recorder := &responseRecorder{ResponseWriter: w, code: http.StatusOK}
+	handle(recorder)
+	close(handled)
+
+	if recorder.code >= http.StatusInternalServerError {
+		err = h.repo.ReleaseIdempotencyKey(ownerId, key)
+	} else {
+		err = h.repo.SaveIdempotentResponse(ownerId, key, recorder.code, recorder.body.Bytes())
+	}
+	if err != nil {
+		h.logger.Error().Msgf("failed to save response for idempotency key %v: %v", key, err)
+	}
+}
+
+// renewIdempotencyKey renews the lease of the key until the request is handled.
+func (h *Handler) renewIdempotencyKey(ownerId int64, key string, handled <-chan struct{}) {
+	ticker := time.NewTicker(idempotencyKeyRenewal)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-handled:
+			return
+		case <-ticker.C:
+			if err := h.repo.RenewIdempotencyKey(ownerId, key, idempotencyKeyLease); err != nil {
+				h.logger.Error().Msgf("failed to renew idempotency key %v: %v", key, err)
+			}
+		}
+	}
+}
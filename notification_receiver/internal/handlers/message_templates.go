@@ -0,0 +1,195 @@
+package addNotifications
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"notification_receiver/internal/auth"
+	"notification_receiver/internal/model"
+	"notification_receiver/internal/repository"
+	"notification_receiver/internal/templates"
+
+	"github.com/gorilla/mux"
+)
+
+const maxTemplateNameLength = 64
+
+func (h *Handler) CreateTemplate(w http.ResponseWriter, r *http.Request) {
+	messageTemplate, ok := h.decodeTemplate(w, r)
+	if !ok {
+		return
+	}
+
+	messageTemplate, err := h.repo.CreateTemplate(messageTemplate)
+	if err != nil {
+		if err == repository.ErrTemplateAlreadyExists {
+			h.respond(w, errorMessage{Error: err.Error()}, http.StatusConflict)
+			return
+		}
+		h.logger.Error().Msgf("failed to save template %v: %v", messageTemplate.Name, err)
+		h.respond(w, errorMessage{Error: ErrInternal.Error()}, http.StatusInternalServerError)
+		return
+	}
+	h.respond(w, messageTemplate, http.StatusOK)
+}
+
+func (h *Handler) UpdateTemplate(w http.ResponseWriter, r *http.Request) {
+	messageTemplate, ok := h.decodeTemplate(w, r)
+	if !ok {
+		return
+	}
+
+	messageTemplate, err := h.repo.UpdateTemplate(messageTemplate)
+	if err != nil {
+		if err == repository.ErrTemplateNotExists {
+			h.respond(w, errorMessage{Error: err.Error()}, http.StatusNotFound)
+			return
+		}
+		h.logger.Error().Msgf("failed to update template %v: %v", messageTemplate.Name, err)
+		h.respond(w, errorMessage{Error: ErrInternal.Error()}, http.StatusInternalServerError)
+		return
+	}
+	h.respond(w, messageTemplate, http.StatusOK)
+}
+
+// decodeTemplate decodes and checks the template of the request, the name is taken from the path if it is there.
+func (h *Handler) decodeTemplate(w http.ResponseWriter, r *http.Request) (model.MessageTemplate, bool) {
+	messageTemplate := model.MessageTemplate{}
+	if err := json.NewDecoder(r.Body).Decode(&messageTemplate); err != nil {
+		h.respond(w, errorMessage{Error: fmt.Sprintf("failed to decode request: %v", err)}, http.StatusBadRequest)
+		return messageTemplate, false
+	}
+
+	senderId, _, ok := auth.User(r.Context())
+	if !ok {
+		h.respond(w, errorMessage{Error: auth.ErrMissingApiKey.Error()}, http.StatusUnauthorized)
+		return messageTemplate, false
+	}
+	messageTemplate.OwnerId = senderId
+
+	if name, ok := mux.Vars(r)["name"]; ok {
+		messageTemplate.Name = name
+	}
+	if messageTemplate.Name == "" || len(messageTemplate.Name) > maxTemplateNameLength ||
+		strings.ContainsAny(messageTemplate.Name, "/ ") {
+		h.respond(w, errorMessage{Error: ErrInvalidTemplateName.Error()}, http.StatusBadRequest)
+		return messageTemplate, false
+	}
+
+	if strings.TrimSpace(messageTemplate.Body) == "" {
+		h.respond(w, errorMessage{Error: "template body must not be empty"}, http.StatusBadRequest)
+		return messageTemplate, false
+	}
+	if _, err := templates.Parse(messageTemplate.Body, messageTemplate.Format); err != nil {
+		h.respond(w, errorMessage{Error: fmt.Sprintf("invalid message template: %v", err)}, http.StatusBadRequest)
+		return messageTemplate, false
+	}
+	return messageTemplate, true
+}
+
+func (h *Handler) ListTemplates(w http.ResponseWriter, r *http.Request) {
+	senderId, senderUserName, ok := auth.User(r.Context())
+	if !ok {
+		h.respond(w, errorMessage{Error: auth.ErrMissingApiKey.Error()}, http.StatusUnauthorized)
+		return
+	}
+
+	messageTemplates, err := h.repo.ListTemplates(senderId)
+	if err != nil {
+		h.logger.Error().Msgf("failed to list templates of %v: %v", senderUserName, err)
+		h.respond(w, errorMessage{Error: ErrInternal.Error()}, http.StatusInternalServerError)
+		return
+	}
+	h.respond(w, messageTemplates, http.StatusOK)
+}
+
+func (h *Handler) GetTemplate(w http.ResponseWriter, r *http.Request) {
+	senderId, _, ok := auth.User(r.Context())
+	if !ok {
+		h.respond(w, errorMessage{Error: auth.ErrMissingApiKey.Error()}, http.StatusUnauthorized)
+		return
+	}
+
+	name := mux.Vars(r)["name"]
+	messageTemplate, err := h.repo.GetTemplate(senderId, name)
+	if err != nil {
+		if err == repository.ErrTemplateNotExists {
+			h.respond(w, errorMessage{Error: err.Error()}, http.StatusNotFound)
+			return
+		}
+		h.logger.Error().Msgf("failed to get template %v: %v", name, err)
+		h.respond(w, errorMessage{Error: ErrInternal.Error()}, http.StatusInternalServerError)
+		return
+	}
+	h.respond(w, messageTemplate, http.StatusOK)
+}
+
+func (h *Handler) DeleteTemplate(w http.ResponseWriter, r *http.Request) {
+	senderId, _, ok := auth.User(r.Context())
+	if !ok {
+		h.respond(w, errorMessage{Error: auth.ErrMissingApiKey.Error()}, http.StatusUnauthorized)
+		return
+	}
+
+	name := mux.Vars(r)["name"]
+	err := h.repo.DeleteTemplate(senderId, name)
+	if err != nil {
+		if err == repository.ErrTemplateNotExists {
+			h.respond(w, errorMessage{Error: err.Error()}, http.StatusNotFound)
+			return
+		}
+		h.logger.Error().Msgf("failed to delete template %v: %v", name, err)
+		h.respond(w, errorMessage{Error: ErrInternal.Error()}, http.StatusInternalServerError)
+		return
+	}
+	h.respond(w, nil, http.StatusNoContent)
+}
+
+// loadTemplate returns the parsed template of the notification and sets the message and the format
+// of the notification from it.
+func (h *Handler) loadTemplate(notification *model.Notification) (*template.Template, error) {
+	if notification.Message != "" {
+		return nil, ErrMessageAndTemplate
+	}
+
+	messageTemplate, err := h.repo.GetTemplate(notification.SenderId, notification.Template)
+	if err != nil {
+		return nil, err
+	}
+	notification.Message, notification.Format = messageTemplate.Body, messageTemplate.Format
+
+	return templates.Parse(messageTemplate.Body, messageTemplate.Format)
+}
+
+// renderMessages renders the template for every recipient. Without recipients it is rendered
+// for an empty one anyway, so missing values are reported regardless of the recipients.
+func renderMessages(tmpl *template.Template, notification model.Notification, recipients resolvedRecipients) (map[string]string, error) {
+	if len(recipients.ids) == 0 {
+		_, err := templates.Render(tmpl, notification.Format, templates.Data{
+			Sender: notification.Sender,
+			Data:   notification.Data,
+		})
+		return nil, err
+	}
+
+	messages := make(map[string]string, len(recipients.ids))
+	for i, id := range recipients.ids {
+		message, err := templates.Render(tmpl, notification.Format, templates.Data{
+			Recipient: templates.Recipient{
+				Id:       id,
+				Username: strings.TrimPrefix(recipients.authorized[i], "@"),
+			},
+			Sender: notification.Sender,
+			Data:   notification.Data,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", recipients.authorized[i], err)
+		}
+		messages[strconv.FormatInt(id, 10)] = message
+	}
+	return messages, nil
+}
@@ -0,0 +1,44 @@
+package addNotifications
+
+import (
+	"net/http"
+	"strconv"
+
+	"notification_receiver/internal/auth"
+	"notification_receiver/internal/repository"
+
+	"github.com/gorilla/mux"
+)
+
+func (h *Handler) GetNotificationStatus(w http.ResponseWriter, r *http.Request) {
+	notificationId, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		h.respond(w, errorMessage{Error: "notification id must be a number"}, http.StatusBadRequest)
+		return
+	}
+
+	senderId, _, ok := auth.User(r.Context())
+	if !ok {
+		h.respond(w, errorMessage{Error: auth.ErrMissingApiKey.Error()}, http.StatusUnauthorized)
+		return
+	}
+
+	status, err := h.repo.GetNotificationStatus(notificationId)
+	if err != nil {
+		if err == repository.ErrNotificationNotExists {
+			h.respond(w, errorMessage{Error: err.Error()}, http.StatusNotFound)
+			return
+		}
+		h.logger.Error().Msgf("failed to get status of notification %v: %v", notificationId, err)
+		h.respond(w, errorMessage{Error: ErrInternal.Error()}, http.StatusInternalServerError)
+		return
+	}
+
+	// notifications of other senders are reported as missing to not disclose their existence
+	if status.SenderId != senderId {
+		h.respond(w, errorMessage{Error: repository.ErrNotificationNotExists.Error()}, http.StatusNotFound)
+		return
+	}
+
+	h.respond(w, status, http.StatusOK)
+}
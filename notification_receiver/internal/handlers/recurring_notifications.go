@@ -0,0 +1,138 @@
+package addNotifications
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"notification_receiver/internal/auth"
+	"notification_receiver/internal/formatting"
+	"notification_receiver/internal/model"
+	"notification_receiver/internal/repository"
+	"notification_receiver/internal/scheduler"
+
+	"github.com/gorilla/mux"
+)
+
+type recurringResponseMessage struct {
+	Message       string     `json:"message"`
+	Id            int64      `json:"id,omitempty"`
+	NextRunAt     *time.Time `json:"nextRunAt,omitempty"`
+	Authorized    []string   `json:"authorizedUsers"`
+	NotAuthorized []string   `json:"notAuthorizedUsers"`
+	NoAccess      []string   `json:"noAccessUsers"`
+}
+
+func (h *Handler) CreateRecurringNotification(w http.ResponseWriter, r *http.Request) {
+	recurring := model.RecurringNotification{}
+	err := json.NewDecoder(r.Body).Decode(&recurring)
+	if err != nil {
+		h.respond(w, errorMessage{Error: fmt.Sprintf("failed to decode request: %v", err)}, http.StatusBadRequest)
+		return
+	}
+
+	senderId, senderUserName, ok := auth.User(r.Context())
+	if !ok {
+		h.respond(w, errorMessage{Error: auth.ErrMissingApiKey.Error()}, http.StatusUnauthorized)
+		return
+	}
+	recurring.Sender = "@" + senderUserName
+	recurring.SenderId = senderId
+
+	if recurring.Timezone == "" {
+		recurring.Timezone = "UTC"
+	}
+	if _, err := time.LoadLocation(recurring.Timezone); err != nil {
+		h.respond(w, errorMessage{Error: ErrInvalidTimezone.Error()}, http.StatusBadRequest)
+		return
+	}
+
+	recurring.NextRunAt, err = scheduler.NextRun(recurring.Cron, recurring.Timezone, time.Now())
+	if err != nil {
+		h.respond(w, errorMessage{Error: fmt.Sprintf("invalid cron expression: %v", err)}, http.StatusBadRequest)
+		return
+	}
+
+	message, err := scheduler.RenderMessage(recurring.Message, recurring.Format, recurring.NextRunAt)
+	if err != nil {
+		h.respond(w, errorMessage{Error: fmt.Sprintf("invalid message template: %v", err)}, http.StatusBadRequest)
+		return
+	}
+	if err := formatting.Validate(recurring.Format, message); err != nil {
+		h.respond(w, errorMessage{Error: err.Error()}, http.StatusBadRequest)
+		return
+	}
+
+	recipients, err := h.resolveRecipients(senderId, recurring.Recipients)
+	if err != nil {
+		h.respond(w, errorMessage{Error: ErrInternal.Error()}, http.StatusInternalServerError)
+		return
+	}
+
+	response := recurringResponseMessage{
+		Authorized:    recipients.authorized,
+		NotAuthorized: recipients.notAuthorized,
+		NoAccess:      recipients.noAccess,
+	}
+	if len(recipients.ids) == 0 {
+		response.Message = "None of the recipients can receive notifications from the sender"
+		h.respond(w, response, http.StatusOK)
+		return
+	}
+
+	recurring.RecipientsId = recipients.ids
+	response.Id, err = h.repo.CreateRecurringNotification(recurring)
+	if err != nil {
+		h.logger.Error().Msgf("failed to save recurring notification: %v", err)
+		h.respond(w, errorMessage{Error: ErrInternal.Error()}, http.StatusInternalServerError)
+		return
+	}
+
+	response.NextRunAt = &recurring.NextRunAt
+	response.Message = "Recurring notification successfully created!"
+	h.respond(w, response, http.StatusOK)
+}
+
+func (h *Handler) ListRecurringNotifications(w http.ResponseWriter, r *http.Request) {
+	senderId, senderUserName, ok := auth.User(r.Context())
+	if !ok {
+		h.respond(w, errorMessage{Error: auth.ErrMissingApiKey.Error()}, http.StatusUnauthorized)
+		return
+	}
+
+	notifications, err := h.repo.ListRecurringNotifications(senderId)
+	if err != nil {
+		h.logger.Error().Msgf("failed to list recurring notifications of %v: %v", senderUserName, err)
+		h.respond(w, errorMessage{Error: ErrInternal.Error()}, http.StatusInternalServerError)
+		return
+	}
+	h.respond(w, notifications, http.StatusOK)
+}
+
+func (h *Handler) DeleteRecurringNotification(w http.ResponseWriter, r *http.Request) {
+	recurringId, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		h.respond(w, errorMessage{Error: "recurring notification id must be a number"}, http.StatusBadRequest)
+		return
+	}
+
+	senderId, _, ok := auth.User(r.Context())
+	if !ok {
+		h.respond(w, errorMessage{Error: auth.ErrMissingApiKey.Error()}, http.StatusUnauthorized)
+		return
+	}
+
+	err = h.repo.DeleteRecurringNotification(recurringId, senderId)
+	if err != nil {
+		if err == repository.ErrNotificationNotExists {
+			h.respond(w, errorMessage{Error: "recurring notification does not exist"}, http.StatusNotFound)
+			return
+		}
+		h.logger.Error().Msgf("failed to delete recurring notification %v: %v", recurringId, err)
+		h.respond(w, errorMessage{Error: ErrInternal.Error()}, http.StatusInternalServerError)
+		return
+	}
+	h.respond(w, nil, http.StatusNoContent)
+}
@@ -0,0 +1,29 @@
+package addNotifications
+
+import (
+	"net/http"
+	"testing"
+
+	"notification_receiver/internal/model"
+)
+
+func TestCreateRecurringNotificationRepeatedRecipient(t *testing.T) {
+	h, repo, _ := newTestHandler()
+
+	var response recurringResponseMessage
+	code := serve(t, h.CreateRecurringNotification, model.RecurringNotification{
+		Cron:       "0 9 * * *",
+		Message:    "daily report",
+		Recipients: []string{"@alice", "@bob", "alice", "@alice_old"},
+	}, &response)
+
+	if code != http.StatusOK {
+		t.Fatalf("status is %v with %q, want 200", code, response.Message)
+	}
+	if recipients := repo.recurring[response.Id]; len(recipients) != 2 || recipients[0] != 2 || recipients[1] != 3 {
+		t.Errorf("recurring notification is saved for %v, want [2 3]", recipients)
+	}
+	if len(response.Authorized) != 2 || response.Authorized[0] != "@alice" || response.Authorized[1] != "@bob" {
+		t.Errorf("authorized users are %v, want [@alice @bob]", response.Authorized)
+	}
+}
@@ -0,0 +1,97 @@
+package addNotifications
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"notification_receiver/internal/auth"
+	"notification_receiver/internal/repository"
+
+	"github.com/gorilla/mux"
+)
+
+// layout of send_at without an offset, which is then interpreted in the given timezone
+const localTimeLayout = "2006-01-02T15:04:05"
+
+// how far send_at may be in the past to allow for the clock skew of clients, such notifications are sent immediately
+const sendAtSkew = time.Minute
+
+// parseSendAt returns nil if the notification must be sent immediately. A send_at in the past is rejected,
+// unless it is within the clock skew, so a mistyped date is not sent at once.
+func parseSendAt(sendAt string, timezone string) (*time.Time, error) {
+	if sendAt == "" {
+		if timezone != "" {
+			return nil, ErrInvalidSendAt
+		}
+		return nil, nil
+	}
+
+	location := time.UTC
+	if timezone != "" {
+		var err error
+		location, err = time.LoadLocation(timezone)
+		if err != nil {
+			return nil, ErrInvalidTimezone
+		}
+	}
+
+	t, err := time.Parse(time.RFC3339, sendAt)
+	if err != nil {
+		t, err = time.ParseInLocation(localTimeLayout, sendAt, location)
+		if err != nil {
+			return nil, ErrInvalidSendAt
+		}
+	}
+
+	now := time.Now()
+	if t.Before(now.Add(-sendAtSkew)) {
+		return nil, ErrSendAtInPast
+	}
+	if !t.After(now) {
+		return nil, nil
+	}
+	return &t, nil
+}
+
+func (h *Handler) ListScheduledNotifications(w http.ResponseWriter, r *http.Request) {
+	senderId, senderUserName, ok := auth.User(r.Context())
+	if !ok {
+		h.respond(w, errorMessage{Error: auth.ErrMissingApiKey.Error()}, http.StatusUnauthorized)
+		return
+	}
+
+	notifications, err := h.repo.ListScheduledNotifications(senderId)
+	if err != nil {
+		h.logger.Error().Msgf("failed to list scheduled notifications of %v: %v", senderUserName, err)
+		h.respond(w, errorMessage{Error: ErrInternal.Error()}, http.StatusInternalServerError)
+		return
+	}
+	h.respond(w, notifications, http.StatusOK)
+}
+
+func (h *Handler) CancelScheduledNotification(w http.ResponseWriter, r *http.Request) {
+	notificationId, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		h.respond(w, errorMessage{Error: "notification id must be a number"}, http.StatusBadRequest)
+		return
+	}
+
+	senderId, _, ok := auth.User(r.Context())
+	if !ok {
+		h.respond(w, errorMessage{Error: auth.ErrMissingApiKey.Error()}, http.StatusUnauthorized)
+		return
+	}
+
+	err = h.repo.CancelScheduledNotification(notificationId, senderId)
+	if err != nil {
+		if err == repository.ErrNotificationNotExists {
+			h.respond(w, errorMessage{Error: "scheduled notification does not exist or is already sent"}, http.StatusNotFound)
+			return
+		}
+		h.logger.Error().Msgf("failed to cancel scheduled notification %v: %v", notificationId, err)
+		h.respond(w, errorMessage{Error: ErrInternal.Error()}, http.StatusInternalServerError)
+		return
+	}
+	h.respond(w, nil, http.StatusNoContent)
+}
@@ -0,0 +1,97 @@
+package addNotifications
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"notification_receiver/internal/auth"
+	"notification_receiver/internal/repository"
+)
+
+const webhookSecretLength = 32
+
+type webhookMessage struct {
+	Url string `json:"url"`
+	// Secret signs the requests to the webhook, it is only returned on registration
+	Secret string `json:"secret,omitempty"`
+}
+
+// SetWebhook registers the url the presses of callback buttons and delivery summaries of the sender's
+// notifications are posted to. Every registration generates a new secret.
+func (h *Handler) SetWebhook(w http.ResponseWriter, r *http.Request) {
+	webhook := webhookMessage{}
+	if err := json.NewDecoder(r.Body).Decode(&webhook); err != nil {
+		h.respond(w, errorMessage{Error: fmt.Sprintf("failed to decode request: %v", err)}, http.StatusBadRequest)
+		return
+	}
+
+	u, err := url.Parse(webhook.Url)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		h.respond(w, errorMessage{Error: ErrInvalidWebhook.Error()}, http.StatusBadRequest)
+		return
+	}
+
+	senderId, senderUserName, ok := auth.User(r.Context())
+	if !ok {
+		h.respond(w, errorMessage{Error: auth.ErrMissingApiKey.Error()}, http.StatusUnauthorized)
+		return
+	}
+
+	buf := make([]byte, webhookSecretLength)
+	if _, err := rand.Read(buf); err != nil {
+		h.logger.Error().Msgf("failed to generate webhook secret: %v", err)
+		h.respond(w, errorMessage{Error: ErrInternal.Error()}, http.StatusInternalServerError)
+		return
+	}
+	webhook.Secret = hex.EncodeToString(buf)
+
+	if err := h.repo.SetWebhook(senderId, webhook.Url, webhook.Secret); err != nil {
+		h.logger.Error().Msgf("failed to set webhook of %v: %v", senderUserName, err)
+		h.respond(w, errorMessage{Error: ErrInternal.Error()}, http.StatusInternalServerError)
+		return
+	}
+	h.respond(w, webhook, http.StatusOK)
+}
+
+func (h *Handler) GetWebhook(w http.ResponseWriter, r *http.Request) {
+	senderId, senderUserName, ok := auth.User(r.Context())
+	if !ok {
+		h.respond(w, errorMessage{Error: auth.ErrMissingApiKey.Error()}, http.StatusUnauthorized)
+		return
+	}
+
+	webhookUrl, err := h.repo.GetWebhook(senderId)
+	if err != nil {
+		if err == repository.ErrWebhookNotExists {
+			h.respond(w, errorMessage{Error: err.Error()}, http.StatusNotFound)
+			return
+		}
+		h.logger.Error().Msgf("failed to get webhook of %v: %v", senderUserName, err)
+		h.respond(w, errorMessage{Error: ErrInternal.Error()}, http.StatusInternalServerError)
+		return
+	}
+	h.respond(w, webhookMessage{Url: webhookUrl}, http.StatusOK)
+}
+
+func (h *Handler) DeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	senderId, senderUserName, ok := auth.User(r.Context())
+	if !ok {
+		h.respond(w, errorMessage{Error: auth.ErrMissingApiKey.Error()}, http.StatusUnauthorized)
+		return
+	}
+
+	if err := h.repo.DeleteWebhook(senderId); err != nil {
+		if err == repository.ErrWebhookNotExists {
+			h.respond(w, errorMessage{Error: err.Error()}, http.StatusNotFound)
+			return
+		}
+		h.logger.Error().Msgf("failed to delete webhook of %v: %v", senderUserName, err)
+		h.respond(w, errorMessage{Error: ErrInternal.Error()}, http.StatusInternalServerError)
+		return
+	}
+	h.respond(w, nil, http.StatusNoContent)
+}
@@ -1,7 +1,166 @@
 package model
 
+import (
+	"encoding/json"
+	"time"
+)
+
+const (
+	StatusScheduled = "scheduled"
+	StatusCancelled = "cancelled"
+	StatusQueued    = "queued"
+	StatusRetrying  = "retrying"
+	StatusSent      = "sent"
+	StatusFailed    = "failed"
+	StatusBlocked   = "blocked"
+)
+
 type Notification struct {
+	Id           int64    `json:"id"`
 	Sender       string   `json:"sender"`
 	RecipientsId []string `json:"recipients"`
 	Message      string   `json:"message"`
+	// Format is one of plain, markdown_v2 or html, plain by default
+	Format string `json:"format,omitempty"`
+	// Template is the name of a message template of the sender, rendered with Data for every
+	// recipient in place of Message
+	Template string                 `json:"template,omitempty"`
+	Data     map[string]interface{} `json:"data,omitempty"`
+	// Attachments are sent before the message, which becomes their caption if it is short enough
+	Attachments []Attachment `json:"attachments,omitempty"`
+	// Buttons are rows of the inline keyboard of the message
+	Buttons [][]Button `json:"buttons,omitempty"`
+	// SendAt is an optional RFC3339 time to send the notification at,
+	// without an offset it is interpreted in Timezone
+	SendAt   string `json:"send_at,omitempty"`
+	Timezone string `json:"timezone,omitempty"`
+	// DedupKey is the idempotency key of the request if it is not given in the Idempotency-Key header
+	DedupKey string `json:"dedup_key,omitempty"`
+
+	// RecipientMessages are messages rendered from the template by recipient id
+	RecipientMessages map[string]string `json:"-"`
+	// SenderId is the user id of the sender, Sender is their username at the time of sending
+	SenderId int64 `json:"-"`
+}
+
+const (
+	AttachmentPhoto    = "photo"
+	AttachmentDocument = "document"
+)
+
+// Attachment is given by exactly one of Url, base64 encoded Data or telegram FileId.
+// Only the id of the saved attachment is published to the queue.
+type Attachment struct {
+	Id       int64  `json:"id,omitempty"`
+	Type     string `json:"type"`
+	Url      string `json:"url,omitempty"`
+	Data     string `json:"data,omitempty"`
+	FileId   string `json:"file_id,omitempty"`
+	FileName string `json:"file_name,omitempty"`
+}
+
+// Recipient is a user registered in the bot and whether they let the sender send them notifications.
+type Recipient struct {
+	Id        int64
+	HasAccess bool
+}
+
+// IdempotentResponse is the saved response to a request with an idempotency key.
+type IdempotentResponse struct {
+	StatusCode int
+	Body       []byte
+}
+
+// Button opens Url or, if it is a callback button, records Action of the recipient
+// and posts it to the webhook of the sender.
+type Button struct {
+	Text   string `json:"text"`
+	Url    string `json:"url,omitempty"`
+	Action string `json:"action,omitempty"`
+}
+
+type ScheduledNotification struct {
+	Id         int64     `json:"id"`
+	Message    string    `json:"message"`
+	SendAt     time.Time `json:"sendAt"`
+	Recipients []string  `json:"recipients"`
+}
+
+type NotificationStatus struct {
+	Id         int64             `json:"id"`
+	Sender     string            `json:"sender"`
+	CreatedAt  time.Time         `json:"createdAt"`
+	Recipients []RecipientStatus `json:"recipients"`
+
+	SenderId int64 `json:"-"`
+}
+
+type RecipientStatus struct {
+	UserName          string    `json:"username"`
+	Status            string    `json:"status"`
+	TelegramMessageId *int64    `json:"telegramMessageId,omitempty"`
+	Error             *string   `json:"error,omitempty"`
+	UpdatedAt         time.Time `json:"updatedAt"`
+
+	Actions []RecipientAction `json:"actions,omitempty"`
+}
+
+type RecipientAction struct {
+	Action    string    `json:"action"`
+	PressedAt time.Time `json:"pressedAt"`
+}
+
+type DeadLetter struct {
+	MessageId    string          `json:"messageId,omitempty"`
+	Attempts     int             `json:"attempts"`
+	Error        string          `json:"error,omitempty"`
+	Notification json.RawMessage `json:"notification"`
+}
+
+// RecurringNotification is sent to its recipients on every match of the cron expression.
+// Message is a text/template executed with the time of the run as .Time.
+type RecurringNotification struct {
+	Id         int64     `json:"id"`
+	Sender     string    `json:"sender,omitempty"`
+	Cron       string    `json:"cron"`
+	Timezone   string    `json:"timezone,omitempty"`
+	Message    string    `json:"message"`
+	Format     string    `json:"format,omitempty"`
+	Recipients []string  `json:"recipients"`
+	NextRunAt  time.Time `json:"nextRunAt"`
+	// DisabledReason is why the notification is not fired anymore, empty while it is
+	DisabledReason string `json:"disabledReason,omitempty"`
+
+	RecipientsId []int64 `json:"-"`
+	SenderId     int64   `json:"-"`
+}
+
+// MessageTemplate is a text/template of messages, see templates.Data for the available values.
+type MessageTemplate struct {
+	Id        int64     `json:"id"`
+	Name      string    `json:"name"`
+	Body      string    `json:"body"`
+	Format    string    `json:"format,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+
+	OwnerId int64 `json:"-"`
+}
+
+const (
+	AccessRequestPending  = "pending"
+	AccessRequestApproved = "approved"
+	AccessRequestDenied   = "denied"
+	AccessRequestExpired  = "expired"
+)
+
+// AccessRequest is a request of the sender to be granted access by the recipient,
+// which the recipient approves or denies in the bot before it expires.
+type AccessRequest struct {
+	Id        int64      `json:"id"`
+	Recipient string     `json:"recipient"`
+	Status    string     `json:"status"`
+	CreatedAt time.Time  `json:"createdAt"`
+	ExpiresAt time.Time  `json:"expiresAt"`
+	DecidedAt *time.Time `json:"decidedAt,omitempty"`
 }
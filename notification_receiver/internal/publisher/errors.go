@@ -3,5 +3,24 @@ package publisher
 import "errors"
 
 var (
-	ErrInternal = errors.New("internal error while sending notification")
+	ErrInternal    = errors.New("internal error while sending notification")
+	ErrUnavailable = errors.New("message broker is unavailable, try again later")
 )
+
+// UnpublishedError reports the recipients of a notification whose messages are not confirmed by the broker.
+// Messages to the rest of the recipients are published. Unconfirmed messages may still reach the queue,
+// so recipients are delivered at least once.
+type UnpublishedError struct {
+	Err          error
+	RecipientsId []string
+	// Partial is true if messages to some recipients are published
+	Partial bool
+}
+
+func (e *UnpublishedError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *UnpublishedError) Unwrap() error {
+	return e.Err
+}
@@ -1,22 +1,46 @@
 package publisher
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
+	"sync"
+	"time"
 
 	"notification_receiver/internal/model"
+	"notification_receiver/internal/rabbitmq"
 
 	"github.com/rs/zerolog"
 	"github.com/streadway/amqp"
 )
 
+const (
+	// how long Publish waits for the reconnection to the message broker
+	publishTimeout = 5 * time.Second
+	// how long Publish waits for the broker to confirm the messages
+	confirmTimeout = 10 * time.Second
+	// how many messages are published before waiting for their confirmations
+	confirmBatchSize = 100
+)
+
+// confirmedChannel is a channel in confirm mode with its confirmation listeners
+type confirmedChannel struct {
+	channel  *amqp.Channel
+	confirms <-chan amqp.Confirmation
+	returns  <-chan amqp.Return
+}
+
 type Service struct {
-	logger        zerolog.Logger
-	rmqConnection *amqp.Connection
-	rmqChannel    *amqp.Channel
-	rmqQueue      *amqp.Queue
+	logger zerolog.Logger
+	rmq    *rabbitmq.Connection
+
+	// publishMu serializes publishing so confirmations arrive in the order of messages
+	publishMu sync.Mutex
+	channelMu sync.Mutex
+	channel   confirmedChannel
 }
 
 func NewService(logger zerolog.Logger) (*Service, error) {
@@ -26,70 +50,335 @@ func NewService(logger zerolog.Logger) (*Service, error) {
 	if err != nil {
 		return nil, err
 	}
-	conn, err := amqp.Dial(rabbitMqCredentials)
-	if err != nil {
-		return nil, err
-	}
 
-	channel, err := conn.Channel()
-	if err != nil {
-		return nil, err
+	s := &Service{
+		logger: l,
 	}
-
-	queue, err := channel.QueueDeclare(
-		"notification_queue",
-		true,
-		false,
-		false,
-		false,
-		nil,
-	)
+	s.rmq, err = rabbitmq.Dial(logger, rabbitMqCredentials, s.setup)
 	if err != nil {
 		return nil, err
 	}
 
-	return &Service{
-		logger:        l,
-		rmqConnection: conn,
-		rmqChannel:    channel,
-		rmqQueue:      &queue,
-	}, nil
+	return s, nil
 }
 
 func (s *Service) Close() error {
-	// TODO if the channel is closed with an error, the connection will not be closed?
-	err := s.rmqChannel.Close()
-	if err != nil {
+	return s.rmq.Close()
+}
+
+func (s *Service) setup(channel *amqp.Channel) error {
+	if _, err := declareTopology(channel); err != nil {
 		return err
 	}
-	err = s.rmqConnection.Close()
-	if err != nil {
+	if err := channel.Confirm(false); err != nil {
 		return err
 	}
+
+	s.channelMu.Lock()
+	defer s.channelMu.Unlock()
+	s.channel = confirmedChannel{
+		channel:  channel,
+		confirms: channel.NotifyPublish(make(chan amqp.Confirmation, confirmBatchSize)),
+		returns:  channel.NotifyReturn(make(chan amqp.Return, confirmBatchSize)),
+	}
 	return nil
 }
 
+// Publish puts a separate message for every recipient of the notification to the queue,
+// so a failed delivery to one recipient is retried without resending it to the others.
+// It returns once the broker has confirmed all messages.
 func (s *Service) Publish(notification model.Notification) error {
-	message, err := json.Marshal(notification)
-	if err != nil {
-		s.logger.Error().Msgf("error while encode new notification, error: %s", err.Error())
-		return ErrInternal
-	}
-
-	err = s.rmqChannel.Publish(
-		"",
-		s.rmqQueue.Name,
-		false,
-		false,
-		amqp.Publishing{
-			ContentType: "text/plain",
-			Body:        message,
+	return s.PublishBatch([]model.Notification{notification})[0]
+}
+
+// PublishBatch publishes the notifications like Publish, sharing the confirmations between them.
+// It returns the errors of the notifications in their order, nil for the published ones.
+// Notifications published to some of their recipients only get an *UnpublishedError.
+func (s *Service) PublishBatch(notifications []model.Notification) []error {
+	errs := make([]error, len(notifications))
+
+	var messages []amqp.Publishing
+	// owners are the indexes of the notifications of the messages, recipients are their recipients
+	var owners []int
+	var recipients []string
+	for i, notification := range notifications {
+		notificationMessages, err := s.messages(notification)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		for range notificationMessages {
+			owners = append(owners, i)
+		}
+		recipients = append(recipients, notification.RecipientsId...)
+		messages = append(messages, notificationMessages...)
+	}
+
+	s.publishMu.Lock()
+	defer s.publishMu.Unlock()
+
+	for start := 0; start < len(messages); start += confirmBatchSize {
+		end := start + confirmBatchSize
+		if end > len(messages) {
+			end = len(messages)
+		}
+		confirmed, err := s.publishBatch(messages[start:end])
+		if err != nil {
+			// messages from the first unconfirmed one on are not published
+			unpublished := make(map[int]*UnpublishedError)
+			for j := start + confirmed; j < len(messages); j++ {
+				i := owners[j]
+				if unpublished[i] == nil {
+					unpublished[i] = &UnpublishedError{Err: err, Partial: j > 0 && owners[j-1] == i}
+					errs[i] = unpublished[i]
+				}
+				unpublished[i].RecipientsId = append(unpublished[i].RecipientsId, recipients[j])
+			}
+			break
+		}
+	}
+	return errs
+}
+
+func (s *Service) messages(notification model.Notification) ([]amqp.Publishing, error) {
+	messages := make([]amqp.Publishing, 0, len(notification.RecipientsId))
+	for _, recipient := range notification.RecipientsId {
+		single := notification
+		single.RecipientsId = []string{recipient}
+		if message, ok := notification.RecipientMessages[recipient]; ok {
+			single.Message = message
+		}
+
+		body, err := json.Marshal(single)
+		if err != nil {
+			s.logger.Error().Msgf("error while encode new notification, error: %s", err.Error())
+			return nil, ErrInternal
+		}
+
+		messages = append(messages, amqp.Publishing{
+			ContentType:  "application/json",
+			DeliveryMode: amqp.Persistent,
+			MessageId:    messageId(notification.Id, recipient),
+			Timestamp:    time.Now(),
+			Body:         body,
 		})
+	}
+	return messages, nil
+}
+
+// publishBatch publishes the messages and returns how many of them from the first one are confirmed
+// by the broker, all of them unless there is an error.
+func (s *Service) publishBatch(messages []amqp.Publishing) (int, error) {
+	channel, err := s.rmq.Channel(publishTimeout)
 	if err != nil {
 		s.logger.Error().Msgf("error while publish new notification to message broker, error: %s", err.Error())
-		return ErrInternal
+		return 0, ErrUnavailable
 	}
-	return nil
+
+	s.channelMu.Lock()
+	current := s.channel
+	s.channelMu.Unlock()
+	if current.channel != channel {
+		s.logger.Error().Msg("error while publish new notification to message broker, error: channel is not set up")
+		return 0, ErrUnavailable
+	}
+
+	// messages published before a failed one are still confirmed, so their recipients are not reported
+	// as unpublished while they get the notification
+	published := 0
+	var publishErr error
+	for _, message := range messages {
+		publishErr = channel.Publish(
+			"",
+			notificationQueue,
+			true,
+			false,
+			message)
+		if publishErr != nil {
+			s.logger.Error().Msgf("error while publish new notification to message broker, error: %s",
+				publishErr.Error())
+			break
+		}
+		published++
+	}
+	if publishErr != nil {
+		defer channel.Close()
+	}
+
+	// on failure the channel is closed to not mix up confirmations of the next messages,
+	// the connection manager opens a new one
+	timer := time.NewTimer(confirmTimeout)
+	defer timer.Stop()
+
+	// confirmations come in the order of the messages
+	for confirmed := 0; confirmed < published; confirmed++ {
+		select {
+		case confirm, ok := <-current.confirms:
+			if !ok {
+				s.logger.Error().Msg("channel to message broker is closed before the notification is confirmed")
+				return confirmed, ErrUnavailable
+			}
+			if !confirm.Ack {
+				s.logger.Error().Msgf("message broker rejected notification, delivery tag: %v", confirm.DeliveryTag)
+				channel.Close()
+				return confirmed, ErrInternal
+			}
+		case <-timer.C:
+			s.logger.Error().Msg("timed out waiting for message broker to confirm the notification")
+			channel.Close()
+			return confirmed, ErrInternal
+		}
+	}
+
+	// the broker sends returns of unroutable messages before their confirmations, so all of them are here
+	// and are drained to not be taken for returns of the next batch
+	if unroutable := s.drainReturns(current.returns, messages); unroutable < published {
+		return unroutable, ErrInternal
+	}
+	if publishErr != nil {
+		return published, ErrInternal
+	}
+	return len(messages), nil
+}
+
+// drainReturns reads the pending returns of unroutable messages and returns the index of the first returned one
+// of the messages, len(messages) if none of them is returned.
+func (s *Service) drainReturns(returns <-chan amqp.Return, messages []amqp.Publishing) int {
+	first := len(messages)
+	for {
+		select {
+		case returned := <-returns:
+			s.logger.Error().Msgf("notification %v is unroutable: %v", returned.MessageId, returned.ReplyText)
+			for i := 0; i < first; i++ {
+				if messages[i].MessageId == returned.MessageId {
+					first = i
+					break
+				}
+			}
+		default:
+			return first
+		}
+	}
+}
+
+// ListDeadLetters returns up to limit messages from the head of the dead letter queue
+// without removing them from the queue.
+func (s *Service) ListDeadLetters(limit int) ([]model.DeadLetter, error) {
+	channel, err := s.rmq.NewChannel()
+	if err != nil {
+		s.logger.Error().Msgf("failed to open channel to message broker: %v", err)
+		return nil, ErrUnavailable
+	}
+	// unacknowledged messages are returned to the queue when the channel is closed
+	defer channel.Close()
+
+	deadLetters := []model.DeadLetter{}
+	for len(deadLetters) < limit {
+		message, ok, err := channel.Get(deadLetterQueue, false)
+		if err != nil {
+			s.logger.Error().Msgf("failed to get message from dead letter queue: %v", err)
+			return nil, ErrInternal
+		}
+		if !ok {
+			break
+		}
+		deadLetters = append(deadLetters, toDeadLetter(message))
+	}
+	return deadLetters, nil
+}
+
+// ReplayDeadLetters moves up to limit messages from the dead letter queue back to the
+// notification queue with a fresh retry budget.
+func (s *Service) ReplayDeadLetters(limit int) ([]model.DeadLetter, error) {
+	channel, err := s.rmq.NewChannel()
+	if err != nil {
+		s.logger.Error().Msgf("failed to open channel to message broker: %v", err)
+		return nil, ErrUnavailable
+	}
+	defer channel.Close()
+
+	if err := channel.Confirm(false); err != nil {
+		s.logger.Error().Msgf("failed to put channel in confirm mode: %v", err)
+		return nil, ErrInternal
+	}
+	confirms := channel.NotifyPublish(make(chan amqp.Confirmation, 1))
+
+	replayed := []model.DeadLetter{}
+	for len(replayed) < limit {
+		message, ok, err := channel.Get(deadLetterQueue, false)
+		if err != nil {
+			s.logger.Error().Msgf("failed to get message from dead letter queue: %v", err)
+			return replayed, ErrInternal
+		}
+		if !ok {
+			break
+		}
+
+		headers := amqp.Table{}
+		for k, v := range message.Headers {
+			headers[k] = v
+		}
+		delete(headers, attemptHeader)
+		delete(headers, errorHeader)
+
+		err = channel.Publish(
+			"",
+			notificationQueue,
+			false,
+			false,
+			amqp.Publishing{
+				Headers:      headers,
+				ContentType:  message.ContentType,
+				DeliveryMode: amqp.Persistent,
+				MessageId:    message.MessageId,
+				Body:         message.Body,
+			})
+		if err != nil {
+			s.logger.Error().Msgf("failed to replay dead letter: %v", err)
+			return replayed, ErrInternal
+		}
+		if confirm, ok := <-confirms; !ok || !confirm.Ack {
+			s.logger.Error().Msg("message broker did not confirm replayed dead letter")
+			return replayed, ErrInternal
+		}
+		if err := message.Ack(false); err != nil {
+			s.logger.Error().Msgf("failed to ack dead letter: %v", err)
+			return replayed, ErrInternal
+		}
+		replayed = append(replayed, toDeadLetter(message))
+	}
+	return replayed, nil
+}
+
+func toDeadLetter(message amqp.Delivery) model.DeadLetter {
+	deadLetter := model.DeadLetter{
+		MessageId: message.MessageId,
+		Attempts:  attempts(message),
+	}
+	if reason, ok := message.Headers[errorHeader].(string); ok {
+		deadLetter.Error = reason
+	} else if reason, ok := message.Headers["x-first-death-reason"].(string); ok {
+		deadLetter.Error = reason
+	}
+	if json.Valid(message.Body) {
+		deadLetter.Notification = message.Body
+	} else {
+		deadLetter.Notification, _ = json.Marshal(string(message.Body))
+	}
+	return deadLetter
+}
+
+// messageId is stable for the notification and recipient, so repeated deliveries can be detected
+func messageId(notificationId int64, recipient string) string {
+	if notificationId != 0 {
+		return fmt.Sprintf("%d-%s", notificationId, recipient)
+	}
+
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(buf)
 }
 
 func getRabbitMqCredentials() (string, error) {
@@ -0,0 +1,27 @@
+package publisher
+
+import (
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/streadway/amqp"
+)
+
+func TestDrainReturnsTakesFirstReturnedMessage(t *testing.T) {
+	s := &Service{logger: zerolog.Nop()}
+	messages := []amqp.Publishing{{MessageId: "1:10"}, {MessageId: "1:11"}, {MessageId: "1:12"}}
+
+	returns := make(chan amqp.Return, 3)
+	returns <- amqp.Return{MessageId: "1:12"}
+	returns <- amqp.Return{MessageId: "1:11"}
+
+	if first := s.drainReturns(returns, messages); first != 1 {
+		t.Errorf("first returned message is %v, want 1", first)
+	}
+	if len(returns) != 0 {
+		t.Errorf("%v returns are left for the next batch", len(returns))
+	}
+	if first := s.drainReturns(returns, messages); first != len(messages) {
+		t.Errorf("first returned message is %v without returns, want %v", first, len(messages))
+	}
+}
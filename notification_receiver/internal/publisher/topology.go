@@ -0,0 +1,47 @@
+package publisher
+
+import "github.com/streadway/amqp"
+
+const (
+	notificationQueue = "notification_queue"
+	deadLetterQueue   = "notification_dlq"
+
+	attemptHeader = "x-attempt"
+	errorHeader   = "x-error"
+)
+
+// declareTopology declares the main queue and the dead letter queue, both without arguments like in
+// notification_sender, which also declares the retry queues.
+func declareTopology(channel *amqp.Channel) (amqp.Queue, error) {
+	_, err := channel.QueueDeclare(
+		deadLetterQueue,
+		true,
+		false,
+		false,
+		false,
+		nil,
+	)
+	if err != nil {
+		return amqp.Queue{}, err
+	}
+
+	return channel.QueueDeclare(
+		notificationQueue,
+		true,
+		false,
+		false,
+		false,
+		nil,
+	)
+}
+
+func attempts(message amqp.Delivery) int {
+	switch v := message.Headers[attemptHeader].(type) {
+	case int32:
+		return int(v)
+	case int64:
+		return int(v)
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,8 @@
+package rabbitmq
+
+import "errors"
+
+var (
+	ErrDisconnected = errors.New("message broker is unavailable")
+	ErrClosed       = errors.New("connection to message broker is closed")
+)
@@ -6,4 +6,18 @@ var (
 	ErrAlreadyExists = errors.New("user already exists")
 	ErrNotExists     = errors.New("user does not exist")
 	ErrInternal      = errors.New("something went wrong")
+
+	ErrNotificationNotExists = errors.New("notification does not exist")
+	ErrTemplateAlreadyExists = errors.New("template already exists")
+	ErrTemplateNotExists     = errors.New("template does not exist")
+	ErrWebhookNotExists      = errors.New("webhook is not set")
+
+	ErrIdempotencyKeyInProgress = errors.New("a request with the idempotency key is in progress")
+	ErrIdempotencyKeyReused     = errors.New("the idempotency key is already used for another request")
+
+	ErrAccessRequestNotExists = errors.New("access request does not exist")
+	ErrAccessRequestPending   = errors.New("an access request to the recipient is already pending")
+	ErrAccessRequestDenied    = errors.New("the recipient has recently denied an access request, try again later")
+	ErrTooManyAccessRequests  = errors.New("too many access requests, try again later")
+	ErrAccessAlreadyGranted   = errors.New("the recipient has already granted access")
 )
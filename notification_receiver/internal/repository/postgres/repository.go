@@ -2,6 +2,35 @@ package postgres
 
 import (
 	"database/sql"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"notification_receiver/internal/formatting"
+	"notification_receiver/internal/model"
+	"notification_receiver/internal/repository"
+
+	"github.com/lib/pq"
+)
+
+const (
+	schedulePending    = "pending"
+	schedulePublishing = "publishing"
+	schedulePublished  = "published"
+	scheduleCancelled  = "cancelled"
+
+	// notifications claimed by the scheduler longer ago are claimed again
+	claimTimeout = 5 * time.Minute
+
+	// error of scheduled recipients who can not receive the notification by the time it is due
+	errRecipientDropped = "recipient has revoked access of the sender or left the bot before the notification was due"
+
+	uniqueViolation = "23505"
+
+	// raised by create_access_request, see migrations/0019_access_request_limits.sql
+	accessAlreadyGranted  = "AR001"
+	accessRequestDenied   = "AR002"
+	tooManyAccessRequests = "AR003"
 )
 
 type Repository struct {
@@ -12,14 +41,858 @@ func NewRepository(db *sql.DB) *Repository {
 	return &Repository{db: db}
 }
 
-func (repo *Repository) GetUser(userName string) (int64, error) {
-	q := `SELECT id FROM users WHERE username = $1`
+// GetUsers looks up the active users with the usernames at once and returns their ids by username.
+// Users who have renamed since are found by their old usernames, unless somebody else has taken them.
+// Usernames of unknown and exited users are missing in the result.
+func (repo *Repository) GetUsers(userNames []string) (map[string]int64, error) {
+	q := `SELECT username, id FROM users WHERE username = ANY($1) AND is_active
+		UNION ALL
+		(SELECT DISTINCT ON (h.username) h.username, u.id
+		FROM username_history h JOIN users u ON u.id = h.user_id
+		WHERE h.username = ANY($1) AND u.is_active
+			AND NOT EXISTS(SELECT 1 FROM users WHERE username = h.username)
+		ORDER BY h.username, h.changed_at DESC)`
+
+	rows, err := repo.db.Query(q, pq.Array(userNames))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := make(map[string]int64, len(userNames))
+	for rows.Next() {
+		var userName string
+		var userId int64
+		if err := rows.Scan(&userName, &userId); err != nil {
+			return nil, err
+		}
+		users[userName] = userId
+	}
+
+	return users, rows.Err()
+}
+
+// GetNotificationAccess returns which of the active users let the user with access send them notifications.
+func (repo *Repository) GetNotificationAccess(usersId []int64, userIdWithAccess int64) (map[int64]bool, error) {
+	q := `SELECT a.user_id FROM notification_access a JOIN users u ON u.id = a.user_id
+		WHERE a.user_id = ANY($1) AND a.granted_user_id = $2 AND u.is_active`
+
+	rows, err := repo.db.Query(q, pq.Array(usersId), userIdWithAccess)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	access := make(map[int64]bool)
+	for rows.Next() {
+		var userId int64
+		if err := rows.Scan(&userId); err != nil {
+			return nil, err
+		}
+		access[userId] = true
+	}
+
+	return access, rows.Err()
+}
+
+func (repo *Repository) GetApiKeyOwner(keyHash string) (int64, string, error) {
+	q := `SELECT u.id, u.username FROM api_keys k JOIN users u ON u.id = k.user_id
+		WHERE k.key_hash = $1 AND k.revoked_at IS NULL`
+
+	var userId int64
+	var userName string
+	row := repo.db.QueryRow(q, keyHash)
+	if err := row.Scan(&userId, &userName); err != nil {
+		return userId, userName, err
+	}
+
+	return userId, userName, nil
+}
+
+// CreateNotification saves the notification with its recipients. Notifications with sendAt
+// are saved as pending and published by the scheduler.
+func (repo *Repository) CreateNotification(notification model.Notification, recipientsId []int64, sendAt *time.Time) (int64, error) {
+	tx, err := repo.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	recipientStatus := model.StatusQueued
+	var scheduleStatus *string
+	if sendAt != nil {
+		recipientStatus = model.StatusScheduled
+		pending := schedulePending
+		scheduleStatus = &pending
+	}
+
+	buttons, err := encodeButtons(notification.Buttons)
+	if err != nil {
+		return 0, err
+	}
+
+	q := `INSERT INTO notifications (sender, sender_id, message, format, send_at, schedule_status, buttons)
+		VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id`
+
+	var notificationId int64
+	row := tx.QueryRow(q, notification.Sender, notification.SenderId, notification.Message,
+		formatOrPlain(notification.Format), sendAt, scheduleStatus, buttons)
+	if err := row.Scan(&notificationId); err != nil {
+		return 0, err
+	}
+
+	q = `INSERT INTO notification_recipients (notification_id, recipient_id, status, message)
+		SELECT $1, r.id, $3, NULLIF(r.message, '') FROM unnest($2::bigint[], $4::text[]) AS r (id, message)`
+
+	messages := make([]string, len(recipientsId))
+	for i, id := range recipientsId {
+		messages[i] = notification.RecipientMessages[strconv.FormatInt(id, 10)]
+	}
+	if _, err := tx.Exec(q, notificationId, pq.Array(recipientsId), recipientStatus, pq.Array(messages)); err != nil {
+		return 0, err
+	}
+
+	q = `INSERT INTO notification_attachments (notification_id, attachment_id, position) VALUES ($1, $2, $3)`
+
+	for i, attachment := range notification.Attachments {
+		if _, err := tx.Exec(q, notificationId, attachment.Id, i); err != nil {
+			return 0, err
+		}
+	}
+
+	return notificationId, tx.Commit()
+}
+
+// SaveAttachment saves the attachment with its decoded data, if any.
+func (repo *Repository) SaveAttachment(attachment model.Attachment, data []byte) (int64, error) {
+	q := `INSERT INTO attachments (type, url, data, file_name, file_id)
+		VALUES ($1, NULLIF($2, ''), $3, NULLIF($4, ''), NULLIF($5, '')) RETURNING id`
+
+	var attachmentId int64
+	row := repo.db.QueryRow(q, attachment.Type, attachment.Url, data, attachment.FileName, attachment.FileId)
+	if err := row.Scan(&attachmentId); err != nil {
+		return 0, err
+	}
+
+	return attachmentId, nil
+}
+
+func (repo *Repository) GetNotificationStatus(notificationId int64) (model.NotificationStatus, error) {
+	q := `SELECT id, sender, COALESCE(sender_id, 0), created_at FROM notifications WHERE id = $1`
+
+	status := model.NotificationStatus{}
+	row := repo.db.QueryRow(q, notificationId)
+	if err := row.Scan(&status.Id, &status.Sender, &status.SenderId, &status.CreatedAt); err != nil {
+		if err == sql.ErrNoRows {
+			return status, repository.ErrNotificationNotExists
+		}
+		return status, err
+	}
+
+	q = `SELECT r.recipient_id, COALESCE(u.username, r.recipient_id::text), r.status, r.telegram_message_id,
+			r.error, r.updated_at
+		FROM notification_recipients r LEFT JOIN users u ON u.id = r.recipient_id
+		WHERE r.notification_id = $1 ORDER BY r.recipient_id`
+
+	rows, err := repo.db.Query(q, notificationId)
+	if err != nil {
+		return status, err
+	}
+	defer rows.Close()
+
+	index := make(map[int64]int)
+	for rows.Next() {
+		var recipientId int64
+		var recipient model.RecipientStatus
+		err := rows.Scan(&recipientId, &recipient.UserName, &recipient.Status, &recipient.TelegramMessageId,
+			&recipient.Error, &recipient.UpdatedAt)
+		if err != nil {
+			return status, err
+		}
+		index[recipientId] = len(status.Recipients)
+		status.Recipients = append(status.Recipients, recipient)
+	}
+	if err := rows.Err(); err != nil {
+		return status, err
+	}
+
+	q = `SELECT recipient_id, action, created_at FROM notification_actions WHERE notification_id = $1 ORDER BY id`
+
+	actions, err := repo.db.Query(q, notificationId)
+	if err != nil {
+		return status, err
+	}
+	defer actions.Close()
+
+	for actions.Next() {
+		var recipientId int64
+		var action model.RecipientAction
+		if err := actions.Scan(&recipientId, &action.Action, &action.PressedAt); err != nil {
+			return status, err
+		}
+		if i, ok := index[recipientId]; ok {
+			status.Recipients[i].Actions = append(status.Recipients[i].Actions, action)
+		}
+	}
+
+	return status, actions.Err()
+}
+
+// ClaimDueNotifications marks up to limit pending notifications due by now as being published
+// and returns them. Notifications claimed long ago are claimed again, as their publisher
+// has probably failed. Recipients who have revoked the access of the sender or left the bot
+// since the notification was scheduled are marked as failed and are not returned.
+func (repo *Repository) ClaimDueNotifications(now time.Time, limit int) ([]model.Notification, error) {
+	tx, err := repo.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	q := `UPDATE notifications SET schedule_status = $3, claimed_at = $1
+		WHERE id IN (
+			SELECT id FROM notifications
+			WHERE (schedule_status = $4 AND send_at <= $1)
+				OR (schedule_status = $3 AND claimed_at < $1 - $5 * interval '1 second')
+			ORDER BY send_at
+			LIMIT $2
+			FOR UPDATE SKIP LOCKED)
+		RETURNING id, sender, COALESCE(sender_id, 0), message, format, buttons`
+
+	rows, err := tx.Query(q, now, limit, schedulePublishing, schedulePending, claimTimeout.Seconds())
+	if err != nil {
+		return nil, err
+	}
+
+	var notifications []model.Notification
+	index := make(map[int64]int)
+	var ids []int64
+	for rows.Next() {
+		var notification model.Notification
+		var buttons []byte
+		err := rows.Scan(&notification.Id, &notification.Sender, &notification.SenderId, &notification.Message,
+			&notification.Format, &buttons)
+		if err == nil && buttons != nil {
+			err = json.Unmarshal(buttons, &notification.Buttons)
+		}
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		index[notification.Id] = len(notifications)
+		ids = append(ids, notification.Id)
+		notifications = append(notifications, notification)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(ids) > 0 {
+		q = `UPDATE notification_recipients r SET status = $3, error = $4, updated_at = now()
+			FROM notifications n
+			WHERE n.id = r.notification_id AND r.notification_id = ANY($1) AND r.status = $2
+				AND NOT EXISTS(SELECT 1 FROM notification_access a JOIN users u ON u.id = a.user_id
+					WHERE a.user_id = r.recipient_id AND a.granted_user_id = n.sender_id AND u.is_active)`
+
+		_, err = tx.Exec(q, pq.Array(ids), model.StatusScheduled, model.StatusFailed, errRecipientDropped)
+		if err != nil {
+			return nil, err
+		}
+
+		q = `SELECT notification_id, recipient_id, COALESCE(message, '') FROM notification_recipients
+			WHERE notification_id = ANY($1) AND status = $2`
+
+		rows, err = tx.Query(q, pq.Array(ids), model.StatusScheduled)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var notificationId, recipientId int64
+			var message string
+			if err := rows.Scan(&notificationId, &recipientId, &message); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			i := index[notificationId]
+			recipient := strconv.FormatInt(recipientId, 10)
+			notifications[i].RecipientsId = append(notifications[i].RecipientsId, recipient)
+			if message != "" {
+				if notifications[i].RecipientMessages == nil {
+					notifications[i].RecipientMessages = make(map[string]string)
+				}
+				notifications[i].RecipientMessages[recipient] = message
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(ids) > 0 {
+		q = `SELECT na.notification_id, a.id, a.type, COALESCE(a.file_id, ''), COALESCE(a.file_name, '')
+			FROM notification_attachments na JOIN attachments a ON a.id = na.attachment_id
+			WHERE na.notification_id = ANY($1)
+			ORDER BY na.notification_id, na.position`
+
+		rows, err = tx.Query(q, pq.Array(ids))
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var notificationId int64
+			var attachment model.Attachment
+			err := rows.Scan(&notificationId, &attachment.Id, &attachment.Type, &attachment.FileId, &attachment.FileName)
+			if err != nil {
+				rows.Close()
+				return nil, err
+			}
+			i := index[notificationId]
+			notifications[i].Attachments = append(notifications[i].Attachments, attachment)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	return notifications, tx.Commit()
+}
+
+// FailRecipients marks the queued recipients of the notification as failed with the reason.
+func (repo *Repository) FailRecipients(notificationId int64, recipientsId []int64, reason string) error {
+	q := `UPDATE notification_recipients SET status = $3, error = $4, updated_at = now()
+		WHERE notification_id = $1 AND recipient_id = ANY($2) AND status = $5`
+
+	_, err := repo.db.Exec(q, notificationId, pq.Array(recipientsId), model.StatusFailed, reason, model.StatusQueued)
+	return err
+}
+
+func (repo *Repository) MarkNotificationPublished(notificationId int64) error {
+	tx, err := repo.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	q := `UPDATE notifications SET schedule_status = $2 WHERE id = $1`
+	if _, err := tx.Exec(q, notificationId, schedulePublished); err != nil {
+		return err
+	}
+
+	q = `UPDATE notification_recipients SET status = $2, updated_at = now()
+		WHERE notification_id = $1 AND status = $3`
+	if _, err := tx.Exec(q, notificationId, model.StatusQueued, model.StatusScheduled); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (repo *Repository) ReleaseNotification(notificationId int64) error {
+	q := `UPDATE notifications SET schedule_status = $2, claimed_at = NULL WHERE id = $1 AND schedule_status = $3`
+
+	_, err := repo.db.Exec(q, notificationId, schedulePending, schedulePublishing)
+	return err
+}
+
+func (repo *Repository) ListScheduledNotifications(senderId int64) ([]model.ScheduledNotification, error) {
+	q := `SELECT n.id, n.message, n.send_at, array_agg(COALESCE('@' || u.username, r.recipient_id::text))
+		FROM notifications n
+			JOIN notification_recipients r ON r.notification_id = n.id
+			LEFT JOIN users u ON u.id = r.recipient_id
+		WHERE n.sender_id = $1 AND n.schedule_status = $2
+		GROUP BY n.id
+		ORDER BY n.send_at`
+
+	rows, err := repo.db.Query(q, senderId, schedulePending)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	notifications := []model.ScheduledNotification{}
+	for rows.Next() {
+		var notification model.ScheduledNotification
+		err := rows.Scan(&notification.Id, &notification.Message, &notification.SendAt,
+			pq.Array(&notification.Recipients))
+		if err != nil {
+			return nil, err
+		}
+		notifications = append(notifications, notification)
+	}
+
+	return notifications, rows.Err()
+}
+
+func (repo *Repository) CancelScheduledNotification(notificationId int64, senderId int64) error {
+	tx, err := repo.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	q := `UPDATE notifications SET schedule_status = $3 WHERE id = $1 AND sender_id = $2 AND schedule_status = $4`
+
+	res, err := tx.Exec(q, notificationId, senderId, scheduleCancelled, schedulePending)
+	if err != nil {
+		return err
+	}
+	count, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return repository.ErrNotificationNotExists
+	}
+
+	q = `UPDATE notification_recipients SET status = $2, updated_at = now() WHERE notification_id = $1`
+	if _, err := tx.Exec(q, notificationId, model.StatusCancelled); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (repo *Repository) CreateRecurringNotification(recurring model.RecurringNotification) (int64, error) {
+	tx, err := repo.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	q := `INSERT INTO recurring_notifications (sender, sender_id, cron, timezone, message, format, next_run_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id`
+
+	var recurringId int64
+	row := tx.QueryRow(q, recurring.Sender, recurring.SenderId, recurring.Cron, recurring.Timezone, recurring.Message,
+		formatOrPlain(recurring.Format), recurring.NextRunAt)
+	if err := row.Scan(&recurringId); err != nil {
+		return 0, err
+	}
+
+	q = `INSERT INTO recurring_notification_recipients (recurring_notification_id, recipient_id)
+		SELECT DISTINCT $1::bigint, unnest($2::bigint[])`
+
+	if _, err := tx.Exec(q, recurringId, pq.Array(recurring.RecipientsId)); err != nil {
+		return 0, err
+	}
+
+	return recurringId, tx.Commit()
+}
+
+func (repo *Repository) ListRecurringNotifications(senderId int64) ([]model.RecurringNotification, error) {
+	q := `SELECT n.id, n.cron, n.timezone, n.message, n.format, n.next_run_at, COALESCE(n.disabled_reason, ''),
+			array_remove(array_agg(COALESCE('@' || u.username, r.recipient_id::text)), NULL)
+		FROM recurring_notifications n
+			LEFT JOIN recurring_notification_recipients r ON r.recurring_notification_id = n.id
+			LEFT JOIN users u ON u.id = r.recipient_id
+		WHERE n.sender_id = $1
+		GROUP BY n.id
+		ORDER BY n.id`
+
+	rows, err := repo.db.Query(q, senderId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	notifications := []model.RecurringNotification{}
+	for rows.Next() {
+		var recurring model.RecurringNotification
+		err := rows.Scan(&recurring.Id, &recurring.Cron, &recurring.Timezone, &recurring.Message,
+			&recurring.Format, &recurring.NextRunAt, &recurring.DisabledReason, pq.Array(&recurring.Recipients))
+		if err != nil {
+			return nil, err
+		}
+		notifications = append(notifications, recurring)
+	}
+
+	return notifications, rows.Err()
+}
+
+func (repo *Repository) DeleteRecurringNotification(recurringId int64, senderId int64) error {
+	q := `DELETE FROM recurring_notifications WHERE id = $1 AND sender_id = $2`
 
-	var userId int64 = 0
-	row := repo.db.QueryRow(q, userName)
-	if err := row.Scan(&userId); err != nil {
-		return userId, err
+	res, err := repo.db.Exec(q, recurringId, senderId)
+	if err != nil {
+		return err
+	}
+	count, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return repository.ErrNotificationNotExists
+	}
+	return nil
+}
+
+// ListDueRecurringNotifications returns recurring notifications due by now with the active recipients
+// who are subscribed and still allow the sender to send them notifications. Sender is the current username.
+func (repo *Repository) ListDueRecurringNotifications(now time.Time, limit int) ([]model.RecurringNotification, error) {
+	q := `SELECT n.id, '@' || s.username, n.sender_id, n.cron, n.timezone, n.message, n.format, n.next_run_at,
+			array_remove(array_agg(a.user_id), NULL)
+		FROM recurring_notifications n
+			JOIN users s ON s.id = n.sender_id
+			LEFT JOIN recurring_notification_recipients r ON r.recurring_notification_id = n.id
+			LEFT JOIN notification_access a
+				ON a.user_id = r.recipient_id AND a.granted_user_id = n.sender_id
+					AND EXISTS(SELECT 1 FROM users u WHERE u.id = a.user_id AND u.is_active)
+		WHERE n.next_run_at <= $1 AND n.disabled_at IS NULL
+		GROUP BY n.id, s.username
+		ORDER BY n.next_run_at
+		LIMIT $2`
+
+	rows, err := repo.db.Query(q, now, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var notifications []model.RecurringNotification
+	for rows.Next() {
+		var recurring model.RecurringNotification
+		err := rows.Scan(&recurring.Id, &recurring.Sender, &recurring.SenderId, &recurring.Cron, &recurring.Timezone,
+			&recurring.Message, &recurring.Format, &recurring.NextRunAt, pq.Array(&recurring.RecipientsId))
+		if err != nil {
+			return nil, err
+		}
+		notifications = append(notifications, recurring)
+	}
+
+	return notifications, rows.Err()
+}
+
+// DisableRecurringNotification stops firing the recurring notification, the reason is shown to its sender.
+func (repo *Repository) DisableRecurringNotification(recurringId int64, reason string) error {
+	q := `UPDATE recurring_notifications SET disabled_at = now(), disabled_reason = $2 WHERE id = $1`
+
+	_, err := repo.db.Exec(q, recurringId, reason)
+	return err
+}
+
+// FireRecurringNotification moves the recurring notification to its next run and saves the current
+// run as a pending scheduled notification. It returns false if the run was fired by someone else.
+func (repo *Repository) FireRecurringNotification(recurring model.RecurringNotification, message string, nextRunAt time.Time) (bool, error) {
+	tx, err := repo.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	q := `UPDATE recurring_notifications SET next_run_at = $3 WHERE id = $1 AND next_run_at = $2`
+
+	res, err := tx.Exec(q, recurring.Id, recurring.NextRunAt, nextRunAt)
+	if err != nil {
+		return false, err
+	}
+	count, err := res.RowsAffected()
+	if err != nil {
+		return false, err
 	}
+	if count == 0 {
+		return false, nil
+	}
+
+	if len(recurring.RecipientsId) > 0 {
+		q = `INSERT INTO notifications (sender, sender_id, message, format, send_at, schedule_status)
+			VALUES ($1, $2, $3, $4, $5, $6) RETURNING id`
+
+		var notificationId int64
+		row := tx.QueryRow(q, recurring.Sender, recurring.SenderId, message, formatOrPlain(recurring.Format),
+			recurring.NextRunAt, schedulePending)
+		if err := row.Scan(&notificationId); err != nil {
+			return false, err
+		}
+
+		q = `INSERT INTO notification_recipients (notification_id, recipient_id, status)
+			SELECT $1, unnest($2::bigint[]), $3`
+
+		if _, err := tx.Exec(q, notificationId, pq.Array(recurring.RecipientsId), model.StatusScheduled); err != nil {
+			return false, err
+		}
+	}
+
+	return true, tx.Commit()
+}
+
+func (repo *Repository) CreateTemplate(messageTemplate model.MessageTemplate) (model.MessageTemplate, error) {
+	q := `INSERT INTO message_templates (owner_id, name, body, format) VALUES ($1, $2, $3, $4)
+		RETURNING id, format, created_at, updated_at`
+
+	row := repo.db.QueryRow(q, messageTemplate.OwnerId, messageTemplate.Name, messageTemplate.Body,
+		formatOrPlain(messageTemplate.Format))
+	err := row.Scan(&messageTemplate.Id, &messageTemplate.Format, &messageTemplate.CreatedAt, &messageTemplate.UpdatedAt)
+	if err != nil {
+		if pgErr, ok := err.(*pq.Error); ok && pgErr.Code == uniqueViolation {
+			return messageTemplate, repository.ErrTemplateAlreadyExists
+		}
+		return messageTemplate, err
+	}
+
+	return messageTemplate, nil
+}
+
+func (repo *Repository) GetTemplate(ownerId int64, name string) (model.MessageTemplate, error) {
+	q := `SELECT id, name, body, format, created_at, updated_at FROM message_templates WHERE owner_id = $1 AND name = $2`
+
+	messageTemplate := model.MessageTemplate{OwnerId: ownerId}
+	row := repo.db.QueryRow(q, ownerId, name)
+	err := row.Scan(&messageTemplate.Id, &messageTemplate.Name, &messageTemplate.Body, &messageTemplate.Format,
+		&messageTemplate.CreatedAt, &messageTemplate.UpdatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return messageTemplate, repository.ErrTemplateNotExists
+		}
+		return messageTemplate, err
+	}
+
+	return messageTemplate, nil
+}
+
+func (repo *Repository) ListTemplates(ownerId int64) ([]model.MessageTemplate, error) {
+	q := `SELECT id, name, body, format, created_at, updated_at FROM message_templates WHERE owner_id = $1 ORDER BY name`
+
+	rows, err := repo.db.Query(q, ownerId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	messageTemplates := []model.MessageTemplate{}
+	for rows.Next() {
+		messageTemplate := model.MessageTemplate{OwnerId: ownerId}
+		err := rows.Scan(&messageTemplate.Id, &messageTemplate.Name, &messageTemplate.Body, &messageTemplate.Format,
+			&messageTemplate.CreatedAt, &messageTemplate.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+		messageTemplates = append(messageTemplates, messageTemplate)
+	}
+
+	return messageTemplates, rows.Err()
+}
+
+func (repo *Repository) UpdateTemplate(messageTemplate model.MessageTemplate) (model.MessageTemplate, error) {
+	q := `UPDATE message_templates SET body = $3, format = $4, updated_at = now() WHERE owner_id = $1 AND name = $2
+		RETURNING id, format, created_at, updated_at`
+
+	row := repo.db.QueryRow(q, messageTemplate.OwnerId, messageTemplate.Name, messageTemplate.Body,
+		formatOrPlain(messageTemplate.Format))
+	err := row.Scan(&messageTemplate.Id, &messageTemplate.Format, &messageTemplate.CreatedAt, &messageTemplate.UpdatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return messageTemplate, repository.ErrTemplateNotExists
+		}
+		return messageTemplate, err
+	}
+
+	return messageTemplate, nil
+}
 
-	return userId, nil
+func (repo *Repository) DeleteTemplate(ownerId int64, name string) error {
+	q := `DELETE FROM message_templates WHERE owner_id = $1 AND name = $2`
+
+	res, err := repo.db.Exec(q, ownerId, name)
+	if err != nil {
+		return err
+	}
+	count, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return repository.ErrTemplateNotExists
+	}
+	return nil
+}
+
+func (repo *Repository) SetWebhook(ownerId int64, url string, secret string) error {
+	q := `INSERT INTO webhooks (owner_id, url, secret) VALUES ($1, $2, $3)
+		ON CONFLICT (owner_id) DO UPDATE SET url = excluded.url, secret = excluded.secret, updated_at = now()`
+
+	_, err := repo.db.Exec(q, ownerId, url, secret)
+	return err
+}
+
+func (repo *Repository) GetWebhook(ownerId int64) (string, error) {
+	q := `SELECT url FROM webhooks WHERE owner_id = $1`
+
+	var url string
+	row := repo.db.QueryRow(q, ownerId)
+	if err := row.Scan(&url); err != nil {
+		if err == sql.ErrNoRows {
+			return url, repository.ErrWebhookNotExists
+		}
+		return url, err
+	}
+
+	return url, nil
+}
+
+func (repo *Repository) DeleteWebhook(ownerId int64) error {
+	q := `DELETE FROM webhooks WHERE owner_id = $1`
+
+	res, err := repo.db.Exec(q, ownerId)
+	if err != nil {
+		return err
+	}
+	count, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return repository.ErrWebhookNotExists
+	}
+	return nil
+}
+
+// ReserveIdempotencyKey reserves the key of the owner for the request for the lease. If the key is reserved already
+// and not expired, it returns the saved response of the request, ErrIdempotencyKeyInProgress if there is none yet
+// or ErrIdempotencyKeyReused if the key was used for another request. A key without a response is taken over
+// once its lease is over, as the request holding it has probably failed.
+func (repo *Repository) ReserveIdempotencyKey(ownerId int64, key string, requestHash string, ttl time.Duration,
+	lease time.Duration) (*model.IdempotentResponse, error) {
+	q := `INSERT INTO idempotency_keys (owner_id, key, request_hash, expires_at, reserved_until)
+		VALUES ($1, $2, $3, now() + $4 * interval '1 second', now() + $5 * interval '1 second')
+		ON CONFLICT (owner_id, key) DO UPDATE
+			SET request_hash = excluded.request_hash, status_code = NULL, response = NULL,
+				created_at = now(), expires_at = excluded.expires_at, reserved_until = excluded.reserved_until
+			WHERE idempotency_keys.expires_at <= now()
+				OR (idempotency_keys.status_code IS NULL AND idempotency_keys.reserved_until <= now())
+		RETURNING true`
+
+	var reserved bool
+	err := repo.db.QueryRow(q, ownerId, key, requestHash, ttl.Seconds(), lease.Seconds()).Scan(&reserved)
+	if err == nil {
+		return nil, nil
+	}
+	if err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	q = `SELECT request_hash, status_code, response FROM idempotency_keys WHERE owner_id = $1 AND key = $2`
+
+	var savedHash string
+	var statusCode sql.NullInt64
+	var response []byte
+	if err := repo.db.QueryRow(q, ownerId, key).Scan(&savedHash, &statusCode, &response); err != nil {
+		return nil, err
+	}
+	if savedHash != requestHash {
+		return nil, repository.ErrIdempotencyKeyReused
+	}
+	if !statusCode.Valid {
+		return nil, repository.ErrIdempotencyKeyInProgress
+	}
+	return &model.IdempotentResponse{StatusCode: int(statusCode.Int64), Body: response}, nil
+}
+
+// RenewIdempotencyKey extends the lease of the key reserved by a request which is still handled.
+func (repo *Repository) RenewIdempotencyKey(ownerId int64, key string, lease time.Duration) error {
+	q := `UPDATE idempotency_keys SET reserved_until = now() + $3 * interval '1 second'
+		WHERE owner_id = $1 AND key = $2 AND status_code IS NULL`
+
+	_, err := repo.db.Exec(q, ownerId, key, lease.Seconds())
+	return err
+}
+
+// SaveIdempotentResponse saves the response of the request holding the key. If the key has been taken over
+// meanwhile, the response saved first is kept.
+func (repo *Repository) SaveIdempotentResponse(ownerId int64, key string, statusCode int, response []byte) error {
+	q := `UPDATE idempotency_keys SET status_code = $3, response = $4
+		WHERE owner_id = $1 AND key = $2 AND status_code IS NULL`
+
+	_, err := repo.db.Exec(q, ownerId, key, statusCode, string(response))
+	return err
+}
+
+func (repo *Repository) ReleaseIdempotencyKey(ownerId int64, key string) error {
+	q := `DELETE FROM idempotency_keys WHERE owner_id = $1 AND key = $2 AND status_code IS NULL`
+
+	_, err := repo.db.Exec(q, ownerId, key)
+	return err
+}
+
+func (repo *Repository) DeleteExpiredIdempotencyKeys(now time.Time) (int64, error) {
+	q := `DELETE FROM idempotency_keys WHERE expires_at <= $1`
+
+	res, err := repo.db.Exec(q, now)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// CreateAccessRequest creates a pending request of the requester to be granted access by the recipient.
+// The limits of requests are kept in access_request_limits and shared with the bot.
+func (repo *Repository) CreateAccessRequest(requesterId int64, recipientId int64) (model.AccessRequest, error) {
+	var request model.AccessRequest
+
+	q := `SELECT id, status, created_at, expires_at FROM create_access_request($1, $2)`
+
+	row := repo.db.QueryRow(q, requesterId, recipientId)
+	if err := row.Scan(&request.Id, &request.Status, &request.CreatedAt, &request.ExpiresAt); err != nil {
+		if e, ok := err.(*pq.Error); ok {
+			switch e.Code {
+			case accessAlreadyGranted:
+				return request, repository.ErrAccessAlreadyGranted
+			case accessRequestDenied:
+				return request, repository.ErrAccessRequestDenied
+			case tooManyAccessRequests:
+				return request, repository.ErrTooManyAccessRequests
+			case uniqueViolation:
+				return request, repository.ErrAccessRequestPending
+			}
+		}
+		return request, err
+	}
+
+	return request, nil
+}
+
+// GetAccessRequest returns the access request of the requester.
+func (repo *Repository) GetAccessRequest(requestId int64, requesterId int64) (model.AccessRequest, error) {
+	q := `SELECT r.id, '@' || u.username, r.status, r.created_at, r.expires_at, r.decided_at
+		FROM access_requests r JOIN users u ON u.id = r.recipient_id
+		WHERE r.id = $1 AND r.requester_id = $2`
+
+	var request model.AccessRequest
+	row := repo.db.QueryRow(q, requestId, requesterId)
+	err := row.Scan(&request.Id, &request.Recipient, &request.Status, &request.CreatedAt, &request.ExpiresAt,
+		&request.DecidedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return request, repository.ErrAccessRequestNotExists
+		}
+		return request, err
+	}
+
+	// requests are expired by the bot, which may not have run yet
+	if request.Status == model.AccessRequestPending && !request.ExpiresAt.After(time.Now()) {
+		request.Status = model.AccessRequestExpired
+	}
+	return request, nil
+}
+
+// encodeButtons returns the buttons as json or nil if there are none.
+func encodeButtons(buttons [][]model.Button) (*string, error) {
+	if len(buttons) == 0 {
+		return nil, nil
+	}
+	encoded, err := json.Marshal(buttons)
+	if err != nil {
+		return nil, err
+	}
+	value := string(encoded)
+	return &value, nil
+}
+
+func formatOrPlain(format string) string {
+	if format == "" {
+		return formatting.FormatPlain
+	}
+	return format
 }
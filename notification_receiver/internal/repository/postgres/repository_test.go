@@ -0,0 +1,112 @@
+package postgres
+
+import (
+	"database/sql"
+	"os"
+	"testing"
+	"time"
+
+	"notification_receiver/internal/cache"
+
+	"github.com/rs/zerolog"
+)
+
+// benchmarkRecipients is how many recipients a notification is resolved for
+const benchmarkRecipients = 100
+
+// openBenchmarkRepository connects to the database of BENCHMARK_POSTGRES_DSN and returns usernames
+// of registered users to resolve together with the id of a sender.
+func openBenchmarkRepository(b *testing.B) (*Repository, []string, int64) {
+	dsn, ok := os.LookupEnv("BENCHMARK_POSTGRES_DSN")
+	if !ok {
+		b.Skip("BENCHMARK_POSTGRES_DSN is not set")
+	}
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { db.Close() })
+
+	rows, err := db.Query(`SELECT id, username FROM users WHERE is_active AND username IS NOT NULL LIMIT $1`,
+		benchmarkRecipients)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer rows.Close()
+
+	var senderId int64
+	var userNames []string
+	for rows.Next() {
+		var userName string
+		if err := rows.Scan(&senderId, &userName); err != nil {
+			b.Fatal(err)
+		}
+		userNames = append(userNames, userName)
+	}
+	if err := rows.Err(); err != nil {
+		b.Fatal(err)
+	}
+	if len(userNames) == 0 {
+		b.Skip("there are no registered users")
+	}
+	return NewRepository(db), userNames, senderId
+}
+
+// BenchmarkResolvePerRecipient resolves recipients the way it was done before GetUsers,
+// with two queries for every recipient.
+func BenchmarkResolvePerRecipient(b *testing.B) {
+	repo, userNames, senderId := openBenchmarkRepository(b)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, userName := range userNames {
+			var userId int64
+			row := repo.db.QueryRow(`SELECT id FROM users WHERE username = $1 AND is_active`, userName)
+			if err := row.Scan(&userId); err != nil {
+				b.Fatal(err)
+			}
+
+			var hasAccess bool
+			row = repo.db.QueryRow(`SELECT EXISTS(SELECT 1 FROM notification_access
+				WHERE user_id = $1 AND granted_user_id = $2)`, userId, senderId)
+			if err := row.Scan(&hasAccess); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkResolveBatched(b *testing.B) {
+	repo, userNames, senderId := openBenchmarkRepository(b)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		benchmarkResolve(b, repo, repo, userNames, senderId)
+	}
+}
+
+func BenchmarkResolveCached(b *testing.B) {
+	repo, userNames, senderId := openBenchmarkRepository(b)
+	users := cache.NewUsers(zerolog.Nop(), repo, time.Hour)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		benchmarkResolve(b, repo, users, userNames, senderId)
+	}
+}
+
+func benchmarkResolve(b *testing.B, repo *Repository, users interface {
+	GetUsers(userNames []string) (map[string]int64, error)
+}, userNames []string, senderId int64) {
+	ids, err := users.GetUsers(userNames)
+	if err != nil {
+		b.Fatal(err)
+	}
+	usersId := make([]int64, 0, len(ids))
+	for _, id := range ids {
+		usersId = append(usersId, id)
+	}
+	if _, err := repo.GetNotificationAccess(usersId, senderId); err != nil {
+		b.Fatal(err)
+	}
+}
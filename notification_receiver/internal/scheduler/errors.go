@@ -0,0 +1,7 @@
+package scheduler
+
+import "errors"
+
+var (
+	ErrNeverRuns = errors.New("cron expression never matches")
+)
@@ -0,0 +1,100 @@
+package scheduler
+
+import (
+	"bytes"
+	"fmt"
+	"text/template"
+	"time"
+
+	"notification_receiver/internal/cron"
+	"notification_receiver/internal/formatting"
+)
+
+type recurringData struct {
+	Time time.Time
+}
+
+// NextRun returns the first run of the cron expression in the timezone after the given time.
+func NextRun(expression string, timezone string, after time.Time) (time.Time, error) {
+	schedule, err := cron.Parse(expression)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	location, err := time.LoadLocation(timezone)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	next := schedule.Next(after.In(location))
+	if next.IsZero() {
+		return next, ErrNeverRuns
+	}
+	return next, nil
+}
+
+// RenderMessage executes the message template of a recurring notification for the run at t.
+// The escape function of the template escapes values for the message format.
+func RenderMessage(message string, format string, t time.Time) (string, error) {
+	funcs := template.FuncMap{
+		"escape": func(value interface{}) string {
+			return formatting.Escape(format, fmt.Sprint(value))
+		},
+	}
+	tmpl, err := template.New("message").Option("missingkey=error").Funcs(funcs).Parse(message)
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, recurringData{Time: t}); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// fireRecurring turns due runs of recurring notifications into scheduled notifications,
+// which are then published as usual. Runs missed while the scheduler was down are fired once.
+func (s *Service) fireRecurring() {
+	now := s.clock.Now()
+	notifications, err := s.repo.ListDueRecurringNotifications(now, batchSize)
+	if err != nil {
+		s.logger.Error().Msgf("failed to get due recurring notifications: %v", err)
+		return
+	}
+
+	for _, recurring := range notifications {
+		nextRunAt, err := NextRun(recurring.Cron, recurring.Timezone, now)
+		if err != nil {
+			// it would stay due forever otherwise, taking a place in every batch
+			s.logger.Error().Msgf("failed to get next run of recurring notification %v, it is disabled: %v",
+				recurring.Id, err)
+			reason := fmt.Sprintf("failed to get next run: %v", err)
+			if err := s.repo.DisableRecurringNotification(recurring.Id, reason); err != nil {
+				s.logger.Error().Msgf("failed to disable recurring notification %v: %v", recurring.Id, err)
+			}
+			continue
+		}
+
+		location, _ := time.LoadLocation(recurring.Timezone)
+		message, err := RenderMessage(recurring.Message, recurring.Format, recurring.NextRunAt.In(location))
+		if err == nil {
+			err = formatting.Validate(recurring.Format, message)
+		}
+		if err != nil {
+			// the run is skipped, otherwise it would be fired again and again
+			s.logger.Error().Msgf("failed to render recurring notification %v, the run is skipped: %v", recurring.Id, err)
+			recurring.RecipientsId = nil
+		}
+
+		fired, err := s.repo.FireRecurringNotification(recurring, message, nextRunAt)
+		if err != nil {
+			s.logger.Error().Msgf("failed to fire recurring notification %v: %v", recurring.Id, err)
+			continue
+		}
+		if fired {
+			s.logger.Info().Msgf("fired recurring notification %v to %v recipients, next run at %v",
+				recurring.Id, len(recurring.RecipientsId), nextRunAt)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"notification_receiver/internal/model"
+	notificationPublisher "notification_receiver/internal/publisher"
+
+	"github.com/rs/zerolog"
+)
+
+const (
+	pollInterval = 5 * time.Second
+	// how many due notifications are claimed at once
+	batchSize = 100
+)
+
+type repo interface {
+	ClaimDueNotifications(now time.Time, limit int) ([]model.Notification, error)
+	MarkNotificationPublished(notificationId int64) error
+	ReleaseNotification(notificationId int64) error
+	FailRecipients(notificationId int64, recipientsId []int64, reason string) error
+	ListDueRecurringNotifications(now time.Time, limit int) ([]model.RecurringNotification, error)
+	FireRecurringNotification(recurring model.RecurringNotification, message string, nextRunAt time.Time) (bool, error)
+	DisableRecurringNotification(recurringId int64, reason string) error
+	DeleteExpiredIdempotencyKeys(now time.Time) (int64, error)
+}
+
+type publisher interface {
+	Publish(notification model.Notification) error
+}
+
+// Service publishes scheduled notifications to the queue when they come due
+// and fires recurring notifications.
+type Service struct {
+	logger    zerolog.Logger
+	repo      repo
+	publisher publisher
+	clock     Clock
+}
+
+func NewService(logger zerolog.Logger, repo repo, publisher publisher, clock Clock) *Service {
+	l := logger.With().Str("component", "scheduler").Logger()
+	return &Service{
+		logger:    l,
+		repo:      repo,
+		publisher: publisher,
+		clock:     clock,
+	}
+}
+
+// Run publishes due notifications until the context is done.
+func (s *Service) Run(ctx context.Context) {
+	for {
+		s.deleteExpiredIdempotencyKeys()
+		s.fireRecurring()
+		for s.PublishDue() == batchSize {
+			// there may be more due notifications
+			if ctx.Err() != nil {
+				return
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.clock.After(pollInterval):
+		}
+	}
+}
+
+// PublishDue publishes one batch of due notifications and returns how many were published.
+func (s *Service) PublishDue() int {
+	notifications, err := s.repo.ClaimDueNotifications(s.clock.Now(), batchSize)
+	if err != nil {
+		s.logger.Error().Msgf("failed to get due notifications: %v", err)
+		return 0
+	}
+
+	published := 0
+	for _, notification := range notifications {
+		err := s.publisher.Publish(notification)
+		var unpublished *notificationPublisher.UnpublishedError
+		if errors.As(err, &unpublished) && unpublished.Partial {
+			// the recipients who have got the notification must not get it again, so it is not retried
+			s.logger.Error().Msgf("scheduled notification %v is not published to %v recipients: %v", notification.Id,
+				len(unpublished.RecipientsId), err)
+			s.markPublished(notification.Id)
+			s.failRecipients(notification.Id, unpublished.RecipientsId, err)
+			continue
+		}
+		if err != nil {
+			s.logger.Error().Msgf("failed to publish scheduled notification %v: %v", notification.Id, err)
+			if err := s.repo.ReleaseNotification(notification.Id); err != nil {
+				s.logger.Error().Msgf("failed to release scheduled notification %v: %v", notification.Id, err)
+			}
+			continue
+		}
+
+		if !s.markPublished(notification.Id) {
+			continue
+		}
+		s.logger.Info().Msgf("published scheduled notification %v", notification.Id)
+		published++
+	}
+	return published
+}
+
+func (s *Service) markPublished(notificationId int64) bool {
+	if err := s.repo.MarkNotificationPublished(notificationId); err != nil {
+		s.logger.Error().Msgf("failed to mark scheduled notification %v as published: %v", notificationId, err)
+		return false
+	}
+	return true
+}
+
+func (s *Service) failRecipients(notificationId int64, recipientsId []string, reason error) {
+	ids := make([]int64, 0, len(recipientsId))
+	for _, recipient := range recipientsId {
+		if id, err := strconv.ParseInt(recipient, 10, 64); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	err := s.repo.FailRecipients(notificationId, ids, fmt.Sprintf("failed to publish notification: %v", reason))
+	if err != nil {
+		s.logger.Error().Msgf("failed to mark unpublished recipients of notification %v as failed: %v",
+			notificationId, err)
+	}
+}
+
+func (s *Service) deleteExpiredIdempotencyKeys() {
+	deleted, err := s.repo.DeleteExpiredIdempotencyKeys(s.clock.Now())
+	if err != nil {
+		s.logger.Error().Msgf("failed to delete expired idempotency keys: %v", err)
+		return
+	}
+	if deleted > 0 {
+		s.logger.Info().Msgf("deleted %v expired idempotency keys", deleted)
+	}
+}
@@ -0,0 +1,377 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"notification_receiver/internal/model"
+	notificationPublisher "notification_receiver/internal/publisher"
+
+	"github.com/rs/zerolog"
+)
+
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers chan chan time.Time
+}
+
+func newFakeClock(now time.Time) *fakeClock {
+	return &fakeClock{now: now, timers: make(chan chan time.Time, 1)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	timer := make(chan time.Time, 1)
+	c.timers <- timer
+	return timer
+}
+
+// sleeping waits for the scheduler to sleep and returns its timer.
+func (c *fakeClock) sleeping(t *testing.T) chan time.Time {
+	select {
+	case timer := <-c.timers:
+		return timer
+	case <-time.After(time.Second):
+		t.Fatal("scheduler does not sleep")
+		return nil
+	}
+}
+
+// wake moves the time by d and wakes the scheduler sleeping on the timer up.
+func (c *fakeClock) wake(timer chan time.Time, d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	now := c.now
+	c.mu.Unlock()
+	timer <- now
+}
+
+type fakeRepo struct {
+	mu        sync.Mutex
+	due       []model.Notification
+	recurring []model.RecurringNotification
+
+	claims    []time.Time
+	published []int64
+	released  []int64
+	failed    map[int64][]int64
+	fired     map[int64]time.Time
+	messages  map[int64]string
+	disabled  map[int64]string
+}
+
+func (r *fakeRepo) ClaimDueNotifications(now time.Time, limit int) ([]model.Notification, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.claims = append(r.claims, now)
+
+	var due, rest []model.Notification
+	for _, notification := range r.due {
+		sendAt, _ := time.Parse(time.RFC3339, notification.SendAt)
+		if !sendAt.After(now) && len(due) < limit {
+			due = append(due, notification)
+		} else {
+			rest = append(rest, notification)
+		}
+	}
+	r.due = rest
+	return due, nil
+}
+
+func (r *fakeRepo) MarkNotificationPublished(notificationId int64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.published = append(r.published, notificationId)
+	return nil
+}
+
+func (r *fakeRepo) ReleaseNotification(notificationId int64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.released = append(r.released, notificationId)
+	return nil
+}
+
+func (r *fakeRepo) FailRecipients(notificationId int64, recipientsId []int64, reason string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.failed[notificationId] = append(r.failed[notificationId], recipientsId...)
+	return nil
+}
+
+func (r *fakeRepo) ListDueRecurringNotifications(now time.Time, limit int) ([]model.RecurringNotification, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var due []model.RecurringNotification
+	for _, recurring := range r.recurring {
+		if !recurring.NextRunAt.After(now) {
+			due = append(due, recurring)
+		}
+	}
+	return due, nil
+}
+
+func (r *fakeRepo) FireRecurringNotification(recurring model.RecurringNotification, message string, nextRunAt time.Time) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i := range r.recurring {
+		if r.recurring[i].Id == recurring.Id {
+			r.recurring[i].NextRunAt = nextRunAt
+		}
+	}
+	r.fired[recurring.Id] = nextRunAt
+	r.messages[recurring.Id] = message
+	return true, nil
+}
+
+func (r *fakeRepo) DisableRecurringNotification(recurringId int64, reason string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var enabled []model.RecurringNotification
+	for _, recurring := range r.recurring {
+		if recurring.Id != recurringId {
+			enabled = append(enabled, recurring)
+		}
+	}
+	r.recurring = enabled
+	r.disabled[recurringId] = reason
+	return nil
+}
+
+func (r *fakeRepo) DeleteExpiredIdempotencyKeys(now time.Time) (int64, error) {
+	return 0, nil
+}
+
+func (r *fakeRepo) claimCount() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.claims)
+}
+
+type fakePublisher struct {
+	mu        sync.Mutex
+	fail      map[int64]bool
+	partial   map[int64][]string
+	published []int64
+}
+
+func (p *fakePublisher) Publish(notification model.Notification) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.fail[notification.Id] {
+		return errors.New("broker is down")
+	}
+	if unpublished, ok := p.partial[notification.Id]; ok {
+		return &notificationPublisher.UnpublishedError{
+			Err:          notificationPublisher.ErrInternal,
+			RecipientsId: unpublished,
+			Partial:      true,
+		}
+	}
+	p.published = append(p.published, notification.Id)
+	return nil
+}
+
+func newTestService(now time.Time) (*Service, *fakeClock, *fakeRepo, *fakePublisher) {
+	clock := newFakeClock(now)
+	repo := &fakeRepo{
+		failed:   make(map[int64][]int64),
+		fired:    make(map[int64]time.Time),
+		messages: make(map[int64]string),
+		disabled: make(map[int64]string),
+	}
+	publisher := &fakePublisher{fail: make(map[int64]bool), partial: make(map[int64][]string)}
+	return NewService(zerolog.Nop(), repo, publisher, clock), clock, repo, publisher
+}
+
+func scheduled(id int64, sendAt time.Time) model.Notification {
+	return model.Notification{Id: id, SendAt: sendAt.Format(time.RFC3339), RecipientsId: []string{"1"}}
+}
+
+func TestPublishDue(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	s, _, repo, publisher := newTestService(now)
+	repo.due = []model.Notification{
+		scheduled(1, now.Add(-time.Minute)),
+		scheduled(2, now),
+		scheduled(3, now.Add(time.Second)),
+	}
+	publisher.fail[2] = true
+
+	if published := s.PublishDue(); published != 1 {
+		t.Fatalf("published %v notifications, want 1", published)
+	}
+	if len(repo.claims) != 1 || !repo.claims[0].Equal(now) {
+		t.Fatalf("claimed at %v, want %v", repo.claims, now)
+	}
+	if len(repo.published) != 1 || repo.published[0] != 1 {
+		t.Errorf("marked %v as published, want [1]", repo.published)
+	}
+	// a notification which failed to be published is released to be claimed again
+	if len(repo.released) != 1 || repo.released[0] != 2 {
+		t.Errorf("released %v, want [2]", repo.released)
+	}
+	if len(repo.due) != 1 || repo.due[0].Id != 3 {
+		t.Errorf("notification 3 is due only in a second, left %v", repo.due)
+	}
+}
+
+func TestPublishDuePartly(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	s, _, repo, publisher := newTestService(now)
+	notification := scheduled(1, now)
+	notification.RecipientsId = []string{"10", "11", "12"}
+	repo.due = []model.Notification{notification}
+	publisher.partial[1] = []string{"11", "12"}
+
+	if published := s.PublishDue(); published != 0 {
+		t.Errorf("published %v notifications, want 0", published)
+	}
+	// the notification is not released, so the recipient who has got it does not get it again
+	if len(repo.released) != 0 {
+		t.Errorf("released %v, want none", repo.released)
+	}
+	if len(repo.published) != 1 || repo.published[0] != 1 {
+		t.Errorf("marked %v as published, want [1]", repo.published)
+	}
+	if failed := repo.failed[1]; len(failed) != 2 || failed[0] != 11 || failed[1] != 12 {
+		t.Errorf("failed recipients are %v, want [11 12]", failed)
+	}
+}
+
+func TestRunPublishesWhenDue(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	s, clock, repo, publisher := newTestService(now)
+	repo.due = []model.Notification{scheduled(1, now.Add(pollInterval))}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.Run(ctx)
+		close(done)
+	}()
+
+	clock.wake(clock.sleeping(t), pollInterval-time.Second)
+	timer := clock.sleeping(t)
+	if len(publisher.published) != 0 {
+		t.Fatal("notification is published before it is due")
+	}
+	clock.wake(timer, time.Second)
+	clock.sleeping(t)
+	cancel()
+	<-done
+
+	if count := repo.claimCount(); count != 3 {
+		t.Errorf("claimed %v times, want once per poll", count)
+	}
+	if len(publisher.published) != 1 || publisher.published[0] != 1 {
+		t.Errorf("published %v, want [1]", publisher.published)
+	}
+	if !repo.claims[2].Equal(now.Add(pollInterval)) {
+		t.Errorf("claimed at %v, want %v", repo.claims[2], now.Add(pollInterval))
+	}
+}
+
+func TestRunDrainsFullBatches(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	s, clock, repo, publisher := newTestService(now)
+	for i := 0; i < batchSize+1; i++ {
+		repo.due = append(repo.due, scheduled(int64(i+1), now))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.Run(ctx)
+		close(done)
+	}()
+
+	// all due notifications are published before the first sleep
+	clock.sleeping(t)
+	cancel()
+	<-done
+
+	if len(publisher.published) != batchSize+1 {
+		t.Errorf("published %v notifications, want %v", len(publisher.published), batchSize+1)
+	}
+	if count := repo.claimCount(); count != 2 {
+		t.Errorf("claimed %v times, want 2", count)
+	}
+}
+
+func TestFireRecurring(t *testing.T) {
+	now := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	s, clock, repo, _ := newTestService(now)
+	repo.recurring = []model.RecurringNotification{
+		{
+			Id:        1,
+			Cron:      "0 9 * * *",
+			Timezone:  "UTC",
+			Message:   "report for {{ .Time.Format \"2006-01-02\" }}",
+			NextRunAt: time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC),
+		},
+		{
+			Id:        2,
+			Cron:      "0 12 * * *",
+			Timezone:  "UTC",
+			Message:   "not yet",
+			NextRunAt: time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC),
+		},
+	}
+
+	s.fireRecurring()
+
+	want := time.Date(2024, 3, 2, 9, 0, 0, 0, time.UTC)
+	if next, ok := repo.fired[1]; !ok || !next.Equal(want) {
+		t.Errorf("next run is %v, want %v", next, want)
+	}
+	if message := repo.messages[1]; message != "report for 2024-03-01" {
+		t.Errorf("message is %q, want the time of the due run", message)
+	}
+	if _, ok := repo.fired[2]; ok {
+		t.Error("recurring notification 2 is fired before it is due")
+	}
+
+	// a run missed while the scheduler was down is fired once
+	clock.now = time.Date(2024, 3, 5, 10, 0, 0, 0, time.UTC)
+	s.fireRecurring()
+	want = time.Date(2024, 3, 6, 9, 0, 0, 0, time.UTC)
+	if next := repo.fired[1]; !next.Equal(want) {
+		t.Errorf("next run is %v, want %v", next, want)
+	}
+}
+
+func TestFireRecurringDisablesUnschedulable(t *testing.T) {
+	now := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	s, _, repo, _ := newTestService(now)
+	repo.recurring = []model.RecurringNotification{
+		{
+			Id:        1,
+			Cron:      "0 9 * * *",
+			Timezone:  "Nowhere/Unknown",
+			Message:   "report",
+			NextRunAt: time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC),
+		},
+	}
+
+	s.fireRecurring()
+
+	if reason, ok := repo.disabled[1]; !ok || reason == "" {
+		t.Errorf("recurring notification is not disabled, reason %q", reason)
+	}
+	if _, ok := repo.fired[1]; ok {
+		t.Error("recurring notification without a next run is fired")
+	}
+	if due, _ := repo.ListDueRecurringNotifications(now, batchSize); len(due) != 0 {
+		t.Errorf("%v recurring notifications are still due", len(due))
+	}
+}
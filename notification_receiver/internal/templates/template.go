@@ -0,0 +1,53 @@
+package templates
+
+import (
+	"bytes"
+	"fmt"
+	"text/template"
+
+	"notification_receiver/internal/formatting"
+)
+
+// Recipient is the recipient the template is rendered for, available as .Recipient
+type Recipient struct {
+	Id       int64
+	Username string
+}
+
+// Data is what message templates are executed with. Values given by the sender are available as .Data
+type Data struct {
+	Recipient Recipient
+	Sender    string
+	Data      map[string]interface{}
+}
+
+// Parse parses the message template in the format. Missing values are errors on execution,
+// the escape function of the template escapes values for the format.
+func Parse(body string, format string) (*template.Template, error) {
+	switch format {
+	case "", formatting.FormatPlain, formatting.FormatMarkdownV2, formatting.FormatHTML:
+	default:
+		return nil, formatting.ErrUnknownFormat
+	}
+
+	funcs := template.FuncMap{
+		"escape": func(value interface{}) string {
+			return formatting.Escape(format, fmt.Sprint(value))
+		},
+	}
+	return template.New("message").Option("missingkey=error").Funcs(funcs).Parse(body)
+}
+
+// Render executes the template with the data and validates the message in the format.
+func Render(tmpl *template.Template, format string, data Data) (string, error) {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+
+	message := buf.String()
+	if err := formatting.Validate(format, message); err != nil {
+		return "", err
+	}
+	return message, nil
+}
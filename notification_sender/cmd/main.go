@@ -1,12 +1,22 @@
 package main
 
 import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"notification_sender/internal/consumer"
+	"notification_sender/internal/repository/postgres"
 	"notification_sender/internal/sender"
+	"notification_sender/internal/webhook"
 
 	"github.com/joho/godotenv"
+	_ "github.com/lib/pq"
 	"github.com/rs/zerolog"
 )
 
@@ -19,24 +29,97 @@ func main() {
 		logger.Panic().Msg(err.Error())
 	}
 
-	sendingService, err := sender.NewService(logger)
+	postgresCredentials, err := getPostgresCredentials()
+	if err != nil {
+		logger.Panic().Msgf("failed to get db credentials from env: %v", err)
+	}
+
+	db, err := sql.Open("postgres", postgresCredentials)
+	if err != nil {
+		logger.Panic().Msgf("failed to open db connection: %v", err)
+	}
+	// TODO handle error
+	defer db.Close()
+
+	repository := postgres.NewRepository(db)
+
+	sendingService, err := sender.NewService(logger, repository)
 	if err != nil {
 		logger.Panic().Msgf("failed to connect to telegram api: %v", err)
 	}
 
-	consumerService, err := consumer.NewService(logger, sendingService)
+	// throttling metrics are exposed by expvar on /debug/vars
+	if metricsAddr, ok := os.LookupEnv("METRICS_ADDR"); ok {
+		go func() {
+			logger.Error().Msgf("failed to listen metrics server: %v", http.ListenAndServe(metricsAddr, nil))
+		}()
+	}
+
+	consumerService, err := consumer.NewService(logger, sendingService, repository)
 	if err != nil {
 		logger.Panic().Msgf("failed to connect to rabbitmq: %v", err)
 	}
-	// TODO handle errors
-	defer consumerService.Close()
+	defer func() {
+		if err := consumerService.Close(); err != nil {
+			logger.Error().Msgf("failed to close connection to rabbitmq: %v", err)
+		}
+	}()
+
+	webhookService, err := webhook.NewService(logger, repository, nil, webhook.RealClock())
+	if err != nil {
+		logger.Panic().Msgf("failed to setup webhooks: %v", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 
-	// TODO handle errors
-	consumerService.StartConsuming()
+	webhookDone := make(chan struct{})
+	go func() {
+		defer close(webhookDone)
+		webhookService.Run(ctx)
+	}()
+	defer func() {
+		stop()
+		<-webhookDone
+	}()
+	go consumerService.PruneProcessed(ctx)
 
+	if err := consumerService.StartConsuming(ctx); err != nil {
+		logger.Error().Msgf("failed to consume notifications: %v", err)
+	}
+	logger.Info().Msg("notification sender is stopped")
 }
 
 func initLogger() zerolog.Logger {
 	zerolog.SetGlobalLevel(zerolog.TraceLevel)
 	return zerolog.New(os.Stdout).With().Timestamp().Logger()
 }
+
+func getPostgresCredentials() (string, error) {
+	host, ok := os.LookupEnv("PGHOST")
+	if !ok {
+		return "", errors.New("failed to get PGHOST from env")
+	}
+
+	port, ok := os.LookupEnv("PGPORT")
+	if !ok {
+		return "", errors.New("failed to get PGPORT from env")
+	}
+
+	user, ok := os.LookupEnv("PGUSER")
+	if !ok {
+		return "", errors.New("failed to get PGUSER from env")
+	}
+
+	password, ok := os.LookupEnv("PGPASSWORD")
+	if !ok {
+		return "", errors.New("failed to get PGPASSWORD from env")
+	}
+
+	dbname, ok := os.LookupEnv("PGDATABASE")
+	if !ok {
+		return "", errors.New("failed to get PGDATABASE from env")
+	}
+
+	return fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable", host, port, user, password, dbname), nil
+}
@@ -5,6 +5,7 @@ go 1.17
 require (
 	github.com/go-telegram-bot-api/telegram-bot-api/v5 v5.5.1
 	github.com/joho/godotenv v1.4.0
+	github.com/lib/pq v1.10.6
 	github.com/rs/zerolog v1.27.0
 	github.com/streadway/amqp v1.0.0
 )
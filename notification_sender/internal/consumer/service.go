@@ -1,123 +1,490 @@
 package consumer
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/fnv"
 	"notification_sender/internal/model"
+	"notification_sender/internal/rabbitmq"
 	"os"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/rs/zerolog"
 	"github.com/streadway/amqp"
 )
 
 type sender interface {
-	Send(notification model.Notification) error
+	Send(recipientId int64, notification model.Notification) model.Delivery
+}
+
+type repo interface {
+	UpdateDeliveryStatus(notificationId int64, delivery model.Delivery) error
+	CompleteNotification(notificationId int64) (bool, error)
+	IsMessageProcessed(messageId string) (bool, error)
+	MarkMessageProcessed(messageId string) error
+	DeleteProcessedMessages(before time.Time) (int64, error)
+	DeactivateUser(userId int64) error
+}
+
+type task struct {
+	message      amqp.Delivery
+	notification model.Notification
+}
+
+// confirmedChannel is a channel in confirm mode with its confirmation listeners
+type confirmedChannel struct {
+	channel  *amqp.Channel
+	confirms <-chan amqp.Confirmation
+	returns  <-chan amqp.Return
 }
 
 type Service struct {
-	logger        zerolog.Logger
-	sender        sender
-	rmqConnection *amqp.Connection
-	rmqChannel    *amqp.Channel
-	rmqQueue      *amqp.Queue
+	logger     zerolog.Logger
+	sender     sender
+	repo       repo
+	rmq        *rabbitmq.Connection
+	maxRetries int
+	retryDelay time.Duration
+	workers    int
+	// how long processed messages are kept to drop their repeated deliveries
+	processedTTL time.Duration
+
+	// forwardMu serializes forwarding, so the confirmation of a forwarded message is not taken for another one
+	forwardMu  sync.Mutex
+	forwarding confirmedChannel
 }
 
-func NewService(logger zerolog.Logger, sender sender) (*Service, error) {
+func NewService(logger zerolog.Logger, sender sender, repo repo) (*Service, error) {
 	l := logger.With().Str("component", "consumer").Logger()
 
 	rabbitMqCredentials, err := getRabbitMqCredentials()
 	if err != nil {
 		return nil, err
 	}
-	conn, err := amqp.Dial(rabbitMqCredentials)
+	maxRetries, retryDelay, err := getRetryPolicy()
 	if err != nil {
 		return nil, err
 	}
-
-	channel, err := conn.Channel()
+	workers, err := getWorkersCount()
 	if err != nil {
 		return nil, err
 	}
-
-	queue, err := channel.QueueDeclare(
-		"notification_queue",
-		true,
-		false,
-		false,
-		false,
-		nil,
-	)
+	processedTTL, err := getProcessedMessagesTTL(retryWindow(retryDelay, maxRetries))
 	if err != nil {
 		return nil, err
 	}
-
-	err = channel.Qos(
-		1,
-		0,
-		false,
-	)
+	delays := retryDelays(retryDelay, maxRetries)
+	rmq, err := rabbitmq.Dial(logger, rabbitMqCredentials, func(channel *amqp.Channel) error {
+		if _, err := declareTopology(channel, delays); err != nil {
+			return err
+		}
+		return channel.Qos(
+			workers,
+			0,
+			false,
+		)
+	})
 	if err != nil {
 		return nil, err
 	}
 
 	return &Service{
-		logger:        l,
-		sender:        sender,
-		rmqConnection: conn,
-		rmqChannel:    channel,
-		rmqQueue:      &queue,
+		logger:       l,
+		sender:       sender,
+		repo:         repo,
+		rmq:          rmq,
+		maxRetries:   maxRetries,
+		retryDelay:   retryDelay,
+		workers:      workers,
+		processedTTL: processedTTL,
 	}, nil
 }
 
 func (s *Service) Close() error {
-	// TODO if the channel is closed with an error, the connection will not be closed?
-	err := s.rmqChannel.Close()
-	if err != nil {
-		return err
+	return s.rmq.Close()
+}
+
+// StartConsuming processes notifications until the context is done or the service is closed,
+// resuming consumption after every reconnection to the message broker.
+// On return all received notifications are processed and acknowledged.
+func (s *Service) StartConsuming(ctx context.Context) error {
+	// messages of the same chat always go to the same worker to keep their order
+	workers := make([]chan task, s.workers)
+	var wg sync.WaitGroup
+	for i := range workers {
+		workers[i] = make(chan task, s.workers)
+		wg.Add(1)
+		go func(tasks <-chan task) {
+			defer wg.Done()
+			for t := range tasks {
+				s.handle(t)
+			}
+		}(workers[i])
 	}
-	err = s.rmqConnection.Close()
-	if err != nil {
-		return err
+	defer func() {
+		for _, tasks := range workers {
+			close(tasks)
+		}
+		wg.Wait()
+	}()
+
+	for ctx.Err() == nil {
+		channel, err := s.rmq.Channel(reconnectTimeout)
+		if err == rabbitmq.ErrClosed {
+			return nil
+		}
+		if err != nil {
+			s.logger.Warn().Msgf("waiting for the connection to message broker: %v", err)
+			continue
+		}
+
+		messages, err := channel.Consume(
+			notificationQueue,
+			consumerTag,
+			false,
+			false,
+			false,
+			false,
+			nil,
+		)
+		if err != nil {
+			s.logger.Error().Msgf("failed to start consuming: %v", err)
+			time.Sleep(time.Second)
+			continue
+		}
+
+		if s.consume(ctx, messages, workers) {
+			s.logger.Info().Msg("stop consuming")
+			if err := channel.Cancel(consumerTag, false); err != nil {
+				s.logger.Error().Msgf("failed to cancel consuming: %v", err)
+			}
+			return nil
+		}
+		s.logger.Warn().Msg("consuming is interrupted")
 	}
 	return nil
 }
 
-func (s *Service) StartConsuming() error {
-	messages, err := s.rmqChannel.Consume(
-		s.rmqQueue.Name,
-		"",
-		false,
-		false,
-		false,
-		false,
-		nil,
-	)
-	if err != nil {
-		return err
-	}
+// consume dispatches messages to the workers until the delivery channel is closed
+// or the context is done, in which case it returns true.
+func (s *Service) consume(ctx context.Context, messages <-chan amqp.Delivery, workers []chan task) bool {
+	for {
+		var message amqp.Delivery
+		var ok bool
+		select {
+		case <-ctx.Done():
+			return true
+		case message, ok = <-messages:
+			if !ok {
+				return false
+			}
+		}
 
-	for message := range messages {
 		s.logger.Info().Msgf("received a message from message broker: %s", message.Body)
 		var notification model.Notification
 		err := json.Unmarshal(message.Body, &notification)
 		if err != nil {
-			s.logger.Error().Msgf("failed to decode message %v: %v", message.Body, err)
+			s.logger.Error().Msgf("failed to decode message %s: %v", message.Body, err)
+			// the message will never be decoded, so retries make no sense
+			if err := s.forward(message, deadLetterQueue, attempts(message), err); err != nil {
+				s.logger.Error().Msgf("failed to send response to message broker")
+			}
+			continue
 		}
 
-		err = s.sender.Send(notification)
+		workers[partition(notification, len(workers))] <- task{message: message, notification: notification}
+	}
+}
+
+func (s *Service) handle(t task) {
+	// the broker delivers at least once, so a message may come again after it is processed
+	if s.isProcessed(t.message.MessageId) {
+		s.logger.Warn().Msgf("dropping duplicate message %v", t.message.MessageId)
+		if err := t.message.Ack(false); err != nil {
+			s.logger.Error().Msgf("failed to send response to message broker")
+		}
+		return
+	}
+
+	// a failure of the last attempt is final, the message goes to the dead letter queue then
+	final := attempts(t.message)+1 > s.maxRetries
+
+	err := s.send(t.notification, final)
+	s.complete(t.notification.Id)
+	if err != nil {
+		err = s.retry(t.message, err)
+	} else {
+		s.markProcessed(t.message.MessageId)
+		err = t.message.Ack(false)
+	}
+	if err != nil {
+		s.logger.Error().Msgf("failed to send response to message broker")
+	}
+}
+
+func partition(notification model.Notification, workers int) int {
+	if len(notification.RecipientsId) == 0 {
+		return 0
+	}
+	h := fnv.New32a()
+	h.Write([]byte(notification.RecipientsId[0]))
+	return int(h.Sum32() % uint32(workers))
+}
+
+// retry schedules another delivery attempt with exponential backoff through the retry queues,
+// or moves the message to the dead letter queue once the attempts are exhausted.
+func (s *Service) retry(message amqp.Delivery, reason error) error {
+	attempt := attempts(message) + 1
+	if attempt > s.maxRetries {
+		s.logger.Error().Msgf("notification is moved to the dead letter queue after %v attempts: %v",
+			attempt, reason)
+		return s.forward(message, deadLetterQueue, attempt, reason)
+	}
+
+	delay := retryDelay(s.retryDelay, attempt)
+	s.logger.Warn().Msgf("notification will be retried in %v (attempt %v): %v", delay, attempt, reason)
+	return s.forward(message, retryQueueName(delay), attempt, reason)
+}
+
+// forward publishes the message to the queue with the attempt and the error in its headers and acknowledges it
+// once the broker confirms the publishing, or requeues it if it can not be published.
+func (s *Service) forward(message amqp.Delivery, queue string, attempt int, reason error) error {
+	headers := amqp.Table{}
+	for k, v := range message.Headers {
+		headers[k] = v
+	}
+	headers[attemptHeader] = int32(attempt)
+	headers[errorHeader] = reason.Error()
+
+	publishing := amqp.Publishing{
+		Headers:      headers,
+		ContentType:  message.ContentType,
+		DeliveryMode: amqp.Persistent,
+		MessageId:    message.MessageId,
+		Body:         message.Body,
+	}
+
+	if err := s.publishConfirmed(queue, publishing); err != nil {
+		s.logger.Error().Msgf("failed to publish notification to %v: %v", queue, err)
+		return message.Nack(false, true)
+	}
+	return message.Ack(false)
+}
+
+// publishConfirmed publishes the message to the queue and waits for the broker to confirm it.
+// The channel is opened on first use and reopened after it fails.
+func (s *Service) publishConfirmed(queue string, publishing amqp.Publishing) error {
+	s.forwardMu.Lock()
+	defer s.forwardMu.Unlock()
+
+	if s.forwarding.channel == nil {
+		channel, err := s.rmq.NewChannel()
 		if err != nil {
-			err = message.Nack(false, true)
-		} else {
-			err = message.Ack(false)
+			return err
+		}
+		if err := channel.Confirm(false); err != nil {
+			channel.Close()
+			return err
 		}
+		s.forwarding = confirmedChannel{
+			channel:  channel,
+			confirms: channel.NotifyPublish(make(chan amqp.Confirmation, 1)),
+			returns:  channel.NotifyReturn(make(chan amqp.Return, 1)),
+		}
+	}
+	current := s.forwarding
+
+	if err := current.channel.Publish("", queue, true, false, publishing); err != nil {
+		s.closeForwarding()
+		return err
+	}
+
+	timer := time.NewTimer(confirmTimeout)
+	defer timer.Stop()
+	select {
+	case confirm, ok := <-current.confirms:
+		if !ok {
+			s.closeForwarding()
+			return errors.New("channel is closed before the message is confirmed")
+		}
+		if !confirm.Ack {
+			return errors.New("message broker rejected the message")
+		}
+	case <-timer.C:
+		// a late confirmation would be taken for the next message, so the channel is not used anymore
+		s.closeForwarding()
+		return errors.New("timed out waiting for message broker to confirm the message")
+	}
+
+	// the broker sends the return of an unroutable message before its confirmation
+	select {
+	case returned := <-current.returns:
+		return fmt.Errorf("message is unroutable: %v", returned.ReplyText)
+	default:
+	}
+	return nil
+}
+
+func (s *Service) closeForwarding() {
+	s.forwarding.channel.Close()
+	s.forwarding = confirmedChannel{}
+}
+
+func (s *Service) send(notification model.Notification, final bool) error {
+	for _, recipient := range notification.RecipientsId {
+		id, err := strconv.ParseInt(recipient, 10, 64)
 		if err != nil {
-			s.logger.Error().Msgf("failed to send response to message broker")
+			s.logger.Error().Msgf("failed to parse recipient id %v: %v", recipient, err)
+			continue
+		}
+
+		delivery := s.sender.Send(id, notification)
+		if delivery.Status == model.StatusFailed && delivery.Retryable && !final {
+			delivery.Status = model.StatusRetrying
+		}
+		s.updateDeliveryStatus(notification.Id, delivery)
+		if delivery.Status == model.StatusBlocked {
+			s.deactivate(id)
+		}
+		if delivery.Status != model.StatusSent && delivery.Retryable {
+			return fmt.Errorf("failed to deliver notification to %v: %v", id, delivery.Reason)
 		}
 	}
 	return nil
 }
 
+func (s *Service) updateDeliveryStatus(notificationId int64, delivery model.Delivery) {
+	// notifications published before status tracking have no id
+	if notificationId == 0 {
+		return
+	}
+	if err := s.repo.UpdateDeliveryStatus(notificationId, delivery); err != nil {
+		s.logger.Error().Msgf("failed to update delivery status of notification %v for %v: %v",
+			notificationId, delivery.RecipientId, err)
+	}
+}
+
+// deactivate deactivates the user who has blocked the bot, the user comes back with /start.
+func (s *Service) deactivate(userId int64) {
+	if err := s.repo.DeactivateUser(userId); err != nil {
+		s.logger.Error().Msgf("failed to deactivate user %v: %v", userId, err)
+		return
+	}
+	s.logger.Info().Msgf("user %v has blocked the bot and is deactivated", userId)
+}
+
+func (s *Service) isProcessed(messageId string) bool {
+	if messageId == "" {
+		return false
+	}
+	processed, err := s.repo.IsMessageProcessed(messageId)
+	if err != nil {
+		// sending twice is better than not sending at all
+		s.logger.Error().Msgf("failed to check if message %v is processed: %v", messageId, err)
+		return false
+	}
+	return processed
+}
+
+func (s *Service) markProcessed(messageId string) {
+	if messageId == "" {
+		return
+	}
+	if err := s.repo.MarkMessageProcessed(messageId); err != nil {
+		s.logger.Error().Msgf("failed to mark message %v as processed: %v", messageId, err)
+	}
+}
+
+// PruneProcessed deletes processed messages older than their ttl every pruneInterval until the context is done.
+func (s *Service) PruneProcessed(ctx context.Context) {
+	for {
+		deleted, err := s.repo.DeleteProcessedMessages(time.Now().Add(-s.processedTTL))
+		if err != nil {
+			s.logger.Error().Msgf("failed to delete processed messages: %v", err)
+		} else if deleted > 0 {
+			s.logger.Info().Msgf("deleted %v processed messages", deleted)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(pruneInterval):
+		}
+	}
+}
+
+// complete schedules the summary of the notification for the webhook of the sender
+// once the notification is delivered to all recipients or failed for them.
+func (s *Service) complete(notificationId int64) {
+	if notificationId == 0 {
+		return
+	}
+	completed, err := s.repo.CompleteNotification(notificationId)
+	if err != nil {
+		s.logger.Error().Msgf("failed to complete notification %v: %v", notificationId, err)
+		return
+	}
+	if completed {
+		s.logger.Info().Msgf("notification %v is completed", notificationId)
+	}
+}
+
+func getWorkersCount() (int, error) {
+	workers := 10
+	if value, ok := os.LookupEnv("SENDER_WORKERS"); ok {
+		var err error
+		workers, err = strconv.Atoi(value)
+		if err != nil || workers < 1 {
+			return 0, fmt.Errorf("failed to parse SENDER_WORKERS: %v", value)
+		}
+	}
+	return workers, nil
+}
+
+// getProcessedMessagesTTL returns how long processed messages are kept. Repeated deliveries come within
+// the retry window, or later when dead lettered messages are moved back to the queue, so the ttl
+// must exceed the window and should cover how long dead letters may wait to be replayed.
+func getProcessedMessagesTTL(retryWindow time.Duration) (time.Duration, error) {
+	ttl := 7 * 24 * time.Hour
+	if value, ok := os.LookupEnv("PROCESSED_MESSAGES_TTL"); ok {
+		var err error
+		ttl, err = time.ParseDuration(value)
+		if err != nil {
+			return 0, fmt.Errorf("failed to parse PROCESSED_MESSAGES_TTL: %v", value)
+		}
+	}
+	if ttl <= retryWindow {
+		return 0, fmt.Errorf("PROCESSED_MESSAGES_TTL must exceed the retry window of %v", retryWindow)
+	}
+	return ttl, nil
+}
+
+func getRetryPolicy() (int, time.Duration, error) {
+	maxRetries := 5
+	if value, ok := os.LookupEnv("NOTIFICATION_MAX_RETRIES"); ok {
+		var err error
+		maxRetries, err = strconv.Atoi(value)
+		if err != nil || maxRetries < 0 {
+			return 0, 0, fmt.Errorf("failed to parse NOTIFICATION_MAX_RETRIES: %v", value)
+		}
+	}
+
+	retryDelay := time.Second
+	if value, ok := os.LookupEnv("NOTIFICATION_RETRY_DELAY"); ok {
+		var err error
+		retryDelay, err = time.ParseDuration(value)
+		if err != nil || retryDelay <= 0 {
+			return 0, 0, fmt.Errorf("failed to parse NOTIFICATION_RETRY_DELAY: %v", value)
+		}
+	}
+
+	return maxRetries, retryDelay, nil
+}
+
 func getRabbitMqCredentials() (string, error) {
 	username, ok := os.LookupEnv("RABBITMQ_USERNAME")
 	if !ok {
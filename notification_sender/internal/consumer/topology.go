@@ -0,0 +1,122 @@
+package consumer
+
+import (
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+const (
+	maxRetryDelay = time.Hour
+	// how long to wait for the reconnection to message broker before checking again
+	reconnectTimeout = time.Minute
+	// how long to wait for message broker to confirm a forwarded message
+	confirmTimeout = 10 * time.Second
+	// how often processed messages are pruned
+	pruneInterval = time.Hour
+)
+
+const (
+	notificationQueue = "notification_queue"
+	retryQueue        = "notification_retry"
+	deadLetterQueue   = "notification_dlq"
+
+	consumerTag = "notification_sender"
+
+	attemptHeader = "x-attempt"
+	errorHeader   = "x-error"
+)
+
+// declareTopology declares the main queue, the dead letter queue and a retry queue for every delay, whose messages
+// expire after the delay back to the main queue. A queue expires messages only from its head, so every delay
+// has its own queue and short delays do not wait behind long ones.
+func declareTopology(channel *amqp.Channel, retryDelays []time.Duration) (amqp.Queue, error) {
+	_, err := channel.QueueDeclare(
+		deadLetterQueue,
+		true,
+		false,
+		false,
+		false,
+		nil,
+	)
+	if err != nil {
+		return amqp.Queue{}, err
+	}
+
+	for _, delay := range retryDelays {
+		_, err = channel.QueueDeclare(
+			retryQueueName(delay),
+			true,
+			false,
+			false,
+			false,
+			amqp.Table{
+				"x-message-ttl":             delay.Milliseconds(),
+				"x-dead-letter-exchange":    "",
+				"x-dead-letter-routing-key": notificationQueue,
+			},
+		)
+		if err != nil {
+			return amqp.Queue{}, err
+		}
+	}
+
+	return channel.QueueDeclare(
+		notificationQueue,
+		true,
+		false,
+		false,
+		false,
+		nil,
+	)
+}
+
+// retryQueueName returns the name of the retry queue of the delay, e.g. notification_retry_30s.
+func retryQueueName(delay time.Duration) string {
+	return retryQueue + "_" + delay.String()
+}
+
+// retryDelays returns the distinct delays of the attempts, which double from the first one up to maxRetryDelay.
+func retryDelays(first time.Duration, maxRetries int) []time.Duration {
+	var delays []time.Duration
+	for attempt := 1; attempt <= maxRetries; attempt++ {
+		delay := retryDelay(first, attempt)
+		if len(delays) > 0 && delays[len(delays)-1] == delay {
+			break
+		}
+		delays = append(delays, delay)
+	}
+	return delays
+}
+
+// retryWindow returns how long a message may be retried for after its first attempt.
+func retryWindow(first time.Duration, maxRetries int) time.Duration {
+	var window time.Duration
+	for attempt := 1; attempt <= maxRetries; attempt++ {
+		window += retryDelay(first, attempt)
+	}
+	return window
+}
+
+// retryDelay returns how long to wait before the attempt, counted from 1.
+func retryDelay(first time.Duration, attempt int) time.Duration {
+	delay := first
+	for i := 1; i < attempt && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+	return delay
+}
+
+func attempts(message amqp.Delivery) int {
+	switch v := message.Headers[attemptHeader].(type) {
+	case int32:
+		return int(v)
+	case int64:
+		return int(v)
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,165 @@
+package formatting
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	FormatPlain      = "plain"
+	FormatMarkdownV2 = "markdown_v2"
+	FormatHTML       = "html"
+
+	// MaxMessageLength is the telegram limit of a text message in UTF-16 code units
+	MaxMessageLength = 4096
+	// MaxCaptionLength is the telegram limit of a media caption in UTF-16 code units
+	MaxCaptionLength = 1024
+	// MaxTextLength is the limit of a text split into messages in UTF-16 code units
+	MaxTextLength = 16 * MaxMessageLength
+)
+
+// ParseMode returns the telegram parse mode of the format.
+func ParseMode(format string) string {
+	switch format {
+	case FormatMarkdownV2:
+		return "MarkdownV2"
+	case FormatHTML:
+		return "HTML"
+	default:
+		return ""
+	}
+}
+
+// Validate checks that the text is well-formed in the format and can be split into messages.
+func Validate(format string, text string) error {
+	if strings.TrimSpace(text) == "" {
+		return ErrEmptyMessage
+	}
+	_, err := Split(format, text, MaxMessageLength)
+	return err
+}
+
+// Escape escapes the text so it is shown as is in the format.
+func Escape(format string, text string) string {
+	switch format {
+	case FormatMarkdownV2:
+		var b strings.Builder
+		for _, r := range text {
+			if r < utf8.RuneSelf && strings.IndexByte(markdownReserved, byte(r)) >= 0 {
+				b.WriteByte('\\')
+			}
+			b.WriteRune(r)
+		}
+		return b.String()
+	case FormatHTML:
+		return htmlEscaper.Replace(text)
+	default:
+		return text
+	}
+}
+
+// Split splits the text into parts of at most limit UTF-16 code units. Parts are cut outside
+// of entities, preferably at line breaks, then at spaces. Texts longer than MaxTextLength are rejected.
+func Split(format string, text string, limit int) ([]string, error) {
+	if Length(text) > MaxTextLength {
+		return nil, ErrTooLong
+	}
+
+	var safe []int
+	var err error
+	switch format {
+	case "", FormatPlain:
+		safe = plainBoundaries(text)
+	case FormatMarkdownV2:
+		safe, err = markdownBoundaries(text)
+	case FormatHTML:
+		safe, err = htmlBoundaries(text)
+	default:
+		return nil, ErrUnknownFormat
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// boundaries always start at 0 and end at len(text), so the length of a part between any two of them
+	// is the difference of their offsets
+	offsets := utf16Offsets(text, safe)
+	total := offsets[len(offsets)-1]
+
+	var parts []string
+	start := 0 // index of the boundary the current part starts at
+	for total-offsets[start] > limit {
+		end, cut := -1, -1
+		for p := start + 1; p < len(safe) && offsets[p]-offsets[start] <= limit; p++ {
+			if safe[p] <= safe[start] {
+				continue
+			}
+			end = p
+			switch text[safe[p]-1] {
+			case '\n':
+				cut = p
+			case ' ':
+				if cut < 0 || text[safe[cut]-1] != '\n' {
+					cut = p
+				}
+			}
+		}
+		if cut < 0 {
+			cut = end
+		}
+		if cut < 0 {
+			return nil, ErrUnsplittable
+		}
+
+		part := strings.TrimSuffix(strings.TrimSuffix(text[safe[start]:safe[cut]], "\n"), " ")
+		if strings.TrimSpace(part) != "" {
+			parts = append(parts, part)
+		}
+		start = cut
+	}
+	if rest := text[safe[start]:]; strings.TrimSpace(rest) != "" {
+		parts = append(parts, rest)
+	}
+	return parts, nil
+}
+
+// utf16Offsets returns the offsets in UTF-16 code units of the ascending byte offsets of the text.
+func utf16Offsets(text string, byteOffsets []int) []int {
+	offsets := make([]int, len(byteOffsets))
+	i, n := 0, 0
+	for j, offset := range byteOffsets {
+		for i < offset {
+			r, size := utf8.DecodeRuneInString(text[i:])
+			n += runeLength(r)
+			i += size
+		}
+		offsets[j] = n
+	}
+	return offsets
+}
+
+func plainBoundaries(text string) []int {
+	safe := make([]int, 0, len(text)+1)
+	for i := range text {
+		safe = append(safe, i)
+	}
+	return append(safe, len(text))
+}
+
+// Length returns the length of the text as telegram counts it, in UTF-16 code units.
+func Length(s string) int {
+	n := 0
+	for _, r := range s {
+		n += runeLength(r)
+	}
+	return n
+}
+
+// runeLength returns the number of UTF-16 code units of the rune, runes outside of
+// the basic multilingual plane are encoded as surrogate pairs.
+func runeLength(r rune) int {
+	if r >= 0x10000 {
+		return 2
+	}
+	return 1
+}
@@ -0,0 +1,115 @@
+package formatting
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// characters which must be escaped in MarkdownV2 outside of entities markup
+const markdownReserved = "_*[]()~`>#+-=|{}.!\\"
+
+// markdownBoundaries validates MarkdownV2 text and returns the byte offsets outside of entities.
+func markdownBoundaries(text string) ([]int, error) {
+	var safe []int
+	var stack []string
+
+	top := func() string {
+		if len(stack) == 0 {
+			return ""
+		}
+		return stack[len(stack)-1]
+	}
+	toggle := func(token string) error {
+		if top() == token {
+			stack = stack[:len(stack)-1]
+			return nil
+		}
+		for _, open := range stack {
+			if open == token {
+				return fmt.Errorf("%w: %q is closed before the inner entity", ErrMalformed, token)
+			}
+		}
+		stack = append(stack, token)
+		return nil
+	}
+
+	for i := 0; i < len(text); {
+		if len(stack) == 0 {
+			safe = append(safe, i)
+		}
+
+		c := text[i]
+		if c == '\\' {
+			if i+1 >= len(text) {
+				return nil, fmt.Errorf("%w: trailing backslash", ErrMalformed)
+			}
+			_, size := utf8.DecodeRuneInString(text[i+1:])
+			i += 1 + size
+			continue
+		}
+
+		switch top() {
+		case "```", "`":
+			// only ` and \ are special inside code
+			if strings.HasPrefix(text[i:], top()) {
+				i += len(top())
+				stack = stack[:len(stack)-1]
+			} else {
+				i++
+			}
+			continue
+		case "(":
+			// only ) and \ are special inside link urls
+			if c == ')' {
+				stack = stack[:len(stack)-1]
+			}
+			i++
+			continue
+		}
+
+		var err error
+		switch {
+		case strings.HasPrefix(text[i:], "```"):
+			stack = append(stack, "```")
+			i += 3
+		case c == '`':
+			stack = append(stack, "`")
+			i++
+		case strings.HasPrefix(text[i:], "__"):
+			err = toggle("__")
+			i += 2
+		case strings.HasPrefix(text[i:], "||"):
+			err = toggle("||")
+			i += 2
+		case c == '_' || c == '*' || c == '~':
+			err = toggle(string(c))
+			i++
+		case c == '[':
+			stack = append(stack, "[")
+			i++
+		case c == ']':
+			if top() != "[" || !strings.HasPrefix(text[i:], "](") {
+				return nil, fmt.Errorf("%w: unexpected ] at %v, must be escaped", ErrMalformed, i)
+			}
+			stack[len(stack)-1] = "("
+			i += 2
+		case c == '>' && (i == 0 || text[i-1] == '\n'):
+			// block quotation
+			i++
+		case strings.IndexByte(markdownReserved, c) >= 0:
+			return nil, fmt.Errorf("%w: character %q at %v must be escaped", ErrMalformed, c, i)
+		default:
+			_, size := utf8.DecodeRuneInString(text[i:])
+			i += size
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(stack) > 0 {
+		return nil, fmt.Errorf("%w: entity %q is not closed", ErrMalformed, top())
+	}
+	return append(safe, len(text)), nil
+}
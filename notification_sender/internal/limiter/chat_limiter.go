@@ -0,0 +1,57 @@
+package limiter
+
+import (
+	"sync"
+	"time"
+)
+
+// chats which have not been written to for this long are forgotten
+const chatIdleTimeout = time.Minute
+
+// ChatLimiter keeps a minimum interval between messages sent to the same chat.
+type ChatLimiter struct {
+	mu        sync.Mutex
+	interval  time.Duration
+	nextSend  map[int64]time.Time
+	lastPrune time.Time
+}
+
+func NewChatLimiter(interval time.Duration) *ChatLimiter {
+	return &ChatLimiter{
+		interval:  interval,
+		nextSend:  make(map[int64]time.Time),
+		lastPrune: time.Now(),
+	}
+}
+
+// Wait blocks until a message can be sent to the chat and returns how long it waited.
+func (l *ChatLimiter) Wait(chatId int64) time.Duration {
+	l.mu.Lock()
+	now := time.Now()
+	l.prune(now)
+
+	sendAt := now
+	if next, ok := l.nextSend[chatId]; ok && next.After(now) {
+		sendAt = next
+	}
+	l.nextSend[chatId] = sendAt.Add(l.interval)
+	l.mu.Unlock()
+
+	delay := sendAt.Sub(now)
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+	return delay
+}
+
+func (l *ChatLimiter) prune(now time.Time) {
+	if now.Sub(l.lastPrune) < chatIdleTimeout {
+		return
+	}
+	for chatId, next := range l.nextSend {
+		if now.Sub(next) > chatIdleTimeout {
+			delete(l.nextSend, chatId)
+		}
+	}
+	l.lastPrune = now
+}
@@ -0,0 +1,68 @@
+package limiter
+
+import (
+	"sync"
+	"time"
+)
+
+// Limiter is a token bucket limiter which can additionally be paused,
+// e.g. when telegram asks to retry after some time.
+type Limiter struct {
+	mu          sync.Mutex
+	rate        float64
+	burst       float64
+	tokens      float64
+	last        time.Time
+	pausedUntil time.Time
+}
+
+func NewLimiter(perSecond float64, burst int) *Limiter {
+	return &Limiter{
+		rate:   perSecond,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// Wait blocks until a token is available and returns how long it waited.
+func (l *Limiter) Wait() time.Duration {
+	l.mu.Lock()
+	now := time.Now()
+	l.refill(now)
+
+	var delay time.Duration
+	if now.Before(l.pausedUntil) {
+		delay = l.pausedUntil.Sub(now)
+	}
+	l.tokens--
+	if l.tokens < 0 {
+		if d := time.Duration(-l.tokens / l.rate * float64(time.Second)); d > delay {
+			delay = d
+		}
+	}
+	l.mu.Unlock()
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+	return delay
+}
+
+// Pause stops handing out tokens for the given duration.
+func (l *Limiter) Pause(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if until := time.Now().Add(d); until.After(l.pausedUntil) {
+		l.pausedUntil = until
+	}
+}
+
+func (l *Limiter) refill(now time.Time) {
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+}
@@ -1,7 +1,96 @@
 package model
 
+import "time"
+
+const (
+	StatusScheduled = "scheduled"
+	StatusQueued    = "queued"
+	StatusRetrying  = "retrying"
+	StatusSent      = "sent"
+	StatusFailed    = "failed"
+	StatusBlocked   = "blocked"
+)
+
 type Notification struct {
+	Id           int64    `json:"id"`
 	Sender       string   `json:"sender"`
 	RecipientsId []string `json:"recipients"`
 	Message      string   `json:"message"`
+	// Format is one of plain, markdown_v2 or html, plain by default
+	Format      string       `json:"format,omitempty"`
+	Attachments []Attachment `json:"attachments,omitempty"`
+	// Buttons are rows of the inline keyboard of the message
+	Buttons [][]Button `json:"buttons,omitempty"`
+}
+
+// Button opens Url or sends the callback "notificationId:Action" to the bot.
+type Button struct {
+	Text   string `json:"text"`
+	Url    string `json:"url,omitempty"`
+	Action string `json:"action,omitempty"`
+}
+
+const (
+	AttachmentPhoto    = "photo"
+	AttachmentDocument = "document"
+)
+
+// Attachment is sent by FileId if telegram already has it, otherwise it is loaded
+// from the database and uploaded by Url or Data.
+type Attachment struct {
+	Id       int64  `json:"id"`
+	Type     string `json:"type"`
+	FileId   string `json:"file_id,omitempty"`
+	FileName string `json:"file_name,omitempty"`
+	Url      string `json:"-"`
+	Data     []byte `json:"-"`
+}
+
+type Delivery struct {
+	RecipientId int64
+	Status      string
+	MessageId   int
+	Reason      string
+	// Retryable is false for errors which will not go away on retry, e.g. the bot is blocked
+	Retryable bool
+}
+
+const (
+	WebhookPending   = "pending"
+	WebhookDelivered = "delivered"
+	WebhookFailed    = "failed"
+)
+
+// NotificationSummary is posted to the webhook of the sender once all recipients of the notification
+// have got it or failed to. A notification whose recipients are retried later, e.g. from the dead letter queue,
+// is completed again and gets another summary with a later CompletedAt.
+type NotificationSummary struct {
+	Event          string             `json:"event"`
+	NotificationId int64              `json:"notificationId"`
+	Sender         string             `json:"sender"`
+	CompletedAt    time.Time          `json:"completedAt"`
+	Recipients     []RecipientSummary `json:"recipients"`
+}
+
+type RecipientSummary struct {
+	UserName          string  `json:"username"`
+	Status            string  `json:"status"`
+	TelegramMessageId *int64  `json:"telegramMessageId,omitempty"`
+	Error             *string `json:"error,omitempty"`
+}
+
+// WebhookDelivery is a request to a webhook, retried until it succeeds or runs out of attempts.
+type WebhookDelivery struct {
+	Id             int64
+	NotificationId int64
+	Url            string
+	Secret         string
+	Payload        []byte
+	Status         string
+	Attempts       int
+	ResponseCode   int
+	Error          string
+	NextAttemptAt  time.Time
+	// ClaimedUntil is when the claim of the delivery expires, it identifies the claim
+	ClaimedUntil time.Time
 }
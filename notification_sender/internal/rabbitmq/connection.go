@@ -0,0 +1,192 @@
+package rabbitmq
+
+import (
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/streadway/amqp"
+)
+
+const (
+	minReconnectDelay = time.Second
+	maxReconnectDelay = 30 * time.Second
+)
+
+// SetupFunc is called on every new channel, e.g. to declare the topology.
+type SetupFunc func(channel *amqp.Channel) error
+
+// Connection keeps a connection and a channel to the message broker open,
+// reconnecting with backoff whenever either of them is closed.
+type Connection struct {
+	logger zerolog.Logger
+	url    string
+	setup  SetupFunc
+
+	mu      sync.RWMutex
+	conn    *amqp.Connection
+	channel *amqp.Channel
+	// ready is closed while the connection is established
+	ready chan struct{}
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// Dial connects to the message broker. The first connection attempt must succeed,
+// later disconnects are handled in background.
+func Dial(logger zerolog.Logger, url string, setup SetupFunc) (*Connection, error) {
+	c := &Connection{
+		logger: logger.With().Str("component", "rabbitmq").Logger(),
+		url:    url,
+		setup:  setup,
+		ready:  make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+
+	conn, channel, err := c.connect()
+	if err != nil {
+		return nil, err
+	}
+	go c.watch(conn, channel)
+
+	return c, nil
+}
+
+// Channel returns the current channel, waiting up to timeout for the reconnection.
+func (c *Connection) Channel(timeout time.Duration) (*amqp.Channel, error) {
+	c.mu.RLock()
+	ready := c.ready
+	c.mu.RUnlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-ready:
+	case <-c.done:
+		return nil, ErrClosed
+	case <-timer.C:
+		return nil, ErrDisconnected
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.channel == nil {
+		return nil, ErrDisconnected
+	}
+	return c.channel, nil
+}
+
+// NewChannel opens an additional channel on the current connection.
+// The caller is responsible for closing it.
+func (c *Connection) NewChannel() (*amqp.Channel, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.conn == nil {
+		return nil, ErrDisconnected
+	}
+	return c.conn.Channel()
+}
+
+func (c *Connection) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+	})
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var err error
+	if c.channel != nil {
+		err = c.channel.Close()
+	}
+	if c.conn != nil {
+		if connErr := c.conn.Close(); err == nil {
+			err = connErr
+		}
+	}
+	c.conn, c.channel = nil, nil
+	return err
+}
+
+func (c *Connection) connect() (*amqp.Connection, *amqp.Channel, error) {
+	conn, err := amqp.Dial(c.url)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	channel, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	if err := c.setup(channel); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	select {
+	case <-c.done:
+		conn.Close()
+		return nil, nil, ErrClosed
+	default:
+	}
+	c.conn, c.channel = conn, channel
+	close(c.ready)
+
+	return conn, channel, nil
+}
+
+func (c *Connection) watch(conn *amqp.Connection, channel *amqp.Channel) {
+	for {
+		connClosed := conn.NotifyClose(make(chan *amqp.Error, 1))
+		channelClosed := channel.NotifyClose(make(chan *amqp.Error, 1))
+
+		select {
+		case <-c.done:
+			return
+		case err := <-connClosed:
+			c.logger.Error().Msgf("connection to message broker is closed: %v", err)
+		case err := <-channelClosed:
+			c.logger.Error().Msgf("channel to message broker is closed: %v", err)
+			conn.Close()
+		}
+
+		c.mu.Lock()
+		c.conn, c.channel = nil, nil
+		c.ready = make(chan struct{})
+		c.mu.Unlock()
+
+		var ok bool
+		conn, channel, ok = c.reconnect()
+		if !ok {
+			return
+		}
+	}
+}
+
+func (c *Connection) reconnect() (*amqp.Connection, *amqp.Channel, bool) {
+	delay := minReconnectDelay
+	for {
+		select {
+		case <-c.done:
+			return nil, nil, false
+		case <-time.After(delay):
+		}
+
+		conn, channel, err := c.connect()
+		if err == nil {
+			c.logger.Info().Msg("reconnected to message broker")
+			return conn, channel, true
+		}
+
+		if delay *= 2; delay > maxReconnectDelay {
+			delay = maxReconnectDelay
+		}
+		c.logger.Error().Msgf("failed to reconnect to message broker, next attempt in %v: %v", delay, err)
+	}
+}
@@ -0,0 +1,279 @@
+package postgres
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"notification_sender/internal/model"
+
+	"github.com/lib/pq"
+)
+
+const (
+	eventDeliverySummary = "delivery_summary"
+
+	// webhook deliveries claimed longer ago are claimed again
+	webhookClaimTimeout = 5 * time.Minute
+)
+
+type Repository struct {
+	db *sql.DB
+}
+
+func NewRepository(db *sql.DB) *Repository {
+	return &Repository{db: db}
+}
+
+// UpdateDeliveryStatus saves the delivery to the recipient. A completed notification whose recipient
+// changes the status, e.g. when it is retried from the dead letter queue, is no longer completed,
+// so it is completed again with an updated summary.
+func (repo *Repository) UpdateDeliveryStatus(notificationId int64, delivery model.Delivery) error {
+	tx, err := repo.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	q := `UPDATE notifications SET completed_at = NULL
+		WHERE id = $1 AND completed_at IS NOT NULL AND EXISTS(
+			SELECT 1 FROM notification_recipients WHERE notification_id = $1 AND recipient_id = $2 AND status <> $3)`
+
+	if _, err := tx.Exec(q, notificationId, delivery.RecipientId, delivery.Status); err != nil {
+		return err
+	}
+
+	q = `UPDATE notification_recipients
+		SET status = $3, telegram_message_id = COALESCE(NULLIF($4, 0), telegram_message_id), error = NULLIF($5, ''),
+			updated_at = now()
+		WHERE notification_id = $1 AND recipient_id = $2`
+
+	_, err = tx.Exec(q, notificationId, delivery.RecipientId, delivery.Status, delivery.MessageId, delivery.Reason)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// GetSentParts returns how many parts of the notification are sent to the recipient and the first sent message.
+func (repo *Repository) GetSentParts(notificationId int64, recipientId int64) (int, int, error) {
+	q := `SELECT sent_parts, COALESCE(telegram_message_id, 0) FROM notification_recipients
+		WHERE notification_id = $1 AND recipient_id = $2`
+
+	var parts, messageId int
+	if err := repo.db.QueryRow(q, notificationId, recipientId).Scan(&parts, &messageId); err != nil {
+		if err == sql.ErrNoRows {
+			return 0, 0, nil
+		}
+		return 0, 0, err
+	}
+	return parts, messageId, nil
+}
+
+func (repo *Repository) SetSentParts(notificationId int64, recipientId int64, parts int, messageId int) error {
+	q := `UPDATE notification_recipients
+		SET sent_parts = $3, telegram_message_id = COALESCE(telegram_message_id, NULLIF($4, 0)), updated_at = now()
+		WHERE notification_id = $1 AND recipient_id = $2`
+
+	_, err := repo.db.Exec(q, notificationId, recipientId, parts, messageId)
+	return err
+}
+
+// GetAttachmentInfo returns the attachment without its data, which is loaded with GetAttachment
+// only when the attachment has to be uploaded.
+func (repo *Repository) GetAttachmentInfo(attachmentId int64) (model.Attachment, error) {
+	q := `SELECT id, type, COALESCE(url, ''), COALESCE(file_name, ''), COALESCE(file_id, '')
+		FROM attachments WHERE id = $1`
+
+	var attachment model.Attachment
+	row := repo.db.QueryRow(q, attachmentId)
+	err := row.Scan(&attachment.Id, &attachment.Type, &attachment.Url, &attachment.FileName, &attachment.FileId)
+	if err != nil {
+		return attachment, err
+	}
+
+	return attachment, nil
+}
+
+func (repo *Repository) GetAttachment(attachmentId int64) (model.Attachment, error) {
+	q := `SELECT id, type, COALESCE(url, ''), data, COALESCE(file_name, ''), COALESCE(file_id, '')
+		FROM attachments WHERE id = $1`
+
+	var attachment model.Attachment
+	row := repo.db.QueryRow(q, attachmentId)
+	err := row.Scan(&attachment.Id, &attachment.Type, &attachment.Url, &attachment.Data,
+		&attachment.FileName, &attachment.FileId)
+	if err != nil {
+		return attachment, err
+	}
+
+	return attachment, nil
+}
+
+func (repo *Repository) SetAttachmentFileId(attachmentId int64, fileId string) error {
+	q := `UPDATE attachments SET file_id = $2, data = NULL WHERE id = $1`
+
+	_, err := repo.db.Exec(q, attachmentId, fileId)
+	return err
+}
+
+// CompleteNotification marks the notification as completed once none of its recipients are waiting for it
+// and schedules the delivery of its summary to the webhook of the sender, if there is one.
+// It returns false if the notification is not completed yet or was completed before and has not changed since.
+func (repo *Repository) CompleteNotification(notificationId int64) (bool, error) {
+	tx, err := repo.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	q := `UPDATE notifications SET completed_at = now()
+		WHERE id = $1 AND completed_at IS NULL AND NOT EXISTS(
+			SELECT 1 FROM notification_recipients WHERE notification_id = $1 AND status = ANY($2))
+		RETURNING sender, completed_at`
+
+	pending := []string{model.StatusScheduled, model.StatusQueued, model.StatusRetrying}
+	summary := model.NotificationSummary{Event: eventDeliverySummary, NotificationId: notificationId}
+	row := tx.QueryRow(q, notificationId, pq.Array(pending))
+	if err := row.Scan(&summary.Sender, &summary.CompletedAt); err != nil {
+		if err == sql.ErrNoRows {
+			return false, nil
+		}
+		return false, err
+	}
+
+	q = `SELECT COALESCE(u.username, r.recipient_id::text), r.status, r.telegram_message_id, r.error
+		FROM notification_recipients r LEFT JOIN users u ON u.id = r.recipient_id
+		WHERE r.notification_id = $1 ORDER BY r.recipient_id`
+
+	rows, err := tx.Query(q, notificationId)
+	if err != nil {
+		return false, err
+	}
+	for rows.Next() {
+		var recipient model.RecipientSummary
+		if err := rows.Scan(&recipient.UserName, &recipient.Status, &recipient.TelegramMessageId, &recipient.Error); err != nil {
+			rows.Close()
+			return false, err
+		}
+		summary.Recipients = append(summary.Recipients, recipient)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return false, err
+	}
+
+	payload, err := json.Marshal(summary)
+	if err != nil {
+		return false, err
+	}
+
+	q = `INSERT INTO webhook_deliveries (notification_id, url, secret, payload)
+		SELECT n.id, w.url, w.secret, $2 FROM notifications n JOIN webhooks w ON w.owner_id = n.sender_id
+		WHERE n.id = $1`
+
+	if _, err := tx.Exec(q, notificationId, string(payload)); err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
+
+// ClaimWebhookDeliveries returns up to limit pending webhook deliveries due by now and postpones them,
+// so they are claimed again if the claimer fails. The claim must be renewed before every request.
+func (repo *Repository) ClaimWebhookDeliveries(now time.Time, limit int) ([]model.WebhookDelivery, error) {
+	q := `UPDATE webhook_deliveries SET next_attempt_at = $1 + $4 * interval '1 second'
+		WHERE id IN (
+			SELECT id FROM webhook_deliveries
+			WHERE status = $3 AND next_attempt_at <= $1
+			ORDER BY next_attempt_at
+			LIMIT $2
+			FOR UPDATE SKIP LOCKED)
+		RETURNING id, notification_id, url, COALESCE(secret, ''), payload, status, attempts, next_attempt_at`
+
+	rows, err := repo.db.Query(q, now, limit, model.WebhookPending, webhookClaimTimeout.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deliveries []model.WebhookDelivery
+	for rows.Next() {
+		var delivery model.WebhookDelivery
+		err := rows.Scan(&delivery.Id, &delivery.NotificationId, &delivery.Url, &delivery.Secret,
+			&delivery.Payload, &delivery.Status, &delivery.Attempts, &delivery.ClaimedUntil)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, delivery)
+	}
+
+	return deliveries, rows.Err()
+}
+
+// RenewWebhookClaim extends the claim of the delivery from now and returns when it expires.
+// It returns false if the claim has expired and the delivery is claimed by someone else.
+func (repo *Repository) RenewWebhookClaim(delivery model.WebhookDelivery, now time.Time) (time.Time, bool, error) {
+	q := `UPDATE webhook_deliveries SET next_attempt_at = $3 + $4 * interval '1 second'
+		WHERE id = $1 AND next_attempt_at = $2 AND status = $5
+		RETURNING next_attempt_at`
+
+	var claimedUntil time.Time
+	row := repo.db.QueryRow(q, delivery.Id, delivery.ClaimedUntil, now, webhookClaimTimeout.Seconds(),
+		model.WebhookPending)
+	if err := row.Scan(&claimedUntil); err != nil {
+		if err == sql.ErrNoRows {
+			return claimedUntil, false, nil
+		}
+		return claimedUntil, false, err
+	}
+	return claimedUntil, true, nil
+}
+
+// UpdateWebhookDelivery saves the outcome of the attempt unless the claim of the delivery has been lost.
+func (repo *Repository) UpdateWebhookDelivery(delivery model.WebhookDelivery) error {
+	q := `UPDATE webhook_deliveries
+		SET status = $2, attempts = $3, response_code = NULLIF($4, 0), error = NULLIF($5, ''), next_attempt_at = $6,
+			delivered_at = CASE WHEN $2 = $7 THEN now() END
+		WHERE id = $1 AND next_attempt_at = $8`
+
+	_, err := repo.db.Exec(q, delivery.Id, delivery.Status, delivery.Attempts, delivery.ResponseCode, delivery.Error,
+		delivery.NextAttemptAt, model.WebhookDelivered, delivery.ClaimedUntil)
+	return err
+}
+
+func (repo *Repository) IsMessageProcessed(messageId string) (bool, error) {
+	q := `SELECT EXISTS(SELECT 1 FROM processed_messages WHERE message_id = $1)`
+
+	var processed bool
+	if err := repo.db.QueryRow(q, messageId).Scan(&processed); err != nil {
+		return false, err
+	}
+	return processed, nil
+}
+
+func (repo *Repository) MarkMessageProcessed(messageId string) error {
+	q := `INSERT INTO processed_messages (message_id) VALUES ($1) ON CONFLICT DO NOTHING`
+
+	_, err := repo.db.Exec(q, messageId)
+	return err
+}
+
+// DeleteProcessedMessages deletes processed messages older than before and returns how many were deleted.
+func (repo *Repository) DeleteProcessedMessages(before time.Time) (int64, error) {
+	q := `DELETE FROM processed_messages WHERE processed_at < $1`
+
+	res, err := repo.db.Exec(q, before)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (repo *Repository) DeactivateUser(userId int64) error {
+	q := `UPDATE users SET is_active = false WHERE id = $1 AND is_active`
+
+	_, err := repo.db.Exec(q, userId)
+	return err
+}
@@ -0,0 +1,235 @@
+package sender
+
+import (
+	"sort"
+	"sync"
+
+	"notification_sender/internal/model"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// fileCache remembers telegram file ids of uploaded attachments,
+// so an attachment is uploaded once however many recipients it has.
+type fileCache struct {
+	mu      sync.Mutex
+	fileIds map[int64]string
+	// uploads serializes sending of attachments which are not uploaded yet
+	uploads map[int64]*sync.Mutex
+}
+
+func newFileCache() *fileCache {
+	return &fileCache{
+		fileIds: make(map[int64]string),
+		uploads: make(map[int64]*sync.Mutex),
+	}
+}
+
+func (c *fileCache) get(attachmentId int64) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fileId, ok := c.fileIds[attachmentId]
+	return fileId, ok
+}
+
+func (c *fileCache) set(attachmentId int64, fileId string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.fileIds[attachmentId] = fileId
+	delete(c.uploads, attachmentId)
+}
+
+// lock locks uploading of the attachments in the order of their ids to avoid deadlocks
+// and returns the function to unlock them.
+func (c *fileCache) lock(attachmentIds []int64) func() {
+	ids := append([]int64(nil), attachmentIds...)
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	var locks []*sync.Mutex
+	for i, id := range ids {
+		if i > 0 && ids[i-1] == id {
+			continue
+		}
+		c.mu.Lock()
+		lock, ok := c.uploads[id]
+		if !ok {
+			lock = &sync.Mutex{}
+			c.uploads[id] = lock
+		}
+		c.mu.Unlock()
+
+		lock.Lock()
+		locks = append(locks, lock)
+	}
+
+	return func() {
+		for _, lock := range locks {
+			lock.Unlock()
+		}
+	}
+}
+
+// resolve returns the file to send and whether it is going to be uploaded.
+// The file of an attachment stored with its data is nil, the data is loaded by load once the upload is locked,
+// so it is not loaded at all if another worker uploads the attachment in the meantime.
+func (s *Service) resolve(attachment model.Attachment) (tgbotapi.RequestFileData, bool, error) {
+	if attachment.FileId != "" {
+		return tgbotapi.FileID(attachment.FileId), false, nil
+	}
+	if fileId, ok := s.files.get(attachment.Id); ok {
+		return tgbotapi.FileID(fileId), false, nil
+	}
+
+	stored, err := s.repo.GetAttachmentInfo(attachment.Id)
+	if err != nil {
+		return nil, false, err
+	}
+	switch {
+	case stored.FileId != "":
+		s.files.set(attachment.Id, stored.FileId)
+		return tgbotapi.FileID(stored.FileId), false, nil
+	case stored.Url != "":
+		return tgbotapi.FileURL(stored.Url), true, nil
+	default:
+		return nil, true, nil
+	}
+}
+
+// load returns the file of an attachment stored with its data.
+func (s *Service) load(attachment model.Attachment) (tgbotapi.RequestFileData, error) {
+	stored, err := s.repo.GetAttachment(attachment.Id)
+	if err != nil {
+		return nil, err
+	}
+	// the attachment may have been uploaded by another sender, its data is dropped then
+	if stored.FileId != "" {
+		s.files.set(attachment.Id, stored.FileId)
+		return tgbotapi.FileID(stored.FileId), nil
+	}
+
+	name := stored.FileName
+	if name == "" {
+		name = attachment.Type
+	}
+	return tgbotapi.FileBytes{Name: name, Bytes: stored.Data}, nil
+}
+
+// sendAttachments sends the attachments as a single photo, a single document or a media group
+// with the caption on the first item, and returns the first sent message.
+// The keyboard is only sent with a single attachment.
+func (s *Service) sendAttachments(chatId int64, attachments []model.Attachment, caption string, parseMode string, keyboard interface{}) (tgbotapi.Message, error) {
+	files := make([]tgbotapi.RequestFileData, len(attachments))
+	var uploading []int64
+	for i, attachment := range attachments {
+		file, upload, err := s.resolve(attachment)
+		if err != nil {
+			return tgbotapi.Message{}, err
+		}
+		files[i] = file
+		if upload {
+			uploading = append(uploading, attachment.Id)
+		}
+	}
+
+	if len(uploading) > 0 {
+		unlock := s.files.lock(uploading)
+		defer unlock()
+
+		// another worker could upload the files while this one was waiting
+		for i, attachment := range attachments {
+			if fileId, ok := s.files.get(attachment.Id); ok {
+				files[i] = tgbotapi.FileID(fileId)
+				continue
+			}
+			if files[i] == nil {
+				file, err := s.load(attachment)
+				if err != nil {
+					return tgbotapi.Message{}, err
+				}
+				files[i] = file
+			}
+		}
+	}
+
+	var sent []tgbotapi.Message
+	err := s.request(chatId, func() error {
+		var err error
+		sent, err = s.sendFiles(chatId, attachments, files, caption, parseMode, keyboard)
+		return err
+	})
+	if err != nil {
+		return tgbotapi.Message{}, err
+	}
+
+	for i, attachment := range attachments {
+		if _, ok := files[i].(tgbotapi.FileID); ok || i >= len(sent) {
+			continue
+		}
+		fileId := sentFileId(sent[i])
+		if fileId == "" {
+			continue
+		}
+		s.files.set(attachment.Id, fileId)
+		if err := s.repo.SetAttachmentFileId(attachment.Id, fileId); err != nil {
+			s.logger.Error().Msgf("failed to save file id of attachment %v: %v", attachment.Id, err)
+		}
+	}
+
+	if len(sent) == 0 {
+		return tgbotapi.Message{}, nil
+	}
+	return sent[0], nil
+}
+
+func (s *Service) sendFiles(chatId int64, attachments []model.Attachment, files []tgbotapi.RequestFileData, caption string, parseMode string, keyboard interface{}) ([]tgbotapi.Message, error) {
+	if len(attachments) == 1 {
+		var config tgbotapi.Chattable
+		if attachments[0].Type == model.AttachmentPhoto {
+			photo := tgbotapi.NewPhoto(chatId, files[0])
+			photo.Caption, photo.ParseMode = caption, parseMode
+			photo.ReplyMarkup = keyboard
+			config = photo
+		} else {
+			document := tgbotapi.NewDocument(chatId, files[0])
+			document.Caption, document.ParseMode = caption, parseMode
+			document.ReplyMarkup = keyboard
+			config = document
+		}
+
+		sent, err := s.botApi.Send(config)
+		if err != nil {
+			return nil, err
+		}
+		return []tgbotapi.Message{sent}, nil
+	}
+
+	media := make([]interface{}, len(attachments))
+	for i, attachment := range attachments {
+		if attachment.Type == model.AttachmentPhoto {
+			item := tgbotapi.NewInputMediaPhoto(files[i])
+			if i == 0 {
+				item.Caption, item.ParseMode = caption, parseMode
+			}
+			media[i] = item
+		} else {
+			item := tgbotapi.NewInputMediaDocument(files[i])
+			if i == 0 {
+				item.Caption, item.ParseMode = caption, parseMode
+			}
+			media[i] = item
+		}
+	}
+	return s.botApi.SendMediaGroup(tgbotapi.NewMediaGroup(chatId, media))
+}
+
+func sentFileId(message tgbotapi.Message) string {
+	switch {
+	case len(message.Photo) > 0:
+		// the largest size goes last
+		return message.Photo[len(message.Photo)-1].FileID
+	case message.Document != nil:
+		return message.Document.FileID
+	default:
+		return ""
+	}
+}
@@ -1,42 +1,289 @@
 package sender
 
 import (
+	"expvar"
+	"fmt"
+	"net/http"
+	"notification_sender/internal/formatting"
+	"notification_sender/internal/limiter"
 	"notification_sender/internal/model"
 	"os"
 	"strconv"
+	"time"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 	"github.com/rs/zerolog"
 )
 
+// how many times a message is resent after telegram responds with 429 before giving up
+const maxRateLimitRetries = 5
+
+var (
+	throttledTotal    = expvar.NewInt("sender_throttled_total")
+	throttledMillis   = expvar.NewInt("sender_throttled_milliseconds_total")
+	rateLimitedTotal  = expvar.NewInt("sender_telegram_429_total")
+	rateLimitedMillis = expvar.NewInt("sender_telegram_429_wait_milliseconds_total")
+)
+
+type repo interface {
+	GetAttachmentInfo(attachmentId int64) (model.Attachment, error)
+	GetAttachment(attachmentId int64) (model.Attachment, error)
+	SetAttachmentFileId(attachmentId int64, fileId string) error
+	GetSentParts(notificationId int64, recipientId int64) (int, int, error)
+	SetSentParts(notificationId int64, recipientId int64, parts int, messageId int) error
+}
+
 type Service struct {
-	logger zerolog.Logger
-	botApi *tgbotapi.BotAPI
+	logger        zerolog.Logger
+	repo          repo
+	files         *fileCache
+	botApi        *tgbotapi.BotAPI
+	globalLimiter *limiter.Limiter
+	chatLimiter   *limiter.ChatLimiter
 }
 
-func NewService(logger zerolog.Logger) (*Service, error) {
+func NewService(logger zerolog.Logger, repo repo) (*Service, error) {
 	l := logger.With().Str("component", "sender").Logger()
 
+	globalRate, chatInterval, err := getRateLimits()
+	if err != nil {
+		return nil, err
+	}
+
 	bot, err := tgbotapi.NewBotAPI(os.Getenv("TELEGRAM_APITOKEN"))
 	if err != nil {
 		return nil, err
 	}
 
 	return &Service{
-		logger: l,
-		botApi: bot,
+		logger:        l,
+		repo:          repo,
+		files:         newFileCache(),
+		botApi:        bot,
+		globalLimiter: limiter.NewLimiter(globalRate, int(globalRate)),
+		chatLimiter:   limiter.NewChatLimiter(chatInterval),
 	}, nil
 }
 
-func (s *Service) Send(notification model.Notification) error {
-	for _, recipient := range notification.RecipientsId {
-		id, _ := strconv.ParseInt(recipient, 10, 64)
-		message := tgbotapi.NewMessage(id, notification.Message)
+func (s *Service) Send(recipientId int64, notification model.Notification) model.Delivery {
+	delivery := model.Delivery{RecipientId: recipientId}
+
+	messageId, err := s.deliver(recipientId, notification)
+	if err != nil {
+		s.logger.Error().Msgf("failed to send message to telegram: %v", err)
+		delivery.Status = model.StatusFailed
+		delivery.Reason = err.Error()
+		delivery.Retryable = true
+		if e, ok := err.(*tgbotapi.Error); ok {
+			switch e.Code {
+			case http.StatusForbidden:
+				delivery.Status = model.StatusBlocked
+				delivery.Retryable = false
+			case http.StatusBadRequest:
+				// chat not found, user is deactivated, etc.
+				delivery.Retryable = false
+			}
+		}
+		return delivery
+	}
+
+	delivery.Status = model.StatusSent
+	delivery.MessageId = messageId
+	return delivery
+}
+
+// deliver sends the attachments and the message and returns the id of the first sent message.
+// Long messages go in several parts, a retry after a failure sends only the parts which are not sent yet.
+func (s *Service) deliver(chatId int64, notification model.Notification) (int, error) {
+	var parts []string
+	if notification.Message != "" {
+		var err error
+		// the receiver validates messages, so this fails only for notifications published before
+		parts, err = formatting.Split(notification.Format, notification.Message, formatting.MaxMessageLength)
+		if err != nil {
+			return 0, err
+		}
+	}
+	parseMode := formatting.ParseMode(notification.Format)
+	keyboard := inlineKeyboard(notification)
+
+	caption := ""
+	var captionKeyboard interface{}
+	if len(notification.Attachments) > 0 {
+		// media groups can not have a keyboard, so it goes with the message then
+		captionable := keyboard == nil || len(notification.Attachments) == 1
+		if captionable && len(parts) == 1 && formatting.Length(parts[0]) <= formatting.MaxCaptionLength {
+			caption, parts = parts[0], nil
+			if keyboard != nil {
+				captionKeyboard = *keyboard
+			}
+		}
+	}
+
+	// the attachments are the first step if there are any, then every part of the message
+	steps := len(parts)
+	if len(notification.Attachments) > 0 {
+		steps++
+	}
+	progress := s.newProgress(notification.Id, chatId, steps)
+
+	if len(notification.Attachments) > 0 && !progress.skip() {
+		sent, err := s.sendAttachments(chatId, notification.Attachments, caption, parseMode, captionKeyboard)
+		if err != nil {
+			return progress.firstId, err
+		}
+		progress.done(sent.MessageID)
+	}
+
+	for i, part := range parts {
+		if progress.skip() {
+			continue
+		}
+		message := tgbotapi.NewMessage(chatId, part)
+		message.ParseMode = parseMode
+		if keyboard != nil && i == len(parts)-1 {
+			message.ReplyMarkup = *keyboard
+		}
+
+		var sent tgbotapi.Message
+		err := s.request(chatId, func() error {
+			var err error
+			sent, err = s.botApi.Send(message)
+			return err
+		})
+		if err != nil {
+			return progress.firstId, err
+		}
+		progress.done(sent.MessageID)
+	}
+	return progress.firstId, nil
+}
+
+// progress counts the sent steps of a delivery and records them if there are several,
+// a delivery of a single step is either sent or not.
+type progress struct {
+	s              *Service
+	notificationId int64
+	chatId         int64
+	steps          int
+	sent           int
+	step           int
+	firstId        int
+}
+
+func (s *Service) newProgress(notificationId int64, chatId int64, steps int) *progress {
+	p := &progress{s: s, notificationId: notificationId, chatId: chatId, steps: steps}
+	// notifications published before status tracking have no id
+	if notificationId == 0 || steps < 2 {
+		return p
+	}
+	sent, firstId, err := s.repo.GetSentParts(notificationId, chatId)
+	if err != nil {
+		// sending twice is better than not sending at all
+		s.logger.Error().Msgf("failed to get sent parts of notification %v for %v: %v", notificationId, chatId, err)
+		return p
+	}
+	p.sent, p.firstId = sent, firstId
+	return p
+}
+
+// skip returns true if the next step is sent already.
+func (p *progress) skip() bool {
+	if p.step < p.sent {
+		p.step++
+		return true
+	}
+	return false
+}
 
-		if _, err := s.botApi.Send(message); err != nil {
-			s.logger.Error().Msgf("failed to send message to telegram: %v", err)
+// done records the sent step, the last one is recorded with the status of the delivery.
+func (p *progress) done(messageId int) {
+	p.step++
+	if p.firstId == 0 {
+		p.firstId = messageId
+	}
+	if p.notificationId == 0 || p.step >= p.steps {
+		return
+	}
+	if err := p.s.repo.SetSentParts(p.notificationId, p.chatId, p.step, p.firstId); err != nil {
+		p.s.logger.Error().Msgf("failed to save sent parts of notification %v for %v: %v", p.notificationId,
+			p.chatId, err)
+	}
+}
+
+// inlineKeyboard returns the keyboard of the notification buttons or nil if there are none.
+func inlineKeyboard(notification model.Notification) *tgbotapi.InlineKeyboardMarkup {
+	if len(notification.Buttons) == 0 {
+		return nil
+	}
+
+	rows := make([][]tgbotapi.InlineKeyboardButton, 0, len(notification.Buttons))
+	for _, buttons := range notification.Buttons {
+		row := make([]tgbotapi.InlineKeyboardButton, 0, len(buttons))
+		for _, button := range buttons {
+			if button.Url != "" {
+				row = append(row, tgbotapi.NewInlineKeyboardButtonURL(button.Text, button.Url))
+			} else {
+				data := fmt.Sprintf("%d:%s", notification.Id, button.Action)
+				row = append(row, tgbotapi.NewInlineKeyboardButtonData(button.Text, data))
+			}
+		}
+		rows = append(rows, row)
+	}
+
+	keyboard := tgbotapi.NewInlineKeyboardMarkup(rows...)
+	return &keyboard
+}
+
+// request waits for the rate limiters and makes the request to telegram,
+// pausing all sending for as long as telegram asks on 429.
+func (s *Service) request(chatId int64, request func() error) error {
+	for attempt := 0; ; attempt++ {
+		s.wait(chatId)
+
+		err := request()
+		e, ok := err.(*tgbotapi.Error)
+		if !ok || e.Code != http.StatusTooManyRequests || attempt >= maxRateLimitRetries {
 			return err
 		}
+
+		retryAfter := time.Duration(e.RetryAfter) * time.Second
+		if retryAfter <= 0 {
+			retryAfter = time.Second
+		}
+		rateLimitedTotal.Add(1)
+		rateLimitedMillis.Add(retryAfter.Milliseconds())
+		s.logger.Warn().Msgf("telegram rate limit exceeded, sending is paused for %v", retryAfter)
+		s.globalLimiter.Pause(retryAfter)
+	}
+}
+
+func (s *Service) wait(chatId int64) {
+	delay := s.chatLimiter.Wait(chatId) + s.globalLimiter.Wait()
+	if delay > 0 {
+		throttledTotal.Add(1)
+		throttledMillis.Add(delay.Milliseconds())
 	}
-	return nil
+}
+
+func getRateLimits() (float64, time.Duration, error) {
+	globalRate := 30.0
+	if value, ok := os.LookupEnv("TELEGRAM_GLOBAL_RATE"); ok {
+		var err error
+		globalRate, err = strconv.ParseFloat(value, 64)
+		if err != nil || globalRate < 1 {
+			return 0, 0, fmt.Errorf("failed to parse TELEGRAM_GLOBAL_RATE: %v", value)
+		}
+	}
+
+	chatInterval := time.Second
+	if value, ok := os.LookupEnv("TELEGRAM_CHAT_INTERVAL"); ok {
+		var err error
+		chatInterval, err = time.ParseDuration(value)
+		if err != nil || chatInterval < 0 {
+			return 0, 0, fmt.Errorf("failed to parse TELEGRAM_CHAT_INTERVAL: %v", value)
+		}
+	}
+
+	return globalRate, chatInterval, nil
 }
@@ -0,0 +1,5 @@
+package webhook
+
+import "errors"
+
+var ErrForbiddenAddress = errors.New("webhook address is not public")
@@ -0,0 +1,221 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"notification_sender/internal/model"
+
+	"github.com/rs/zerolog"
+)
+
+const (
+	pollInterval = time.Second
+	// how many due deliveries are claimed at once
+	batchSize = 100
+	// how many requests of a batch are made at once, so a batch takes at most
+	// batchSize / concurrency * requestTimeout, well within the claim of the deliveries
+	concurrency = 10
+
+	requestTimeout = 10 * time.Second
+	maxRetryDelay  = time.Hour
+)
+
+type repo interface {
+	ClaimWebhookDeliveries(now time.Time, limit int) ([]model.WebhookDelivery, error)
+	RenewWebhookClaim(delivery model.WebhookDelivery, now time.Time) (time.Time, bool, error)
+	UpdateWebhookDelivery(delivery model.WebhookDelivery) error
+}
+
+// Service posts summaries of completed notifications to the webhooks of their senders,
+// retrying failed requests with exponential backoff.
+type Service struct {
+	logger      zerolog.Logger
+	repo        repo
+	client      *http.Client
+	clock       Clock
+	maxAttempts int
+	retryDelay  time.Duration
+}
+
+// NewService creates the service. If the client is nil, the default one connects only to public addresses
+// and times out after requestTimeout.
+func NewService(logger zerolog.Logger, repo repo, client *http.Client, clock Clock) (*Service, error) {
+	l := logger.With().Str("component", "webhook").Logger()
+
+	maxAttempts, retryDelay, err := getRetryPolicy()
+	if err != nil {
+		return nil, err
+	}
+	if client == nil {
+		client = newPublicClient(requestTimeout)
+	}
+
+	return &Service{
+		logger:      l,
+		repo:        repo,
+		client:      client,
+		clock:       clock,
+		maxAttempts: maxAttempts,
+		retryDelay:  retryDelay,
+	}, nil
+}
+
+// Run delivers due webhook requests until the context is done.
+func (s *Service) Run(ctx context.Context) {
+	for {
+		for s.DeliverDue() == batchSize {
+			// there may be more due deliveries
+			if ctx.Err() != nil {
+				return
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.clock.After(pollInterval):
+		}
+	}
+}
+
+// DeliverDue makes one batch of due webhook requests and returns how many deliveries were claimed.
+func (s *Service) DeliverDue() int {
+	deliveries, err := s.repo.ClaimWebhookDeliveries(s.clock.Now(), batchSize)
+	if err != nil {
+		s.logger.Error().Msgf("failed to get due webhook deliveries: %v", err)
+		return 0
+	}
+
+	claimed := make(chan model.WebhookDelivery)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for delivery := range claimed {
+				s.deliverClaimed(delivery)
+			}
+		}()
+	}
+	for _, delivery := range deliveries {
+		claimed <- delivery
+	}
+	close(claimed)
+	wg.Wait()
+
+	return len(deliveries)
+}
+
+// deliverClaimed renews the claim of the delivery, so it is not claimed again while the request is made,
+// then makes the request and saves its outcome. Deliveries claimed by someone else meanwhile are skipped.
+func (s *Service) deliverClaimed(delivery model.WebhookDelivery) {
+	claimedUntil, ok, err := s.repo.RenewWebhookClaim(delivery, s.clock.Now())
+	if err != nil {
+		s.logger.Error().Msgf("failed to renew claim of webhook delivery %v: %v", delivery.Id, err)
+		return
+	}
+	if !ok {
+		s.logger.Warn().Msgf("webhook delivery %v is claimed by someone else", delivery.Id)
+		return
+	}
+	delivery.ClaimedUntil = claimedUntil
+
+	delivery = s.Deliver(delivery)
+	if err := s.repo.UpdateWebhookDelivery(delivery); err != nil {
+		s.logger.Error().Msgf("failed to update webhook delivery %v: %v", delivery.Id, err)
+	}
+}
+
+// Deliver makes one attempt of the webhook request and returns the delivery with its outcome:
+// delivered, pending with the time of the next attempt, or failed once the attempts are exhausted.
+func (s *Service) Deliver(delivery model.WebhookDelivery) model.WebhookDelivery {
+	delivery.Attempts++
+	delivery.ResponseCode, delivery.Error = 0, ""
+
+	err := s.post(&delivery)
+	if err == nil {
+		delivery.Status = model.WebhookDelivered
+		s.logger.Info().Msgf("delivered summary of notification %v to %v", delivery.NotificationId, delivery.Url)
+		return delivery
+	}
+	delivery.Error = err.Error()
+
+	if delivery.Attempts >= s.maxAttempts {
+		delivery.Status = model.WebhookFailed
+		s.logger.Error().Msgf("failed to deliver summary of notification %v to %v after %v attempts: %v",
+			delivery.NotificationId, delivery.Url, delivery.Attempts, err)
+		return delivery
+	}
+
+	delay := s.retryDelay
+	for i := 1; i < delivery.Attempts && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+	delivery.Status = model.WebhookPending
+	delivery.NextAttemptAt = s.clock.Now().Add(delay)
+	s.logger.Warn().Msgf("summary of notification %v will be posted to %v again in %v (attempt %v): %v",
+		delivery.NotificationId, delivery.Url, delay, delivery.Attempts, err)
+	return delivery
+}
+
+func (s *Service) post(delivery *model.WebhookDelivery) error {
+	request, err := http.NewRequest(http.MethodPost, delivery.Url, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return err
+	}
+
+	timestamp := strconv.FormatInt(s.clock.Now().Unix(), 10)
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(DeliveryHeader, strconv.FormatInt(delivery.Id, 10))
+	request.Header.Set(TimestampHeader, timestamp)
+	if delivery.Secret != "" {
+		request.Header.Set(SignatureHeader, Sign(delivery.Secret, timestamp, delivery.Payload))
+	}
+
+	response, err := s.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	// the body is drained so the connection can be reused
+	io.Copy(io.Discard, io.LimitReader(response.Body, 1<<16))
+
+	delivery.ResponseCode = response.StatusCode
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded with status %v", response.StatusCode)
+	}
+	return nil
+}
+
+func getRetryPolicy() (int, time.Duration, error) {
+	maxAttempts := 10
+	if value, ok := os.LookupEnv("WEBHOOK_MAX_ATTEMPTS"); ok {
+		var err error
+		maxAttempts, err = strconv.Atoi(value)
+		if err != nil || maxAttempts < 1 {
+			return 0, 0, fmt.Errorf("failed to parse WEBHOOK_MAX_ATTEMPTS: %v", value)
+		}
+	}
+
+	retryDelay := 10 * time.Second
+	if value, ok := os.LookupEnv("WEBHOOK_RETRY_DELAY"); ok {
+		var err error
+		retryDelay, err = time.ParseDuration(value)
+		if err != nil || retryDelay <= 0 {
+			return 0, 0, fmt.Errorf("failed to parse WEBHOOK_RETRY_DELAY: %v", value)
+		}
+	}
+
+	return maxAttempts, retryDelay, nil
+}
@@ -0,0 +1,276 @@
+package webhook
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"notification_sender/internal/model"
+
+	"github.com/rs/zerolog"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	return make(chan time.Time)
+}
+
+type fakeRepo struct {
+	mu         sync.Mutex
+	due        []model.WebhookDelivery
+	lost       map[int64]bool
+	renewedAt  []time.Time
+	deliveries map[int64]model.WebhookDelivery
+}
+
+func (r *fakeRepo) ClaimWebhookDeliveries(now time.Time, limit int) ([]model.WebhookDelivery, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	due := r.due
+	if len(due) > limit {
+		due = due[:limit]
+	}
+	r.due = r.due[len(due):]
+	return due, nil
+}
+
+func (r *fakeRepo) RenewWebhookClaim(delivery model.WebhookDelivery, now time.Time) (time.Time, bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.lost[delivery.Id] {
+		return time.Time{}, false, nil
+	}
+	r.renewedAt = append(r.renewedAt, now)
+	return now.Add(5 * time.Minute), true, nil
+}
+
+func (r *fakeRepo) UpdateWebhookDelivery(delivery model.WebhookDelivery) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.deliveries[delivery.Id] = delivery
+	return nil
+}
+
+func newTestService(t *testing.T, client *http.Client, now time.Time) (*Service, *fakeRepo) {
+	t.Setenv("WEBHOOK_MAX_ATTEMPTS", "4")
+	t.Setenv("WEBHOOK_RETRY_DELAY", "10s")
+
+	repo := &fakeRepo{lost: make(map[int64]bool), deliveries: make(map[int64]model.WebhookDelivery)}
+	s, err := NewService(zerolog.Nop(), repo, client, &fakeClock{now: now})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, repo
+}
+
+func TestDeliverSignsRequest(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	payload := []byte(`{"event":"delivery_summary","notificationId":7}`)
+
+	var header http.Header
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header.Clone()
+		body, _ = io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	s, _ := newTestService(t, server.Client(), now)
+	delivery := s.Deliver(model.WebhookDelivery{
+		Id:             3,
+		NotificationId: 7,
+		Url:            server.URL,
+		Secret:         "secret",
+		Payload:        payload,
+	})
+
+	if delivery.Status != model.WebhookDelivered || delivery.ResponseCode != http.StatusNoContent {
+		t.Fatalf("delivery is %v with code %v, want delivered", delivery.Status, delivery.ResponseCode)
+	}
+	if string(body) != string(payload) {
+		t.Errorf("posted %s, want %s", body, payload)
+	}
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	if header.Get(TimestampHeader) != timestamp {
+		t.Errorf("timestamp is %v, want %v", header.Get(TimestampHeader), timestamp)
+	}
+	if header.Get(DeliveryHeader) != "3" {
+		t.Errorf("delivery id is %v, want 3", header.Get(DeliveryHeader))
+	}
+	if want := Sign("secret", timestamp, payload); header.Get(SignatureHeader) != want {
+		t.Errorf("signature is %v, want %v", header.Get(SignatureHeader), want)
+	}
+}
+
+func TestDeliverWithoutSecretIsNotSigned(t *testing.T) {
+	var signature string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		signature = r.Header.Get(SignatureHeader)
+	}))
+	defer server.Close()
+
+	s, _ := newTestService(t, server.Client(), time.Now())
+	s.Deliver(model.WebhookDelivery{Id: 1, Url: server.URL, Payload: []byte(`{}`)})
+
+	if signature != "" {
+		t.Errorf("request without a secret is signed with %v", signature)
+	}
+}
+
+func TestDeliverRetriesWithBackoff(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	s, _ := newTestService(t, server.Client(), now)
+	delivery := model.WebhookDelivery{Id: 1, Url: server.URL, Payload: []byte(`{}`), Status: model.WebhookPending}
+
+	for _, delay := range []time.Duration{10 * time.Second, 20 * time.Second, 40 * time.Second} {
+		delivery = s.Deliver(delivery)
+		if delivery.Status != model.WebhookPending {
+			t.Fatalf("delivery is %v after attempt %v, want pending", delivery.Status, delivery.Attempts)
+		}
+		if !delivery.NextAttemptAt.Equal(now.Add(delay)) {
+			t.Errorf("attempt %v is retried at %v, want in %v", delivery.Attempts, delivery.NextAttemptAt, delay)
+		}
+		if delivery.ResponseCode != http.StatusServiceUnavailable || delivery.Error == "" {
+			t.Errorf("attempt %v has code %v and error %q", delivery.Attempts, delivery.ResponseCode, delivery.Error)
+		}
+	}
+
+	// the last attempt fails the delivery
+	delivery = s.Deliver(delivery)
+	if delivery.Status != model.WebhookFailed || delivery.Attempts != 4 {
+		t.Errorf("delivery is %v after %v attempts, want failed after 4", delivery.Status, delivery.Attempts)
+	}
+	if requests != 4 {
+		t.Errorf("webhook got %v requests, want 4", requests)
+	}
+}
+
+func TestDeliverUnreachableWebhook(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	url := server.URL
+	server.Close()
+
+	s, _ := newTestService(t, &http.Client{Timeout: time.Second}, time.Now())
+	delivery := s.Deliver(model.WebhookDelivery{Id: 1, Url: url, Payload: []byte(`{}`), Attempts: 3})
+
+	if delivery.Status != model.WebhookFailed || delivery.ResponseCode != 0 || delivery.Error == "" {
+		t.Errorf("delivery is %v with code %v and error %q, want failed", delivery.Status, delivery.ResponseCode,
+			delivery.Error)
+	}
+}
+
+func TestDeliverRejectsPrivateAddress(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+	}))
+	defer server.Close()
+
+	// the default client of the service connects only to public addresses
+	s, _ := newTestService(t, nil, time.Now())
+	delivery := s.Deliver(model.WebhookDelivery{Id: 1, Url: server.URL, Payload: []byte(`{}`)})
+
+	if delivery.Status != model.WebhookPending || !strings.Contains(delivery.Error, ErrForbiddenAddress.Error()) {
+		t.Errorf("delivery is %v with error %q, want rejected address", delivery.Status, delivery.Error)
+	}
+	if requests != 0 {
+		t.Errorf("webhook on a loopback address got %v requests", requests)
+	}
+}
+
+func TestIsPublic(t *testing.T) {
+	for address, public := range map[string]bool{
+		"93.184.216.34":    true,
+		"2606:2800:220::1": true,
+		"127.0.0.1":        false,
+		"::1":              false,
+		"10.1.2.3":         false,
+		"172.16.0.1":       false,
+		"192.168.1.1":      false,
+		"169.254.169.254":  false,
+		"100.64.0.1":       false,
+		"0.0.0.0":          false,
+		"::":               false,
+		"fd00::1":          false,
+		"fe80::1":          false,
+		"::ffff:127.0.0.1": false,
+		"::ffff:10.0.0.1":  false,
+	} {
+		if got := isPublic(net.ParseIP(address)); got != public {
+			t.Errorf("%v is public: %v, want %v", address, got, public)
+		}
+	}
+}
+
+func TestDeliverDueRenewsClaims(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	// every request waits for the others, so it passes only if they are made at once
+	var mu sync.Mutex
+	inFlight := 0
+	all := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		inFlight++
+		if inFlight == concurrency {
+			close(all)
+		}
+		mu.Unlock()
+		select {
+		case <-all:
+		case <-time.After(5 * time.Second):
+			w.WriteHeader(http.StatusGatewayTimeout)
+		}
+	}))
+	defer server.Close()
+
+	s, repo := newTestService(t, server.Client(), now)
+	for i := 1; i <= concurrency+1; i++ {
+		repo.due = append(repo.due, model.WebhookDelivery{Id: int64(i), Url: server.URL, Payload: []byte(`{}`)})
+	}
+	// the claim of the last delivery has expired and it is taken by someone else
+	repo.lost[int64(concurrency+1)] = true
+
+	if claimed := s.DeliverDue(); claimed != concurrency+1 {
+		t.Fatalf("claimed %v deliveries, want %v", claimed, concurrency+1)
+	}
+
+	if len(repo.renewedAt) != concurrency {
+		t.Errorf("renewed %v claims, want %v", len(repo.renewedAt), concurrency)
+	}
+	if len(repo.deliveries) != concurrency {
+		t.Errorf("updated %v deliveries, want %v", len(repo.deliveries), concurrency)
+	}
+	for id, delivery := range repo.deliveries {
+		if delivery.Status != model.WebhookDelivered {
+			t.Errorf("delivery %v is %v, want delivered", id, delivery.Status)
+		}
+		if !delivery.ClaimedUntil.Equal(now.Add(5 * time.Minute)) {
+			t.Errorf("delivery %v is updated with claim %v, want the renewed one", id, delivery.ClaimedUntil)
+		}
+	}
+	if _, ok := repo.deliveries[int64(concurrency+1)]; ok {
+		t.Error("delivery claimed by someone else is updated")
+	}
+}